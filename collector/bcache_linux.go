@@ -16,6 +16,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	// https://godoc.org/github.com/prometheus/client_golang/prometheus
@@ -49,10 +50,19 @@ func NewBcacheCollector() (Collector, error) {
 // Update reads and exposes bcache stats.
 // It implements the Collector interface.
 func (c *bcacheCollector) Update(ch chan<- prometheus.Metric) error {
-	stats, err := c.fs.BcacheStats()
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface, the bcache stats
+// are read through the scrape cache.
+func (c *bcacheCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	v, err := fileCacheFrom(ctx).load(sysFilePath("fs/bcache"), func() (interface{}, error) {
+		return c.fs.BcacheStats()
+	})
 	if err != nil {
 		return fmt.Errorf("failed to retrieve bcache stats: %v", err)
 	}
+	stats := v.([]*bcache.Stats)
 
 	for _, s := range stats {
 		c.updateBcacheStats(ch, s)
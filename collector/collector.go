@@ -15,12 +15,15 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/node_exporter/rtpanic"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 // Namespace defines the common namespace to be used by all metrics.
@@ -39,6 +42,14 @@ var (
 		[]string{"collector"},
 		nil,
 	)
+	scrapeTimeoutDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_timeout"),
+		"node_exporter: Whether a collector was abandoned because it exceeded its scrape timeout.",
+		[]string{"collector"},
+		nil,
+	)
+
+	scrapeTimeout = kingpin.Flag("collector.scrape-timeout", "Maximum duration of a scrape, collectors still running after it are abandoned. 0 disables the timeout.").Default("10s").Duration()
 )
 
 const (
@@ -48,52 +59,116 @@ const (
 
 var (
 	factories        = make(map[string]func() (Collector, error))
-	collectorState   = make(map[string]bool)
-	failedCollectors = make(map[string]int) // 失败次数过多, 则踢出收集器列表
+	collectorState   = make(map[string]*bool)
+	forcedCollectors = make(map[string]bool) // collectors which have been explicitly enabled or disabled
+	collectorTimeout = make(map[string]*time.Duration)
+
+	// collectorStateMtx guards the values of collectorState, which can be
+	// changed at runtime by SetCollector
+	collectorStateMtx = sync.RWMutex{}
 )
 
+// ListAllCollectors returns the enabled state of every registered collector.
 func ListAllCollectors() map[string]bool {
-	return collectorState
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
+	res := make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		res[name] = *enabled
+	}
+	return res
 }
 
-func SetCollector(collector string, isEnabled bool) {
+// SetCollector enables or disables a registered collector. It only affects
+// NodeCollectors created afterwards.
+func SetCollector(collector string, isEnabled bool) error {
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
 	if _, ok := collectorState[collector]; !ok {
-		// do nothing
-		return
+		return fmt.Errorf("missing collector: %s", collector)
 	}
 
-	collectorState[collector] = isEnabled
+	*collectorState[collector] = isEnabled
+	return nil
+}
+
+// EnableAllCollectors enables every collector that has not been explicitly
+// disabled by a --no-collector.<name> flag.
+func EnableAllCollectors() {
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	for collector, enabled := range collectorState {
+		if !forcedCollectors[collector] {
+			*enabled = true
+		}
+	}
 }
 
 func registerCollector(collector string, isDefaultEnabled bool, factory func() (Collector, error)) {
+	var helpDefaultState string
+	if isDefaultEnabled {
+		helpDefaultState = "enabled"
+	} else {
+		helpDefaultState = "disabled"
+	}
 
-	collectorState[collector] = isDefaultEnabled
+	flagName := fmt.Sprintf("collector.%s", collector)
+	flagHelp := fmt.Sprintf("Enable the %s collector (default: %s).", collector, helpDefaultState)
+	defaultValue := fmt.Sprintf("%v", isDefaultEnabled)
+
+	flag := kingpin.Flag(flagName, flagHelp).Default(defaultValue).Action(collectorFlagAction(collector)).Bool()
+	collectorState[collector] = flag
+
+	timeoutFlagName := fmt.Sprintf("collector.%s.timeout", collector)
+	timeoutFlagHelp := fmt.Sprintf("Scrape timeout of the %s collector, bounded by --collector.scrape-timeout. 0 means no own timeout.", collector)
+	collectorTimeout[collector] = kingpin.Flag(timeoutFlagName, timeoutFlagHelp).Default("0s").Duration()
 
 	factories[collector] = factory
 }
 
+// collectorFlagAction generates a new action function for the given collector
+// to track whether it has been explicitly enabled or disabled from the command line.
+// A new action function is needed for each collector flag because the ParseContext
+// does not contain information about which flag called the action.
+// See: https://github.com/alecthomas/kingpin/issues/294
+func collectorFlagAction(collector string) func(ctx *kingpin.ParseContext) error {
+	return func(ctx *kingpin.ParseContext) error {
+		forcedCollectors[collector] = true
+		return nil
+	}
+}
+
 // NodeCollector implements the prometheus.Collector interface.
 type NodeCollector struct {
 	Collectors map[string]Collector
+	// timeouts are the own scrape timeouts of the collectors
+	timeouts map[string]time.Duration
 }
 
 // NewNodeCollector creates a new NodeCollector.
 func NewNodeCollector(filters ...string) (*NodeCollector, error) {
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
 	f := make(map[string]bool)
 	for _, filter := range filters {
 		enabled, exist := collectorState[filter]
 		if !exist {
 			return nil, fmt.Errorf("missing collector: %s", filter)
 		}
-		if !enabled {
+		if !*enabled {
 			return nil, fmt.Errorf("disabled collector: %s", filter)
 		}
 		f[filter] = true
 	}
 
 	collectors := make(map[string]Collector)
+	timeouts := make(map[string]time.Duration)
 	for key, enabled := range collectorState {
-		if enabled {
+		if *enabled {
 			collector, err := factories[key]() // call NewxxxCollector()
 			if err != nil {
 				continue
@@ -101,17 +176,27 @@ func NewNodeCollector(filters ...string) (*NodeCollector, error) {
 
 			if len(f) == 0 || f[key] {
 				collectors[key] = collector
+				timeouts[key] = durationOption(optionFlagName(key, "timeout"), collectorTimeout[key])
 			}
 		}
 	}
 
-	return &NodeCollector{Collectors: collectors}, nil
+	return &NodeCollector{Collectors: collectors, timeouts: timeouts}, nil
 }
 
 // Describe implements the prometheus.Collector interface.
 func (n NodeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- scrapeDurationDesc
 	ch <- scrapeSuccessDesc
+	ch <- scrapeTimeoutDesc
+	ch <- scrapeQueueWaitDesc
+	ch <- scrapeQuarantinedDesc
+	ch <- scrapeFailuresDesc
+	ch <- scrapePanicsDesc
+	ch <- scrapeLastErrorDesc
+	ch <- fileReadDurationDesc
+	ch <- fileReadErrorsDesc
+	ch <- fileCacheHitsDesc
 }
 
 // Collect implements the prometheus.Collector interface.
@@ -131,59 +216,166 @@ func (n NodeCollector) Collect(ch chan<- prometheus.Metric) {
 	 *   /home/coanor/go/src/github.com/prometheus/node_exporter/vendor/github.com/prometheus/client_golang/prometheus/registry.go:441 +0x599
 	 */
 
-	wg := sync.WaitGroup{}
-	wg.Add(len(n.Collectors))
-
-	chFailed := make(chan string, len(n.Collectors))
-	defer close(chFailed)
+	ctx := context.Background()
+	if *scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *scrapeTimeout)
+		defer cancel()
+	}
 
 	log.Debugf("node-exporter try collect...")
 
-	for name, c := range n.Collectors {
-		go func(name string, c Collector) {
-			execute(name, c, ch, chFailed)
-			wg.Done()
-		}(name, c)
+	// 同一次采集中, 多个 collector 读取的 procfs/sysfs 文件只读一次
+	ctx = withFileCache(ctx, newFileCache())
+	defer collectFileStats(ch)
+
+	// 限制同时运行的 collector 个数, 按优先级排队
+	queue := make(chan string, len(n.Collectors))
+	for _, name := range scrapeOrder(n.Collectors) {
+		queue <- name
 	}
-	wg.Wait() // 等待所有 collector 跑完
+	close(queue)
 
-	for {
-		select {
-		case name := <-chFailed:
-			n.addFailed(name)
-		default:
-			return
-		}
+	begin := time.Now()
+	wg := sync.WaitGroup{}
+	nworkers := workers(len(n.Collectors))
+	wg.Add(nworkers)
+
+	for i := 0; i < nworkers; i++ {
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				ch <- prometheus.MustNewConstMetric(scrapeQueueWaitDesc, prometheus.GaugeValue, time.Since(begin).Seconds(), name)
+				execute(ctx, name, n.Collectors[name], n.timeouts[name], ch)
+			}
+		}()
 	}
+	wg.Wait() // 等待所有 collector 跑完或超时
 }
 
-func (n NodeCollector) addFailed(name string) {
-	if _, ok := failedCollectors[name]; !ok {
-		failedCollectors[name] = 1
-	} else {
-		failedCollectors[name]++
+var (
+	// collectors abandoned by a previous scrape whose Update() has not
+	// returned yet, they are not started again until it does.
+	stuckCollectors    = make(map[string]bool)
+	stuckCollectorsMtx = sync.Mutex{}
+)
+
+func execute(ctx context.Context, name string, c Collector, timeout time.Duration, ch chan<- prometheus.Metric) {
+	// 由于默认开启了所有的收集器, 所以, 有一些收集器会不成功, 失败次数过多, 则将其隔离, 定期重试
+	defer health.collect(name, ch)
+
+	if !health.shouldRun(name, time.Now()) {
+		log.Debugf("SKIP: %s collector is quarantined", name)
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, 0, name)
+		ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, 0, name)
+		ch <- prometheus.MustNewConstMetric(scrapeTimeoutDesc, prometheus.GaugeValue, 0, name)
+		return
 	}
 
-	// 由于默认开启了所有的收集器, 所以, 有一些收集器会不成功, 失败次数过多, 则将其踢出去
-	if failedCollectors[name] > 3 {
-		log.Warnf("WARN: %s collector failed %d times, remove it.", name, failedCollectors[name])
-		delete(n.Collectors, name)
-	} else {
-		log.Warnf("WARN: %s collector failed %d times", name, failedCollectors[name])
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-}
 
-func execute(name string, c Collector, ch chan<- prometheus.Metric, chFailed chan<- string) {
 	begin := time.Now()
-	err := c.Update(ch)
+	timedOut, err := run(ctx, name, c, ch)
 	duration := time.Since(begin)
 
+	var success, timedOutValue float64
 	if err != nil {
 		log.Errorf("ERROR: %s collector failed after %fs: %s", name, duration.Seconds(), err)
-		chFailed <- name
+		// a collector held back by its neighbours is not failing itself
+		if _, ok := err.(*notStartedError); !ok {
+			health.failure(name, err, time.Now())
+		}
 	} else {
 		log.Debugf("OK: %s collector succeeded after %fs.", name, duration.Seconds())
+		health.success(name)
+		success = 1
+	}
+	if timedOut {
+		timedOutValue = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, name)
+	ch <- prometheus.MustNewConstMetric(scrapeTimeoutDesc, prometheus.GaugeValue, timedOutValue, name)
+}
+
+// run calls the collector and forwards its metrics to ch until it returns or
+// ctx expires. An expired collector is left running in the background, its
+// late metrics are dropped and never written to ch.
+func run(ctx context.Context, name string, c Collector, ch chan<- prometheus.Metric) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		// the scrape timed out while the collector was queued
+		return true, &notStartedError{msg: fmt.Sprintf("%s collector not started: %s", name, err)}
+	}
+
+	stuckCollectorsMtx.Lock()
+	if stuckCollectors[name] {
+		stuckCollectorsMtx.Unlock()
+		return true, &notStartedError{msg: fmt.Sprintf("previous scrape of %s collector still running", name)}
 	}
+	stuckCollectorsMtx.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- update(ctx, name, c, metrics)
+	}()
+
+	for {
+		select {
+		case m := <-metrics:
+			ch <- m
+		case err := <-done:
+			return false, err
+		case <-ctx.Done():
+			stuckCollectorsMtx.Lock()
+			stuckCollectors[name] = true
+			stuckCollectorsMtx.Unlock()
+
+			go func() {
+				// metrics is unbuffered, so once done is received the
+				// collector can not send anything else
+				for {
+					select {
+					case <-metrics:
+					case <-done:
+						stuckCollectorsMtx.Lock()
+						delete(stuckCollectors, name)
+						stuckCollectorsMtx.Unlock()
+						return
+					}
+				}
+			}()
+			return true, fmt.Errorf("%s collector timed out: %s", name, ctx.Err())
+		}
+	}
+}
+
+// notStartedError is the error of a collector which was not started, it is
+// reported as timed out but does not count against its health.
+type notStartedError struct {
+	msg string
+}
+
+func (e *notStartedError) Error() string { return e.msg }
+
+// update calls the collector, a panic of the collector only fails its own
+// scrape and is returned as an error.
+func update(ctx context.Context, name string, c Collector, ch chan<- prometheus.Metric) (err error) {
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		health.panic(name)
+		err = fmt.Errorf("%s collector panicked: %s", name, perr)
+	})
+
+	if cc, ok := c.(ContextCollector); ok {
+		return cc.UpdateContext(ctx, ch)
+	}
+	return c.Update(ch)
 }
 
 // Collector is the interface a collector has to implement.
@@ -192,6 +384,15 @@ type Collector interface {
 	Update(ch chan<- prometheus.Metric) error
 }
 
+// ContextCollector is implemented by collectors which can stop early once
+// their scrape timeout expires.
+type ContextCollector interface {
+	Collector
+	// UpdateContext is called instead of Update, ctx is cancelled when the
+	// collector is abandoned for the current scrape.
+	UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error
+}
+
 type typedDesc struct {
 	desc      *prometheus.Desc
 	valueType prometheus.ValueType
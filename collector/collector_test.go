@@ -0,0 +1,192 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type testCollector struct {
+	desc    *prometheus.Desc
+	release chan struct{}
+}
+
+func (c testCollector) Update(ch chan<- prometheus.Metric) error {
+	if c.release != nil {
+		<-c.release
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1)
+	return nil
+}
+
+func collectScrapeMetrics(t *testing.T, n NodeCollector) map[string]map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		n.Collect(ch)
+		close(ch)
+	}()
+
+	res := map[string]map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		name := m.Desc().String()
+		for _, l := range pb.Label {
+			if l.GetName() == "collector" {
+				if res[l.GetValue()] == nil {
+					res[l.GetValue()] = map[string]float64{}
+				}
+				res[l.GetValue()][name] = pb.GetGauge().GetValue() + pb.GetCounter().GetValue()
+			}
+		}
+	}
+	return res
+}
+
+func TestCollectTimeout(t *testing.T) {
+	defer func(d time.Duration) { *scrapeTimeout = d }(*scrapeTimeout)
+	*scrapeTimeout = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+
+	desc := prometheus.NewDesc("node_test", "test metric", nil, nil)
+	n := NodeCollector{Collectors: map[string]Collector{
+		"fast": testCollector{desc: desc},
+		"slow": testCollector{desc: desc, release: release},
+	}}
+
+	begin := time.Now()
+	res := collectScrapeMetrics(t, n)
+	if d := time.Since(begin); d > time.Second {
+		t.Fatalf("collect took %s, want it to be bounded by the scrape timeout", d)
+	}
+
+	for name, want := range map[string]float64{"fast": 0, "slow": 1} {
+		if got := res[name][scrapeTimeoutDesc.String()]; got != want {
+			t.Errorf("%s: want timeout %v, got %v", name, want, got)
+		}
+		if got := res[name][scrapeSuccessDesc.String()]; got != 1-want {
+			t.Errorf("%s: want success %v, got %v", name, 1-want, got)
+		}
+	}
+}
+
+func TestCollectNotStarted(t *testing.T) {
+	stuckCollectorsMtx.Lock()
+	stuckCollectors["held"] = true
+	stuckCollectorsMtx.Unlock()
+	defer func() {
+		stuckCollectorsMtx.Lock()
+		delete(stuckCollectors, "held")
+		stuckCollectorsMtx.Unlock()
+	}()
+
+	desc := prometheus.NewDesc("node_test", "test metric", nil, nil)
+	n := NodeCollector{Collectors: map[string]Collector{"held": testCollector{desc: desc}}}
+	res := collectScrapeMetrics(t, n)
+
+	// a collector whose previous run is still stuck times out, but does
+	// not fail on its own
+	if got := res["held"][scrapeTimeoutDesc.String()]; got != 1 {
+		t.Errorf("want timeout 1, got %v", got)
+	}
+	if got := res["held"][scrapeSuccessDesc.String()]; got != 0 {
+		t.Errorf("want success 0, got %v", got)
+	}
+	if got := res["held"][scrapeFailuresDesc.String()]; got != 0 {
+		t.Errorf("want no failure counted, got %v", got)
+	}
+}
+
+type panicCollector struct{}
+
+func (panicCollector) Update(ch chan<- prometheus.Metric) error {
+	panic("unknown metric type")
+}
+
+func TestCollectPanic(t *testing.T) {
+	desc := prometheus.NewDesc("node_test", "test metric", nil, nil)
+	n := NodeCollector{Collectors: map[string]Collector{
+		"ok":    testCollector{desc: desc},
+		"panic": panicCollector{},
+	}}
+
+	res := collectScrapeMetrics(t, n)
+
+	for name, want := range map[string]float64{"ok": 0, "panic": 1} {
+		if got := res[name][scrapePanicsDesc.String()]; got != want {
+			t.Errorf("%s: want panics %v, got %v", name, want, got)
+		}
+		if got := res[name][scrapeSuccessDesc.String()]; got != 1-want {
+			t.Errorf("%s: want success %v, got %v", name, 1-want, got)
+		}
+	}
+}
+
+type concurrencyCollector struct {
+	mtx          *sync.Mutex
+	running, max *int
+	order        *[]string
+	name         string
+}
+
+func (c concurrencyCollector) Update(ch chan<- prometheus.Metric) error {
+	c.mtx.Lock()
+	*c.running++
+	if *c.running > *c.max {
+		*c.max = *c.running
+	}
+	*c.order = append(*c.order, c.name)
+	c.mtx.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.mtx.Lock()
+	*c.running--
+	c.mtx.Unlock()
+	return nil
+}
+
+func TestCollectMaxConcurrency(t *testing.T) {
+	defer func(n int) { *maxConcurrency = n }(*maxConcurrency)
+	*maxConcurrency = 1
+
+	var (
+		mtx          sync.Mutex
+		running, max int
+		order        []string
+	)
+	n := NodeCollector{Collectors: map[string]Collector{}}
+	for _, name := range []string{"systemd", "zfs", "loadavg", "cpu"} {
+		n.Collectors[name] = concurrencyCollector{mtx: &mtx, running: &running, max: &max, order: &order, name: name}
+	}
+
+	collectScrapeMetrics(t, n)
+
+	if max != 1 {
+		t.Errorf("want at most 1 collector running, got %d", max)
+	}
+	if want := []string{"cpu", "loadavg", "zfs", "systemd"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("want collectors run in order %v, got %v", want, order)
+	}
+}
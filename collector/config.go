@@ -0,0 +1,329 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/node_exporter/rtpanic"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// CollectorConfig is the configuration of a collector in the config file.
+// Options are the values of its --collector.<name>.<option> flags.
+type CollectorConfig struct {
+	Enabled *bool             `json:"enabled,omitempty"`
+	Timeout string            `json:"timeout,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+var (
+	// baseState is the enabled state of the collectors set by the command
+	// line, before any config was applied.
+	baseState map[string]bool
+	// cmdlineFlags are the collector flags explicitly set on the command
+	// line, they win over the config file.
+	cmdlineFlags map[string]bool
+	// options are the collector options of the applied config, guarded by
+	// collectorStateMtx.
+	options = collectorOptions{}
+)
+
+// collectorOptions are the values of the --collector.<name>.<option> flags
+// set by a config, by flag name, parsed to the type of their flag. They are
+// never modified once applied: a new config creates new options, and the
+// flags keep their command line values, so that reloads do not race with
+// the collectors reading them.
+type collectorOptions map[string]interface{}
+
+// ApplyConfig applies the collector section of the config file. Collectors
+// and flags not in cfgs go back to their command line state. It returns a
+// function restoring the previous state if applying the rest of the config
+// fails. Like SetCollector, it only affects NodeCollectors created
+// afterwards.
+func ApplyConfig(cfgs map[string]*CollectorConfig) (func(), error) {
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	if baseState == nil {
+		saveCmdline()
+	}
+
+	values, errs := checkConfig(cfgs)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	opts := collectorOptions{}
+	for flagName, value := range values {
+		if cmdlineFlags[flagName] {
+			log.Warnf("WARN: flag --%s is set on the command line, ignored the config file", flagName)
+			continue
+		}
+		opts[flagName] = value
+	}
+
+	enabled := make(map[string]bool, len(collectorState))
+	for name, e := range collectorState {
+		enabled[name] = *e
+		if forcedCollectors[name] {
+			continue
+		}
+
+		enabled[name] = baseState[name]
+		if cfg := cfgs[name]; cfg != nil && cfg.Enabled != nil {
+			enabled[name] = *cfg.Enabled
+		}
+	}
+
+	prev := saveConfigState()
+	restoreConfigState(&configState{enabled: enabled, options: opts})
+
+	// the options are mostly checked by the collector constructors, which
+	// read the new options now they are swapped in
+	changed := map[string]bool{}
+	for flagName := range prev.options {
+		changed[optionCollector(flagName)] = true
+	}
+	for flagName := range opts {
+		changed[optionCollector(flagName)] = true
+	}
+	for name := range changed {
+		if !enabled[name] {
+			continue
+		}
+		if err := checkFactory(name); err != nil {
+			restoreConfigState(prev)
+			return nil, fmt.Errorf("collector %s: %s", name, err)
+		}
+	}
+
+	return func() {
+		collectorStateMtx.Lock()
+		defer collectorStateMtx.Unlock()
+		restoreConfigState(prev)
+	}, nil
+}
+
+// CheckConfig reports every problem of the collector section of the config
+// file.
+func CheckConfig(cfgs map[string]*CollectorConfig) []error {
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
+	_, errs := checkConfig(cfgs)
+	return errs
+}
+
+// checkConfig checks cfgs and returns the options they set.
+func checkConfig(cfgs map[string]*CollectorConfig) (collectorOptions, []error) {
+	var errs []error
+	values := collectorOptions{}
+
+	for name, cfg := range cfgs {
+		if _, ok := collectorState[name]; !ok {
+			errs = append(errs, fmt.Errorf("unknown collector: %s", name))
+			continue
+		}
+		if cfg == nil {
+			continue
+		}
+
+		if cfg.Timeout != "" {
+			timeout, err := time.ParseDuration(cfg.Timeout)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("collector %s: invalid timeout %q", name, cfg.Timeout))
+			} else {
+				values[optionFlagName(name, "timeout")] = timeout
+			}
+		}
+
+		for option, value := range cfg.Options {
+			flagName := optionFlagName(name, option)
+			f := kingpin.CommandLine.GetFlag(flagName)
+			if option == "timeout" || f == nil {
+				errs = append(errs, fmt.Errorf("collector %s: unknown option %s", name, option))
+				continue
+			}
+			v, err := parseOption(f.Model(), value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("collector %s: option %s: %s", name, option, err))
+				continue
+			}
+			values[flagName] = v
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return values, errs
+}
+
+// parseOption parses value to the type of the flag f.
+func parseOption(f *kingpin.FlagModel, value string) (interface{}, error) {
+	switch f.Value.(kingpin.Getter).Get().(type) {
+	case bool:
+		return strconv.ParseBool(value)
+	case int:
+		return strconv.Atoi(value)
+	case time.Duration:
+		return time.ParseDuration(value)
+	}
+	return value, checkRegexpFlag(f, value)
+}
+
+// stringOption returns the value of the option flag name in the applied
+// config, or the command line value flag. Collectors read their options
+// when they are created, NewNodeCollector holds collectorStateMtx
+// meanwhile.
+func stringOption(name string, flag *string) string {
+	if v, ok := options[name]; ok {
+		return v.(string)
+	}
+	return *flag
+}
+
+// intOption is stringOption for int flags.
+func intOption(name string, flag *int) int {
+	if v, ok := options[name]; ok {
+		return v.(int)
+	}
+	return *flag
+}
+
+// boolOption is stringOption for bool flags.
+func boolOption(name string, flag *bool) bool {
+	if v, ok := options[name]; ok {
+		return v.(bool)
+	}
+	return *flag
+}
+
+// durationOption is stringOption for duration flags.
+func durationOption(name string, flag *time.Duration) time.Duration {
+	if v, ok := options[name]; ok {
+		return v.(time.Duration)
+	}
+	return *flag
+}
+
+// CheckFlags reports the regexp flags of the collectors which do not
+// compile.
+func CheckFlags() []error {
+	var errs []error
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		if !strings.HasPrefix(f.Name, "collector.") {
+			continue
+		}
+		if err := checkRegexpFlag(f, f.Value.String()); err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %s", f.Name, err))
+		}
+	}
+	return errs
+}
+
+// checkRegexpFlag compiles value if f is a regexp flag, whose help starts
+// with "Regexp".
+func checkRegexpFlag(f *kingpin.FlagModel, value string) error {
+	if !strings.HasPrefix(f.Help, "Regexp") {
+		return nil
+	}
+	_, err := regexp.Compile(value)
+	return err
+}
+
+// CheckCollectors creates every enabled collector and returns the errors of
+// the ones which can not be created, they are skipped by NodeCollector.
+func CheckCollectors() map[string]error {
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
+	errs := map[string]error{}
+	for name, enabled := range collectorState {
+		if !*enabled {
+			continue
+		}
+		if err := checkFactory(name); err != nil {
+			errs[name] = err
+		}
+	}
+	return errs
+}
+
+// checkFactory creates the collector name, most constructors compile their
+// regexp options with regexp.MustCompile.
+func checkFactory(name string) (err error) {
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		err = perr
+	})
+
+	_, err = factories[name]()
+	return err
+}
+
+func optionFlagName(collector, option string) string {
+	return fmt.Sprintf("collector.%s.%s", collector, option)
+}
+
+// optionCollector returns the collector of the option flag flagName.
+func optionCollector(flagName string) string {
+	return strings.SplitN(strings.TrimPrefix(flagName, "collector."), ".", 2)[0]
+}
+
+// saveCmdline records the collector states and flags set by the command
+// line.
+func saveCmdline() {
+	baseState = make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		baseState[name] = *enabled
+	}
+
+	cmdlineFlags = map[string]bool{}
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		if !strings.HasPrefix(f.Name, "collector.") {
+			continue
+		}
+		if f.Value.String() != strings.Join(f.Default, ",") {
+			cmdlineFlags[f.Name] = true
+		}
+	}
+}
+
+type configState struct {
+	enabled map[string]bool
+	options collectorOptions
+}
+
+func saveConfigState() *configState {
+	s := &configState{
+		enabled: make(map[string]bool, len(collectorState)),
+		options: options,
+	}
+	for name, enabled := range collectorState {
+		s.enabled[name] = *enabled
+	}
+	return s
+}
+
+func restoreConfigState(s *configState) {
+	for name, enabled := range s.enabled {
+		*collectorState[name] = enabled
+	}
+	options = s.options
+}
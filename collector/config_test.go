@@ -0,0 +1,118 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestApplyConfig(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	defer ApplyConfig(nil)
+
+	cmdline := *netdevIgnoredDevices
+	rollback, err := ApplyConfig(map[string]*CollectorConfig{
+		"netdev": {Timeout: "2s", Options: map[string]string{"ignored-devices": "^lo$"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the flags keep their command line values, new collectors get the
+	// options of the config
+	if *netdevIgnoredDevices != cmdline {
+		t.Errorf("want the flag unchanged, got %q", *netdevIgnoredDevices)
+	}
+	n, err := NewNodeCollector("netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := n.timeouts["netdev"]; timeout != 2*time.Second {
+		t.Errorf("want a timeout of 2s, got %s", timeout)
+	}
+	if pattern := n.Collectors["netdev"].(*netDevCollector).ignoredDevicesPattern.String(); pattern != "^lo$" {
+		t.Errorf("want the pattern of the config, got %q", pattern)
+	}
+
+	rollback()
+	n, err = NewNodeCollector("netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := n.timeouts["netdev"]; timeout != 0 {
+		t.Errorf("want no timeout after the rollback, got %s", timeout)
+	}
+	if pattern := n.Collectors["netdev"].(*netDevCollector).ignoredDevicesPattern.String(); pattern != cmdline {
+		t.Errorf("want the command line pattern after the rollback, got %q", pattern)
+	}
+
+	for _, c := range []struct {
+		cfg  *CollectorConfig
+		want string
+	}{
+		{&CollectorConfig{Options: map[string]string{"ignored-devices": "("}}, "missing closing )"},
+		{&CollectorConfig{Options: map[string]string{"missing": "x"}}, "unknown option missing"},
+		{&CollectorConfig{Timeout: "2"}, "invalid timeout"},
+	} {
+		_, err := ApplyConfig(map[string]*CollectorConfig{"netdev": c.cfg})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%+v: want an error containing %q, got %v", c.cfg, c.want, err)
+		}
+	}
+	if _, err := ApplyConfig(map[string]*CollectorConfig{"ntp": {
+		Enabled: &[]bool{true}[0],
+		Options: map[string]string{"protocol-version": "four"},
+	}}); err == nil || !strings.Contains(err.Error(), "invalid syntax") {
+		t.Errorf("want an error for a non integer option, got %v", err)
+	}
+
+	// a config refused by a collector constructor is not swapped in
+	if _, err := ApplyConfig(map[string]*CollectorConfig{"ntp": {
+		Enabled: &[]bool{true}[0],
+		Options: map[string]string{"protocol-version": "5"},
+	}}); err == nil || !strings.Contains(err.Error(), "invalid NTP protocol version") {
+		t.Errorf("want the error of the ntp collector, got %v", err)
+	}
+	if len(options) != 0 || *collectorState["ntp"] {
+		t.Errorf("want the previous config kept, got %v", options)
+	}
+}
+
+func TestCheckConfigInvalidValues(t *testing.T) {
+	values, errs := checkConfig(map[string]*CollectorConfig{
+		"netdev": {Timeout: "2", Options: map[string]string{"ignored-devices": "^lo$"}},
+		"ntp":    {Options: map[string]string{"protocol-version": "four"}},
+	})
+	if len(errs) != 2 {
+		t.Errorf("want 2 errors, got %v", errs)
+	}
+
+	// values failing to parse are not set, so that they do not override
+	// the previous ones with zero values
+	if _, ok := values[optionFlagName("netdev", "timeout")]; ok {
+		t.Errorf("want no timeout for an invalid one, got %v", values)
+	}
+	if _, ok := values[optionFlagName("ntp", "protocol-version")]; ok {
+		t.Errorf("want no protocol version for an invalid one, got %v", values)
+	}
+	if values[optionFlagName("netdev", "ignored-devices")] != "^lo$" {
+		t.Errorf("want the valid option kept, got %v", values)
+	}
+}
@@ -16,13 +16,13 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
-	"github.com/prometheus/procfs"
 	"github.com/prometheus/procfs/sysfs"
 )
 
@@ -79,7 +79,12 @@ func NewCPUCollector() (Collector, error) {
 
 // Update implements Collector and exposes cpu related metrics from /proc/stat and /sys/.../cpu/.
 func (c *cpuCollector) Update(ch chan<- prometheus.Metric) error {
-	if err := c.updateStat(ch); err != nil {
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *cpuCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	if err := c.updateStat(ctx, ch); err != nil {
 		return err
 	}
 	if err := c.updateCPUfreq(ch); err != nil {
@@ -207,12 +212,8 @@ func (c *cpuCollector) updateThermalThrottle(ch chan<- prometheus.Metric) error
 }
 
 // updateStat reads /proc/stat through procfs and exports cpu related metrics.
-func (c *cpuCollector) updateStat(ch chan<- prometheus.Metric) error {
-	fs, err := procfs.NewFS(*procPath)
-	if err != nil {
-		return fmt.Errorf("failed to open procfs: %v", err)
-	}
-	stats, err := fs.NewStat()
+func (c *cpuCollector) updateStat(ctx context.Context, ch chan<- prometheus.Metric) error {
+	stats, err := readProcStat(ctx)
 	if err != nil {
 		return err
 	}
@@ -17,9 +17,10 @@ package collector
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -67,7 +68,7 @@ func NewDiskstatsCollector() (Collector, error) {
 	var diskLabelNames = []string{"device"}
 
 	return &diskstatsCollector{
-		ignoredDevicesPattern: regexp.MustCompile(*ignoredDevices),
+		ignoredDevicesPattern: regexp.MustCompile(stringOption("collector.diskstats.ignored-devices", ignoredDevices)),
 		descs: []typedFactorDesc{
 			{
 				desc: prometheus.NewDesc(
@@ -201,7 +202,12 @@ func NewDiskstatsCollector() (Collector, error) {
 }
 
 func (c *diskstatsCollector) Update(ch chan<- prometheus.Metric) error {
-	diskStats, err := getDiskStats()
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *diskstatsCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	diskStats, err := getDiskStats(ctx)
 	if err != nil {
 		return fmt.Errorf("couldn't get diskstats: %s", err)
 	}
@@ -227,14 +233,13 @@ func (c *diskstatsCollector) Update(ch chan<- prometheus.Metric) error {
 	return nil
 }
 
-func getDiskStats() (map[string][]string, error) {
-	file, err := os.Open(procFilePath(diskstatsFilename))
+func getDiskStats(ctx context.Context) (map[string][]string, error) {
+	data, err := readFile(ctx, procFilePath(diskstatsFilename))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	return parseDiskStats(file)
+	return parseDiskStats(bytes.NewReader(data))
 }
 
 func parseDiskStats(r io.Reader) (map[string][]string, error) {
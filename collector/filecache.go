@@ -0,0 +1,187 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+)
+
+var (
+	fileReadDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "file_read_duration_seconds"),
+		"node_exporter: Time the last read of a shared procfs/sysfs file took.",
+		[]string{"file"},
+		nil,
+	)
+	fileReadErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "file_read_errors_total"),
+		"node_exporter: Number of failed reads of a shared procfs/sysfs file.",
+		[]string{"file"},
+		nil,
+	)
+	fileCacheHitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "file_cache_hits_total"),
+		"node_exporter: Number of times a shared procfs/sysfs file was served from the scrape cache instead of being read again.",
+		[]string{"file"},
+		nil,
+	)
+
+	fileStatsMtx = sync.Mutex{}
+	fileStatsOf  = map[string]*fileStats{}
+)
+
+// fileCache shares the content of procfs/sysfs files read by several
+// collectors during one scrape, each file is read at most once by the
+// scrape. Every NodeCollector.Collect gets a cache of its own, passed to
+// the collectors in their context, so that overlapping scrapes do not share
+// their reads; reads without a cache in their context (tests) are not
+// cached.
+type fileCache struct {
+	mtx     sync.Mutex
+	entries map[string]*fileEntry
+}
+
+type fileEntry struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+type fileStats struct {
+	duration time.Duration
+	errors   float64
+	hits     float64
+}
+
+type fileCacheKey struct{}
+
+func newFileCache() *fileCache {
+	return &fileCache{entries: map[string]*fileEntry{}}
+}
+
+// withFileCache returns ctx with c, the cache of its scrape.
+func withFileCache(ctx context.Context, c *fileCache) context.Context {
+	return context.WithValue(ctx, fileCacheKey{}, c)
+}
+
+// fileCacheFrom returns the cache of the scrape of ctx, nil if it has none.
+func fileCacheFrom(ctx context.Context) *fileCache {
+	c, _ := ctx.Value(fileCacheKey{}).(*fileCache)
+	return c
+}
+
+// load returns the value read from file by read. Concurrent callers of the
+// same file wait for the first one instead of reading it again. A nil cache
+// always reads.
+func (c *fileCache) load(file string, read func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return read()
+	}
+
+	c.mtx.Lock()
+	if e, ok := c.entries[file]; ok {
+		c.mtx.Unlock()
+		updateFileStats(file, func(s *fileStats) { s.hits++ })
+		<-e.done
+		return e.value, e.err
+	}
+
+	e := &fileEntry{done: make(chan struct{})}
+	c.entries[file] = e
+	c.mtx.Unlock()
+
+	begin := time.Now()
+	e.value, e.err = read()
+	close(e.done)
+
+	duration := time.Since(begin)
+	updateFileStats(file, func(s *fileStats) {
+		s.duration = duration
+		if e.err != nil {
+			s.errors++
+		}
+	})
+
+	return e.value, e.err
+}
+
+func updateFileStats(file string, update func(s *fileStats)) {
+	fileStatsMtx.Lock()
+	defer fileStatsMtx.Unlock()
+
+	s, ok := fileStatsOf[file]
+	if !ok {
+		s = &fileStats{}
+		fileStatsOf[file] = s
+	}
+	update(s)
+}
+
+func collectFileStats(ch chan<- prometheus.Metric) {
+	fileStatsMtx.Lock()
+	defer fileStatsMtx.Unlock()
+
+	for file, s := range fileStatsOf {
+		ch <- prometheus.MustNewConstMetric(fileReadDurationDesc, prometheus.GaugeValue, s.duration.Seconds(), file)
+		ch <- prometheus.MustNewConstMetric(fileReadErrorsDesc, prometheus.CounterValue, s.errors, file)
+		ch <- prometheus.MustNewConstMetric(fileCacheHitsDesc, prometheus.CounterValue, s.hits, file)
+	}
+}
+
+// readFile reads file through the cache of the scrape of ctx. The returned
+// content is shared and must not be modified.
+func readFile(ctx context.Context, file string) ([]byte, error) {
+	v, err := fileCacheFrom(ctx).load(file, func() (interface{}, error) {
+		return ioutil.ReadFile(file)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// readProcStat returns the parsed /proc/stat through the scrape cache, it is
+// used by both the cpu and stat collectors.
+func readProcStat(ctx context.Context) (procfs.Stat, error) {
+	v, err := fileCacheFrom(ctx).load(procFilePath("stat"), func() (interface{}, error) {
+		fs, err := procfs.NewFS(*procPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open procfs: %v", err)
+		}
+		return fs.NewStat()
+	})
+	if err != nil {
+		return procfs.Stat{}, err
+	}
+	return v.(procfs.Stat), nil
+}
+
+// readMountStats returns the parsed mountstats of proc through the scrape
+// cache.
+func readMountStats(ctx context.Context, proc procfs.Proc) ([]*procfs.Mount, error) {
+	v, err := fileCacheFrom(ctx).load(procFilePath(fmt.Sprintf("%d/mountstats", proc.PID)), func() (interface{}, error) {
+		return proc.MountStats()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*procfs.Mount), nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFileCache(t *testing.T) {
+	c := newFileCache()
+
+	var reads int32
+	read := func() (interface{}, error) {
+		atomic.AddInt32(&reads, 1)
+		return "content", nil
+	}
+	stats := func(file string) fileStats {
+		fileStatsMtx.Lock()
+		defer fileStatsMtx.Unlock()
+		if s, ok := fileStatsOf[file]; ok {
+			return *s
+		}
+		return fileStats{}
+	}
+
+	before := stats("test/stat").hits
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.load("test/stat", read); err != nil || v.(string) != "content" {
+				t.Errorf("unexpected result %v, %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reads != 1 {
+		t.Errorf("file read %d times during a scrape, want 1", reads)
+	}
+	if got := stats("test/stat").hits - before; got != 9 {
+		t.Errorf("want 9 cache hits, got %v", got)
+	}
+
+	// not cached outside of a scrape
+	var none *fileCache
+	none.load("test/stat", read)
+	if reads != 2 {
+		t.Errorf("file read %d times, want 2", reads)
+	}
+
+	// overlapping scrapes do not share their reads: a scrape started while
+	// another one is running reads the file again, and so does the next one
+	for i := 0; i < 2; i++ {
+		newFileCache().load("test/stat", read)
+	}
+	c.load("test/stat", read)
+	if reads != 4 {
+		t.Errorf("file read %d times, want 4", reads)
+	}
+
+	errs := stats("test/missing").errors
+	c.load("test/missing", func() (interface{}, error) { return nil, errors.New("not found") })
+	if got := stats("test/missing").errors - errs; got != 1 {
+		t.Errorf("want 1 read error, got %v", got)
+	}
+}
+
+func TestFileCacheContext(t *testing.T) {
+	if c := fileCacheFrom(context.Background()); c != nil {
+		t.Errorf("want no cache, got %v", c)
+	}
+
+	c := newFileCache()
+	ctx := withFileCache(context.Background(), c)
+	if got := fileCacheFrom(ctx); got != c {
+		t.Errorf("want the cache of the scrape, got %v", got)
+	}
+
+	// readFile shares the content with the other collectors of the scrape
+	file := filepath.Join(t.TempDir(), "meminfo")
+	ioutil.WriteFile(file, []byte("MemTotal: 1 kB\n"), 0644)
+	first, err := readFile(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(file, []byte("MemTotal: 2 kB\n"), 0644)
+	if second, _ := readFile(ctx, file); string(second) != string(first) {
+		t.Errorf("want %q from the cache, got %q", first, second)
+	}
+	if next, _ := readFile(withFileCache(context.Background(), newFileCache()), file); string(next) != "MemTotal: 2 kB\n" {
+		t.Errorf("want the next scrape to read the file again, got %q", next)
+	}
+}
@@ -17,6 +17,7 @@
 package collector
 
 import (
+	"context"
 	"errors"
 	"unsafe"
 
@@ -38,7 +39,7 @@ const (
 )
 
 // Expose filesystem fullness.
-func (c *filesystemCollector) GetStats() (stats []filesystemStats, err error) {
+func (c *filesystemCollector) GetStats(_ context.Context) (stats []filesystemStats, err error) {
 	var mntbuf *C.struct_statfs
 	count := C.getmntinfo(&mntbuf, C.MNT_NOWAIT)
 	if count == 0 {
@@ -17,6 +17,7 @@
 package collector
 
 import (
+	"context"
 	"regexp"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -68,8 +69,8 @@ func init() {
 // NewFilesystemCollector returns a new Collector exposing filesystems stats.
 func NewFilesystemCollector() (Collector, error) {
 	subsystem := "filesystem"
-	mountPointPattern := regexp.MustCompile(*ignoredMountPoints)
-	filesystemsTypesPattern := regexp.MustCompile(*ignoredFSTypes)
+	mountPointPattern := regexp.MustCompile(stringOption("collector.filesystem.ignored-mount-points", ignoredMountPoints))
+	filesystemsTypesPattern := regexp.MustCompile(stringOption("collector.filesystem.ignored-fs-types", ignoredFSTypes))
 
 	sizeDesc := prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, subsystem, "size_bytes"),
@@ -127,7 +128,12 @@ func NewFilesystemCollector() (Collector, error) {
 }
 
 func (c *filesystemCollector) Update(ch chan<- prometheus.Metric) error {
-	stats, err := c.GetStats()
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *filesystemCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	stats, err := c.GetStats(ctx)
 	if err != nil {
 		return err
 	}
@@ -17,6 +17,7 @@ package collector
 
 import (
 	"bytes"
+	"context"
 	"unsafe"
 
 	"github.com/prometheus/common/log"
@@ -40,7 +41,7 @@ func gostring(b []int8) string {
 }
 
 // Expose filesystem fullness.
-func (c *filesystemCollector) GetStats() ([]filesystemStats, error) {
+func (c *filesystemCollector) GetStats(_ context.Context) ([]filesystemStats, error) {
 	n, err := unix.Getfsstat(nil, noWait)
 	if err != nil {
 		return nil, err
@@ -17,9 +17,10 @@ package collector
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 	"sync"
 	"syscall"
@@ -39,8 +40,8 @@ var stuckMounts = make(map[string]struct{})
 var stuckMountsMtx = &sync.Mutex{}
 
 // GetStats returns filesystem stats.
-func (c *filesystemCollector) GetStats() ([]filesystemStats, error) {
-	mps, err := mountPointDetails()
+func (c *filesystemCollector) GetStats(ctx context.Context) ([]filesystemStats, error) {
+	mps, err := mountPointDetails(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -134,14 +135,13 @@ func stuckMountWatcher(mountPoint string, success chan struct{}) {
 	}
 }
 
-func mountPointDetails() ([]filesystemLabels, error) {
-	file, err := os.Open(procFilePath("1/mounts"))
+func mountPointDetails(ctx context.Context) ([]filesystemLabels, error) {
+	data, err := readFile(ctx, procFilePath("1/mounts"))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	return parseFilesystemLabels(file)
+	return parseFilesystemLabels(bytes.NewReader(data))
 }
 
 func parseFilesystemLabels(r io.Reader) ([]filesystemLabels, error) {
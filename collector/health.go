@@ -0,0 +1,194 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	quarantineFailures   = kingpin.Flag("collector.quarantine.failures", "Number of consecutive failures after which a collector is quarantined.").Default("3").Int()
+	quarantineBackoff    = kingpin.Flag("collector.quarantine.backoff", "Initial time a quarantined collector is skipped before it is retried, doubled on every failed retry.").Default("1m").Duration()
+	quarantineMaxBackoff = kingpin.Flag("collector.quarantine.max-backoff", "Maximum time a quarantined collector is skipped before it is retried.").Default("1h").Duration()
+
+	scrapeQuarantinedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_quarantined"),
+		"node_exporter: Whether a collector is quarantined after repeated failures.",
+		[]string{"collector"},
+		nil,
+	)
+	scrapeFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_failures_total"),
+		"node_exporter: Total number of failed collector scrapes.",
+		[]string{"collector"},
+		nil,
+	)
+	scrapePanicsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_panics_total"),
+		"node_exporter: Total number of collector scrapes which panicked.",
+		[]string{"collector"},
+		nil,
+	)
+	scrapeLastErrorDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_last_error_timestamp_seconds"),
+		"node_exporter: Unix timestamp of the last collector failure, 0 if it never failed.",
+		[]string{"collector"},
+		nil,
+	)
+
+	health = newHealthTracker()
+)
+
+// CollectorHealth is the failure and quarantine state of a collector.
+type CollectorHealth struct {
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Failures            uint64    `json:"failures_total"`
+	Panics              uint64    `json:"panics_total"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastErrorTime       time.Time `json:"last_error_time"`
+	Quarantined         bool      `json:"quarantined"`
+	QuarantinedUntil    time.Time `json:"quarantined_until"`
+
+	backoff time.Duration
+}
+
+// healthTracker keeps the health of every collector across scrapes and
+// NodeCollector instances. Collectors failing too often are quarantined:
+// they are skipped until their backoff expires, then retried once. A
+// successful retry re-admits the collector, a failed one doubles the backoff.
+type healthTracker struct {
+	mtx        sync.Mutex
+	collectors map[string]*CollectorHealth
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{collectors: make(map[string]*CollectorHealth)}
+}
+
+func (t *healthTracker) get(name string) *CollectorHealth {
+	h, ok := t.collectors[name]
+	if !ok {
+		h = &CollectorHealth{}
+		t.collectors[name] = h
+	}
+	return h
+}
+
+// shouldRun reports whether the collector is to be scraped at now. A
+// quarantined collector whose backoff expired is let through once, the
+// next retry is pushed back so that concurrent scrapes don't retry it too.
+func (t *healthTracker) shouldRun(name string, now time.Time) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	h := t.get(name)
+	if !h.Quarantined {
+		return true
+	}
+	if now.Before(h.QuarantinedUntil) {
+		return false
+	}
+
+	h.QuarantinedUntil = now.Add(h.backoff)
+	log.Infof("INFO: retrying quarantined %s collector", name)
+	return true
+}
+
+func (t *healthTracker) success(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	h := t.get(name)
+	if h.Quarantined {
+		log.Infof("INFO: %s collector succeeded, leaving quarantine", name)
+	}
+	h.ConsecutiveFailures = 0
+	h.Quarantined = false
+	h.QuarantinedUntil = time.Time{}
+	h.backoff = 0
+}
+
+func (t *healthTracker) failure(name string, err error, now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	h := t.get(name)
+	h.ConsecutiveFailures++
+	h.Failures++
+	h.LastError = err.Error()
+	h.LastErrorTime = now
+
+	switch {
+	case h.Quarantined:
+		h.backoff *= 2
+		if h.backoff > *quarantineMaxBackoff {
+			h.backoff = *quarantineMaxBackoff
+		}
+	case h.ConsecutiveFailures >= *quarantineFailures:
+		h.Quarantined = true
+		h.backoff = *quarantineBackoff
+	default:
+		log.Warnf("WARN: %s collector failed %d times", name, h.ConsecutiveFailures)
+		return
+	}
+
+	h.QuarantinedUntil = now.Add(h.backoff)
+	log.Warnf("WARN: %s collector failed %d times, quarantined until %s", name, h.ConsecutiveFailures, h.QuarantinedUntil.Format(time.RFC3339))
+}
+
+// panic records a panic of the collector, the panic is also reported as a
+// failure by the scrape.
+func (t *healthTracker) panic(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.get(name).Panics++
+}
+
+func (t *healthTracker) collect(name string, ch chan<- prometheus.Metric) {
+	t.mtx.Lock()
+	h := *t.get(name)
+	t.mtx.Unlock()
+
+	var quarantined, lastError float64
+	if h.Quarantined {
+		quarantined = 1
+	}
+	if !h.LastErrorTime.IsZero() {
+		lastError = float64(h.LastErrorTime.UnixNano()) / 1e9
+	}
+
+	ch <- prometheus.MustNewConstMetric(scrapeQuarantinedDesc, prometheus.GaugeValue, quarantined, name)
+	ch <- prometheus.MustNewConstMetric(scrapeFailuresDesc, prometheus.CounterValue, float64(h.Failures), name)
+	ch <- prometheus.MustNewConstMetric(scrapePanicsDesc, prometheus.CounterValue, float64(h.Panics), name)
+	ch <- prometheus.MustNewConstMetric(scrapeLastErrorDesc, prometheus.GaugeValue, lastError, name)
+}
+
+// CollectorHealthStatus returns the health of every collector that has been
+// scraped at least once.
+func CollectorHealthStatus() map[string]CollectorHealth {
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+
+	res := make(map[string]CollectorHealth, len(health.collectors))
+	for name, h := range health.collectors {
+		res[name] = *h
+	}
+	return res
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthTrackerQuarantine(t *testing.T) {
+	*quarantineFailures = 3
+	*quarantineBackoff = time.Minute
+	*quarantineMaxBackoff = 3 * time.Minute
+
+	tracker := newHealthTracker()
+	now := time.Unix(0, 0)
+	fail := errors.New("failed")
+
+	for i := 0; i < 3; i++ {
+		if !tracker.shouldRun("test", now) {
+			t.Fatalf("collector quarantined after %d failures", i)
+		}
+		tracker.failure("test", fail, now)
+	}
+	if tracker.shouldRun("test", now.Add(59*time.Second)) {
+		t.Fatal("quarantined collector run before its backoff expired")
+	}
+
+	// Failed retries double the backoff up to the maximum.
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		now = now.Add(backoff)
+		if !tracker.shouldRun("test", now) {
+			t.Fatalf("quarantined collector not retried after %s", backoff)
+		}
+		if tracker.shouldRun("test", now) {
+			t.Fatal("quarantined collector retried twice")
+		}
+		tracker.failure("test", fail, now)
+	}
+
+	now = now.Add(3 * time.Minute)
+	if !tracker.shouldRun("test", now) {
+		t.Fatal("quarantined collector not retried")
+	}
+	tracker.success("test")
+	if !tracker.shouldRun("test", now) {
+		t.Fatal("collector still quarantined after a successful retry")
+	}
+
+	h := tracker.collectors["test"]
+	if h.Quarantined || h.ConsecutiveFailures != 0 || h.Failures != 7 {
+		t.Fatalf("unexpected health after recovery: %+v", h)
+	}
+}
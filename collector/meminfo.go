@@ -17,6 +17,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -42,8 +43,13 @@ func NewMeminfoCollector() (Collector, error) {
 // Update calls (*meminfoCollector).getMemInfo to get the platform specific
 // memory metrics.
 func (c *meminfoCollector) Update(ch chan<- prometheus.Metric) error {
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *meminfoCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
 	var metricType prometheus.ValueType
-	memInfo, err := c.getMemInfo()
+	memInfo, err := c.getMemInfo(ctx)
 	if err != nil {
 		return fmt.Errorf("couldn't get meminfo: %s", err)
 	}
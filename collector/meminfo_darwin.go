@@ -19,6 +19,7 @@ package collector
 import "C"
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"syscall"
@@ -27,7 +28,7 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func (c *meminfoCollector) getMemInfo() (map[string]float64, error) {
+func (c *meminfoCollector) getMemInfo(_ context.Context) (map[string]float64, error) {
 	infoCount := C.mach_msg_type_number_t(C.HOST_VM_INFO_COUNT)
 	vmstat := C.vm_statistics_data_t{}
 	ret := C.host_statistics(
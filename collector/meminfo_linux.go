@@ -17,22 +17,22 @@ package collector
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
-func (c *meminfoCollector) getMemInfo() (map[string]float64, error) {
-	file, err := os.Open(procFilePath("meminfo"))
+func (c *meminfoCollector) getMemInfo(ctx context.Context) (map[string]float64, error) {
+	data, err := readFile(ctx, procFilePath("meminfo"))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	return parseMemInfo(file)
+	return parseMemInfo(bytes.NewReader(data))
 }
 
 func parseMemInfo(r io.Reader) (map[string]float64, error) {
@@ -17,6 +17,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -40,7 +41,7 @@ sysctl_uvmexp(struct uvmexp *uvmexp)
 */
 import "C"
 
-func (c *meminfoCollector) getMemInfo() (map[string]float64, error) {
+func (c *meminfoCollector) getMemInfo(_ context.Context) (map[string]float64, error) {
 	var uvmexp C.struct_uvmexp
 
 	if _, err := C.sysctl_uvmexp(&uvmexp); err != nil {
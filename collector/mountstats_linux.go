@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -497,7 +498,12 @@ func NewMountStatsCollector() (Collector, error) {
 }
 
 func (c *mountStatsCollector) Update(ch chan<- prometheus.Metric) error {
-	mounts, err := c.proc.MountStats()
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *mountStatsCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	mounts, err := readMountStats(ctx, c.proc)
 	if err != nil {
 		return fmt.Errorf("failed to parse mountstats: %v", err)
 	}
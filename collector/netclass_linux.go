@@ -17,6 +17,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 
@@ -41,7 +42,7 @@ func init() {
 
 // NewNetClassCollector returns a new Collector exposing network class stats.
 func NewNetClassCollector() (Collector, error) {
-	pattern := regexp.MustCompile(*netclassIgnoredDevices)
+	pattern := regexp.MustCompile(stringOption("collector.netclass.ignored-devices", netclassIgnoredDevices))
 	return &netClassCollector{
 		subsystem:             "network",
 		ignoredDevicesPattern: pattern,
@@ -50,7 +51,12 @@ func NewNetClassCollector() (Collector, error) {
 }
 
 func (c *netClassCollector) Update(ch chan<- prometheus.Metric) error {
-	netClass, err := getNetClassInfo(c.ignoredDevicesPattern)
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *netClassCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	netClass, err := getNetClassInfo(ctx, c.ignoredDevicesPattern)
 	if err != nil {
 		return fmt.Errorf("could not get net class info: %s", err)
 	}
@@ -152,20 +158,25 @@ func pushMetric(ch chan<- prometheus.Metric, subsystem string, name string, valu
 	ch <- prometheus.MustNewConstMetric(fieldDesc, valueType, float64(value), ifaceName)
 }
 
-func getNetClassInfo(ignore *regexp.Regexp) (sysfs.NetClass, error) {
-	fs, err := sysfs.NewFS(*sysPath)
-	if err != nil {
-		return nil, err
-	}
-	netClass, err := fs.NewNetClass()
-
+// getNetClassInfo returns the interfaces of /sys/class/net not ignored,
+// read through the scrape cache.
+func getNetClassInfo(ctx context.Context, ignore *regexp.Regexp) (sysfs.NetClass, error) {
+	v, err := fileCacheFrom(ctx).load(sysFilePath("class/net"), func() (interface{}, error) {
+		fs, err := sysfs.NewFS(*sysPath)
+		if err != nil {
+			return nil, err
+		}
+		return fs.NewNetClass()
+	})
 	if err != nil {
-		return netClass, fmt.Errorf("error obtaining net class info: %s", err)
+		return nil, fmt.Errorf("error obtaining net class info: %s", err)
 	}
 
-	for device := range netClass {
-		if ignore.MatchString(device) {
-			delete(netClass, device)
+	// the cached net class is shared, it is filtered into a copy
+	netClass := sysfs.NetClass{}
+	for device, iface := range v.(sysfs.NetClass) {
+		if !ignore.MatchString(device) {
+			netClass[device] = iface
 		}
 	}
 
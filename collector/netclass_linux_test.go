@@ -0,0 +1,53 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nonetclass
+
+package collector
+
+import (
+	"context"
+	"regexp"
+	"testing"
+)
+
+func TestNetClassFileCache(t *testing.T) {
+	defer func(p string) { *sysPath = p }(*sysPath)
+	*sysPath = "fixtures/sys"
+
+	ctx := withFileCache(context.Background(), newFileCache())
+	all, err := getNetClassInfo(ctx, regexp.MustCompile("^$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := all["eth0"]; !ok {
+		t.Fatalf("want eth0 in %v", all)
+	}
+
+	// the net class is read once by the scrape, ignoring devices does not
+	// change the cached one
+	hits := fileStatsOf[sysFilePath("class/net")].hits
+	ignored, err := getNetClassInfo(ctx, regexp.MustCompile("^eth0$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ignored["eth0"]; ok {
+		t.Errorf("want eth0 ignored, got %v", ignored)
+	}
+	if got := fileStatsOf[sysFilePath("class/net")].hits - hits; got != 1 {
+		t.Errorf("want the net class served from the cache, got %v hits", got)
+	}
+	if again, _ := getNetClassInfo(ctx, regexp.MustCompile("^$")); len(again) != len(all) {
+		t.Errorf("want %d devices from the cache, got %d", len(all), len(again))
+	}
+}
@@ -17,6 +17,7 @@
 package collector
 
 import (
+	"context"
 	"errors"
 	"regexp"
 	"strconv"
@@ -34,7 +35,7 @@ import (
 */
 import "C"
 
-func getNetDevStats(ignore *regexp.Regexp) (map[string]map[string]string, error) {
+func getNetDevStats(_ context.Context, ignore *regexp.Regexp) (map[string]map[string]string, error) {
 	netDev := map[string]map[string]string{}
 
 	var ifap, ifa *C.struct_ifaddrs
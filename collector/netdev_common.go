@@ -17,6 +17,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -41,7 +42,7 @@ func init() {
 
 // NewNetDevCollector returns a new Collector exposing network device stats.
 func NewNetDevCollector() (Collector, error) {
-	pattern := regexp.MustCompile(*netdevIgnoredDevices)
+	pattern := regexp.MustCompile(stringOption("collector.netdev.ignored-devices", netdevIgnoredDevices))
 	return &netDevCollector{
 		subsystem:             "network",
 		ignoredDevicesPattern: pattern,
@@ -50,7 +51,12 @@ func NewNetDevCollector() (Collector, error) {
 }
 
 func (c *netDevCollector) Update(ch chan<- prometheus.Metric) error {
-	netDev, err := getNetDevStats(c.ignoredDevicesPattern)
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *netDevCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	netDev, err := getNetDevStats(ctx, c.ignoredDevicesPattern)
 	if err != nil {
 		return fmt.Errorf("couldn't get netstats: %s", err)
 	}
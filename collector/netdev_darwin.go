@@ -16,6 +16,7 @@
 package collector
 
 import (
+	"context"
 	"errors"
 	"regexp"
 	"strconv"
@@ -32,7 +33,7 @@ import (
 */
 import "C"
 
-func getNetDevStats(ignore *regexp.Regexp) (map[string]map[string]string, error) {
+func getNetDevStats(_ context.Context, ignore *regexp.Regexp) (map[string]map[string]string, error) {
 	netDev := map[string]map[string]string{}
 
 	var ifap, ifa *C.struct_ifaddrs
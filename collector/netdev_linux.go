@@ -17,9 +17,10 @@ package collector
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 	"strings"
 
@@ -31,14 +32,13 @@ var (
 	procNetDevFieldSep    = regexp.MustCompile(` +`)
 )
 
-func getNetDevStats(ignore *regexp.Regexp) (map[string]map[string]string, error) {
-	file, err := os.Open(procFilePath("net/dev"))
+func getNetDevStats(ctx context.Context, ignore *regexp.Regexp) (map[string]map[string]string, error) {
+	data, err := readFile(ctx, procFilePath("net/dev"))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	return parseNetDevStats(file, ignore)
+	return parseNetDevStats(bytes.NewReader(data), ignore)
 }
 
 func parseNetDevStats(r io.Reader, ignore *regexp.Regexp) (map[string]map[string]string, error) {
@@ -47,7 +47,7 @@ func init() {
 // NewNetStatCollector takes and returns
 // a new Collector exposing network stats.
 func NewNetStatCollector() (Collector, error) {
-	pattern := regexp.MustCompile(*netStatFields)
+	pattern := regexp.MustCompile(stringOption("collector.netstat.fields", netStatFields))
 	return &netStatCollector{
 		fieldPattern: pattern,
 	}, nil
@@ -47,6 +47,10 @@ var (
 
 type ntpCollector struct {
 	stratum, leap, rtt, offset, reftime, rootDelay, rootDispersion, sanity typedDesc
+
+	server                       string
+	protocolVersion, ttl         int
+	maxDistance, offsetTolerance time.Duration
 }
 
 func init() {
@@ -58,16 +62,19 @@ func init() {
 // - collector.ntp.server address is a loopback address (or collector.ntp.server-is-mine flag is turned on)
 // - the server is reachable with outgoin IP_TTL = 1
 func NewNtpCollector() (Collector, error) {
-	ipaddr := net.ParseIP(*ntpServer)
-	if !*ntpServerIsLocal && (ipaddr == nil || !ipaddr.IsLoopback()) {
+	server := stringOption("collector.ntp.server", ntpServer)
+	ipaddr := net.ParseIP(server)
+	if !boolOption("collector.ntp.server-is-local", ntpServerIsLocal) && (ipaddr == nil || !ipaddr.IsLoopback()) {
 		return nil, fmt.Errorf("only IP address of local NTP server is valid for --collector.ntp.server")
 	}
 
-	if *ntpProtocolVersion < 2 || *ntpProtocolVersion > 4 {
-		return nil, fmt.Errorf("invalid NTP protocol version %d; must be 2, 3, or 4", *ntpProtocolVersion)
+	protocolVersion := intOption("collector.ntp.protocol-version", ntpProtocolVersion)
+	if protocolVersion < 2 || protocolVersion > 4 {
+		return nil, fmt.Errorf("invalid NTP protocol version %d; must be 2, 3, or 4", protocolVersion)
 	}
 
-	if *ntpOffsetTolerance < 0 {
+	offsetTolerance := durationOption("collector.ntp.local-offset-tolerance", ntpOffsetTolerance)
+	if offsetTolerance < 0 {
 		return nil, fmt.Errorf("Offset tolerance must be non-negative")
 	}
 
@@ -113,13 +120,19 @@ func NewNtpCollector() (Collector, error) {
 			"NTPD sanity according to RFC5905 heuristics and configured limits.",
 			nil, nil,
 		), prometheus.GaugeValue},
+
+		server:          server,
+		protocolVersion: protocolVersion,
+		ttl:             intOption("collector.ntp.ip-ttl", ntpIPTTL),
+		maxDistance:     durationOption("collector.ntp.max-distance", ntpMaxDistance),
+		offsetTolerance: offsetTolerance,
 	}, nil
 }
 
 func (c *ntpCollector) Update(ch chan<- prometheus.Metric) error {
-	resp, err := ntp.QueryWithOptions(*ntpServer, ntp.QueryOptions{
-		Version: *ntpProtocolVersion,
-		TTL:     *ntpIPTTL,
+	resp, err := ntp.QueryWithOptions(c.server, ntp.QueryOptions{
+		Version: c.protocolVersion,
+		TTL:     c.ttl,
 		Timeout: time.Second, // default `ntpdate` timeout
 	})
 	if err != nil {
@@ -145,7 +158,7 @@ func (c *ntpCollector) Update(ch chan<- prometheus.Metric) error {
 	// Here is SNTP packet sanity check that is exposed to move burden of
 	// configuration from node_exporter user to the developer.
 
-	maxerr := *ntpOffsetTolerance
+	maxerr := c.offsetTolerance
 	leapMidnightMutex.Lock()
 	if resp.Leap == ntp.LeapAddSecond || resp.Leap == ntp.LeapDelSecond {
 		// state of leapMidnight is cached as leap flag is dropped right after midnight
@@ -157,7 +170,7 @@ func (c *ntpCollector) Update(ch chan<- prometheus.Metric) error {
 	}
 	leapMidnightMutex.Unlock()
 
-	if resp.Validate() == nil && resp.RootDistance <= *ntpMaxDistance && resp.MinError <= maxerr {
+	if resp.Validate() == nil && resp.RootDistance <= c.maxDistance && resp.MinError <= maxerr {
 		ch <- c.sanity.mustNewConstMetric(1)
 	} else {
 		ch <- c.sanity.mustNewConstMetric(0)
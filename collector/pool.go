@@ -0,0 +1,103 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	priorityCheap = iota
+	priorityDefault
+	prioritySlow
+)
+
+var (
+	maxConcurrency = kingpin.Flag("collector.max-concurrency", "Maximum number of collectors running at once during a scrape, 0 runs all of them at once.").Default("0").Int()
+
+	scrapeQueueWaitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_queue_wait_seconds"),
+		"node_exporter: Time a collector waited for a free worker before it started.",
+		[]string{"collector"},
+		nil,
+	)
+
+	// collectorPriority orders the collectors of a scrape when their
+	// concurrency is limited. Collectors reading a few procfs/sysfs files
+	// go first so that they are not queued behind the ones talking to
+	// D-Bus, the network or walking many mounts/files. Others have
+	// priorityDefault.
+	collectorPriority = map[string]int{
+		"arp":       priorityCheap,
+		"conntrack": priorityCheap,
+		"cpu":       priorityCheap,
+		"diskstats": priorityCheap,
+		"entropy":   priorityCheap,
+		"filefd":    priorityCheap,
+		"loadavg":   priorityCheap,
+		"meminfo":   priorityCheap,
+		"netdev":    priorityCheap,
+		"netstat":   priorityCheap,
+		"sockstat":  priorityCheap,
+		"stat":      priorityCheap,
+		"time":      priorityCheap,
+		"timex":     priorityCheap,
+		"uname":     priorityCheap,
+		"vmstat":    priorityCheap,
+
+		"filesystem":  prioritySlow,
+		"logind":      prioritySlow,
+		"mountstats":  prioritySlow,
+		"ntp":         prioritySlow,
+		"supervisord": prioritySlow,
+		"systemd":     prioritySlow,
+		"textfile":    prioritySlow,
+		"wifi":        prioritySlow,
+	}
+)
+
+func priorityOf(name string) int {
+	if p, ok := collectorPriority[name]; ok {
+		return p
+	}
+	return priorityDefault
+}
+
+// scrapeOrder returns the names of collectors in the order they are run.
+func scrapeOrder(collectors map[string]Collector) []string {
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := priorityOf(names[i]), priorityOf(names[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// workers returns the number of collectors to run at once for n collectors.
+func workers(n int) int {
+	if *maxConcurrency > 0 && *maxConcurrency < n {
+		return *maxConcurrency
+	}
+	return n
+}
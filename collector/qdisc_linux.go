@@ -31,6 +31,7 @@ type qdiscStatCollector struct {
 	drops      typedDesc
 	requeues   typedDesc
 	overlimits typedDesc
+	fixtures   string
 }
 
 var (
@@ -69,6 +70,7 @@ func NewQdiscStatCollector() (Collector, error) {
 			"Number of overlimit packets.",
 			[]string{"device", "kind"}, nil,
 		), prometheus.CounterValue},
+		fixtures: stringOption("collector.qdisc.fixtures", collectorQdisc),
 	}, nil
 }
 
@@ -88,7 +90,7 @@ func (c *qdiscStatCollector) Update(ch chan<- prometheus.Metric) error {
 	var msgs []qdisc.QdiscInfo
 	var err error
 
-	fixtures := *collectorQdisc
+	fixtures := c.fixtures
 
 	if fixtures == "" {
 		msgs, err = qdisc.Get()
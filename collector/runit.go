@@ -26,6 +26,7 @@ var runitServiceDir = kingpin.Flag("collector.runit.servicedir", "Path to runit
 
 type runitCollector struct {
 	state, stateDesired, stateNormal, stateTimestamp typedDesc
+	serviceDir                                       string
 }
 
 func init() {
@@ -61,11 +62,12 @@ func NewRunitCollector() (Collector, error) {
 			"Unix timestamp of the last runit service state change.",
 			labelNames, constLabels,
 		), prometheus.GaugeValue},
+		serviceDir: stringOption("collector.runit.servicedir", runitServiceDir),
 	}, nil
 }
 
 func (c *runitCollector) Update(ch chan<- prometheus.Metric) error {
-	services, err := runit.GetServices(*runitServiceDir)
+	services, err := runit.GetServices(c.serviceDir)
 	if err != nil {
 		return err
 	}
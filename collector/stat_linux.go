@@ -16,9 +16,7 @@
 package collector
 
 import (
-	"fmt"
-
-	"github.com/prometheus/procfs"
+	"context"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -74,11 +72,12 @@ func NewStatCollector() (Collector, error) {
 
 // Update implements Collector and exposes kernel and system statistics.
 func (c *statCollector) Update(ch chan<- prometheus.Metric) error {
-	fs, err := procfs.NewFS(*procPath)
-	if err != nil {
-		return fmt.Errorf("failed to open procfs: %v", err)
-	}
-	stats, err := fs.NewStat()
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *statCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	stats, err := readProcStat(ctx)
 	if err != nil {
 		return err
 	}
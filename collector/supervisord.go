@@ -33,6 +33,7 @@ type supervisordCollector struct {
 	stateDesc      *prometheus.Desc
 	exitStatusDesc *prometheus.Desc
 	startTimeDesc  *prometheus.Desc
+	url            string
 }
 
 func init() {
@@ -70,6 +71,7 @@ func NewSupervisordCollector() (Collector, error) {
 			labelNames,
 			nil,
 		),
+		url: stringOption("collector.supervisord.url", supervisordURL),
 	}, nil
 }
 
@@ -108,7 +110,7 @@ func (c *supervisordCollector) Update(ch chan<- prometheus.Metric) error {
 		PID           int    `xmlrpc:"pid"`
 	}
 
-	res, err := xmlrpc.Call(*supervisordURL, "supervisor.getAllProcessInfo")
+	res, err := xmlrpc.Call(c.url, "supervisor.getAllProcessInfo")
 	if err != nil {
 		return fmt.Errorf("unable to call supervisord: %s", err)
 	}
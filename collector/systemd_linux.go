@@ -48,6 +48,7 @@ type systemdCollector struct {
 	socketRefusedConnectionsDesc  *prometheus.Desc
 	unitWhitelistPattern          *regexp.Regexp
 	unitBlacklistPattern          *regexp.Regexp
+	private                       bool
 }
 
 var unitStatesName = []string{"active", "activating", "deactivating", "inactive", "failed"}
@@ -99,8 +100,8 @@ func NewSystemdCollector() (Collector, error) {
 	socketRefusedConnectionsDesc := prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, subsystem, "socket_refused_connections_total"),
 		"Total number of refused socket connections", []string{"name"}, nil)
-	unitWhitelistPattern := regexp.MustCompile(fmt.Sprintf("^(?:%s)$", *unitWhitelist))
-	unitBlacklistPattern := regexp.MustCompile(fmt.Sprintf("^(?:%s)$", *unitBlacklist))
+	unitWhitelistPattern := regexp.MustCompile(fmt.Sprintf("^(?:%s)$", stringOption("collector.systemd.unit-whitelist", unitWhitelist)))
+	unitBlacklistPattern := regexp.MustCompile(fmt.Sprintf("^(?:%s)$", stringOption("collector.systemd.unit-blacklist", unitBlacklist)))
 
 	return &systemdCollector{
 		unitDesc:                      unitDesc,
@@ -116,6 +117,7 @@ func NewSystemdCollector() (Collector, error) {
 		socketRefusedConnectionsDesc:  socketRefusedConnectionsDesc,
 		unitWhitelistPattern:          unitWhitelistPattern,
 		unitBlacklistPattern:          unitBlacklistPattern,
+		private:                       boolOption("collector.systemd.private", systemdPrivate),
 	}, nil
 }
 
@@ -240,7 +242,7 @@ func (c *systemdCollector) collectSystemState(ch chan<- prometheus.Metric, syste
 }
 
 func (c *systemdCollector) newDbus() (*dbus.Conn, error) {
-	if *systemdPrivate {
+	if c.private {
 		return dbus.NewSystemdConnection()
 	}
 	return dbus.New()
@@ -16,6 +16,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -55,7 +56,7 @@ func init() {
 // in the given textfile directory.
 func NewTextFileCollector() (Collector, error) {
 	c := &textFileCollector{
-		path: *textFileDirectory,
+		path: stringOption("collector.textfile.directory", textFileDirectory),
 	}
 	return c, nil
 }
@@ -183,6 +184,11 @@ func (c *textFileCollector) exportMTimes(mtimes map[string]time.Time, ch chan<-
 
 // Update implements the Collector interface.
 func (c *textFileCollector) Update(ch chan<- prometheus.Metric) error {
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface.
+func (c *textFileCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
 	error := 0.0
 	mtimes := map[string]time.Time{}
 
@@ -194,6 +200,9 @@ func (c *textFileCollector) Update(ch chan<- prometheus.Metric) error {
 	}
 
 	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !strings.HasSuffix(f.Name(), ".prom") {
 			continue
 		}
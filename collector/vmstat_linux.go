@@ -45,7 +45,7 @@ func init() {
 
 // NewvmStatCollector returns a new Collector exposing vmstat stats.
 func NewvmStatCollector() (Collector, error) {
-	pattern := regexp.MustCompile(*vmStatFields)
+	pattern := regexp.MustCompile(stringOption("collector.vmstat.fields", vmStatFields))
 	return &vmStatCollector{
 		fieldPattern: pattern,
 	}, nil
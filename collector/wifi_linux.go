@@ -38,6 +38,8 @@ type wifiCollector struct {
 	stationTransmitRetriesTotal  *prometheus.Desc
 	stationTransmitFailedTotal   *prometheus.Desc
 	stationBeaconLossTotal       *prometheus.Desc
+
+	fixtures string
 }
 
 var (
@@ -138,11 +140,13 @@ func NewWifiCollector() (Collector, error) {
 			labels,
 			nil,
 		),
+
+		fixtures: stringOption("collector.wifi.fixtures", collectorWifi),
 	}, nil
 }
 
 func (c *wifiCollector) Update(ch chan<- prometheus.Metric) error {
-	stat, err := newWifiStater(*collectorWifi)
+	stat, err := newWifiStater(c.fixtures)
 	if err != nil {
 		// Cannot access wifi metrics, report no error.
 		if os.IsNotExist(err) {
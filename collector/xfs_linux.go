@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -44,10 +45,19 @@ func NewXFSCollector() (Collector, error) {
 
 // Update implements Collector.
 func (c *xfsCollector) Update(ch chan<- prometheus.Metric) error {
-	stats, err := c.fs.XFSStats()
+	return c.UpdateContext(context.Background(), ch)
+}
+
+// UpdateContext implements the ContextCollector interface, the XFS stats
+// are read through the scrape cache.
+func (c *xfsCollector) UpdateContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	v, err := fileCacheFrom(ctx).load(sysFilePath("fs/xfs"), func() (interface{}, error) {
+		return c.fs.XFSStats()
+	})
 	if err != nil {
 		return fmt.Errorf("failed to retrieve XFS stats: %v", err)
 	}
+	stats := v.([]*xfs.Stats)
 
 	for _, s := range stats {
 		c.updateXFSStats(ch, s)
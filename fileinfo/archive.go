@@ -0,0 +1,517 @@
+package fileinfo
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/redact"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// The files of a configure are archived within its budgets: a file longer
+// than MaxFileSize, or than what is left of the MaxSize of the configure,
+// is cut and ends with fileTruncated, once redacted. Directories are walked
+// down to MaxDepth, their entries filtered by Include and Exclude, their
+// symlinks followed, kept as links or skipped, and their sockets, devices
+// and FIFOs skipped. The entries keep the metadata of their files, also exported as
+// the file_info_* metrics.
+
+const (
+	fileTruncated = "\n[truncated]\n"
+
+	symlinksFollow = "follow"
+	symlinksKeep   = "keep"
+	symlinksSkip   = "skip"
+
+	// reasons a file is not archived
+	skipExcluded = "excluded"
+	skipDepth    = "depth"
+	skipSymlink  = "symlink"
+	skipSpecial  = "special"
+	skipError    = "error"
+)
+
+var (
+	maxFileSize = kingpin.Flag("fileinfo.max-file-size", "Default size a file archived by a fileinfo configure is truncated to, 0 for no limit.").Default("1MB").Bytes()
+	maxSize     = kingpin.Flag("fileinfo.max-size", "Default total size of the files archived by a fileinfo configure, 0 for no limit.").Default("4MB").Bytes()
+
+	archiveFilesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "archive", "files"),
+		"fileinfo: Number of files in the last archive of a configure.",
+		[]string{"configure"},
+		nil,
+	)
+	archiveBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "archive", "bytes"),
+		"fileinfo: Size of the file contents in the last archive of a configure.",
+		[]string{"configure"},
+		nil,
+	)
+	archiveTruncatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "archive", "truncated_files"),
+		"fileinfo: Number of files cut by the size limits in the last archive of a configure.",
+		[]string{"configure"},
+		nil,
+	)
+	archiveSkippedFilesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "archive", "skipped_files"),
+		"fileinfo: Number of files and directories left out of the last archive of a configure.",
+		[]string{"configure", "reason"},
+		nil,
+	)
+	archiveSkippedBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "archive", "skipped_bytes"),
+		"fileinfo: Size of the file contents cut by the size limits from the last archive of a configure.",
+		[]string{"configure"},
+		nil,
+	)
+
+	fileSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "info", "size_bytes"),
+		"fileinfo: Size of an archived file, sha256 is the hash of its content in the archive.",
+		[]string{"configure", "path", "sha256"},
+		nil,
+	)
+	fileArchivedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "info", "archived_bytes"),
+		"fileinfo: Size of the content of a file in the archive, after truncation and redaction.",
+		[]string{"configure", "path"},
+		nil,
+	)
+	fileMtimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "info", "mtime_seconds"),
+		"fileinfo: Modification time of an archived file, directory or symlink.",
+		[]string{"configure", "path"},
+		nil,
+	)
+	fileModeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "info", "mode"),
+		"fileinfo: Permission bits, setuid, setgid and sticky included, of an archived file, directory or symlink.",
+		[]string{"configure", "path", "type", "owner", "group", "target"},
+		nil,
+	)
+)
+
+// parseLimits checks the walk and size settings of g, it returns the json
+// name of the invalid field.
+func (g *fileGroup) parseLimits() (string, error) {
+	for _, p := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"include", g.Include},
+		{"exclude", g.Exclude},
+	} {
+		for _, pattern := range p.patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return p.name, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+			}
+		}
+	}
+
+	if g.MaxDepth < 0 {
+		return "max_depth", fmt.Errorf("max_depth must not be negative: %d", g.MaxDepth)
+	}
+
+	switch g.Symlinks {
+	case "", symlinksFollow, symlinksKeep, symlinksSkip:
+	default:
+		return "symlinks", fmt.Errorf("unknown symlinks %q", g.Symlinks)
+	}
+
+	for _, s := range []struct {
+		name  string
+		value string
+		dst   *int64
+	}{
+		{"max_file_size", g.MaxFileSize, &g.maxFileSize},
+		{"max_size", g.MaxSize, &g.maxSize},
+	} {
+		if s.value == "" {
+			continue
+		}
+		n, err := units.ParseBase2Bytes(s.value)
+		if err != nil {
+			return s.name, fmt.Errorf("invalid %s: %s", s.name, err)
+		}
+		if n <= 0 {
+			return s.name, fmt.Errorf("%s must be positive: %s", s.name, s.value)
+		}
+		*s.dst = int64(n)
+	}
+	return "", nil
+}
+
+// archiver writes the files of a configure to a tarball.
+type archiver struct {
+	g  *fileGroup
+	tw *tar.Writer
+
+	maxFileSize, maxSize int64 // 0 for no limit
+
+	files, size, truncated, skippedBytes int64
+	skipped                              map[string]int64 // by reason
+
+	// dirs are the directories being walked, to stop on symlink loops
+	dirs []os.FileInfo
+
+	// entries are the file_info_* metrics of the archived files, seen
+	// their paths, a path is archived once
+	entries []prometheus.Metric
+	seen    map[string]bool
+}
+
+func newArchiver(g *fileGroup, tw *tar.Writer) *archiver {
+	a := &archiver{
+		g:           g,
+		tw:          tw,
+		maxFileSize: g.maxFileSize,
+		maxSize:     g.maxSize,
+		skipped:     map[string]int64{},
+		seen:        map[string]bool{},
+	}
+	if a.maxFileSize == 0 {
+		a.maxFileSize = int64(*maxFileSize)
+	}
+	if a.maxSize == 0 {
+		a.maxSize = int64(*maxSize)
+	}
+	return a
+}
+
+// add archives a configured file or directory, it is always followed.
+func (a *archiver) add(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		a.skipped[skipError]++
+		return
+	}
+
+	switch {
+	case fi.IsDir():
+		a.addDir(path, fi, 1)
+	case fi.Mode().IsRegular():
+		a.addFile(path)
+	default:
+		a.skipped[skipSpecial]++
+	}
+}
+
+// addDir archives the directory path and its entries, at depth under the
+// configured directory.
+func (a *archiver) addDir(path string, fi os.FileInfo, depth int) {
+	if a.seen[path] {
+		return
+	}
+	for _, d := range a.dirs {
+		if os.SameFile(d, fi) {
+			a.skipped[skipSymlink]++
+			return
+		}
+	}
+	a.dirs = append(a.dirs, fi)
+	defer func() {
+		a.dirs = a.dirs[:len(a.dirs)-1]
+	}()
+
+	a.write(path, &taritem{path: a.tarPath(path), fi: fi})
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		a.skipped[skipError]++
+		return
+	}
+	for _, e := range entries {
+		full := filepath.Join(path, e.Name())
+		if matchGlobs(a.g.Exclude, full) {
+			a.skipped[skipExcluded]++
+			continue
+		}
+
+		// ReadDir does not follow symlinks
+		if e.Mode()&os.ModeSymlink != 0 {
+			switch a.g.Symlinks {
+			case symlinksSkip:
+				a.skipped[skipSymlink]++
+				continue
+			case symlinksKeep:
+				if len(a.g.Include) > 0 && !matchGlobs(a.g.Include, full) {
+					a.skipped[skipExcluded]++
+				} else {
+					a.addLink(full, e)
+				}
+				continue
+			}
+			if e, err = os.Stat(full); err != nil {
+				a.skipped[skipError]++
+				continue
+			}
+		}
+
+		switch {
+		case e.IsDir():
+			if a.g.MaxDepth > 0 && depth >= a.g.MaxDepth {
+				a.skipped[skipDepth]++
+				continue
+			}
+			a.addDir(full, e, depth+1)
+		case !e.Mode().IsRegular():
+			a.skipped[skipSpecial]++
+		case len(a.g.Include) > 0 && !matchGlobs(a.g.Include, full):
+			a.skipped[skipExcluded]++
+		default:
+			a.addFile(full)
+		}
+	}
+}
+
+// addFile archives the regular file path within the budgets left.
+func (a *archiver) addFile(path string) {
+	if a.seen[path] {
+		return
+	}
+
+	limit := int64(-1)
+	if a.maxFileSize > 0 {
+		limit = a.maxFileSize
+	}
+	if a.maxSize > 0 {
+		left := a.maxSize - a.size
+		if left < 0 {
+			left = 0
+		}
+		if limit < 0 || left < limit {
+			limit = left
+		}
+	}
+
+	// files are redacted before they are cut, a secret crossing the limit
+	// would not match its rule once cut
+	readLimit := limit
+	if len(a.g.redact) > 0 {
+		readLimit = redact.ReadLimit(limit)
+	}
+	content, fi, fileSize, err := readLimited(path, readLimit)
+	if err != nil {
+		a.skipped[skipError]++
+		return
+	}
+	cut := fileSize - int64(len(content))
+
+	if len(a.g.redact) > 0 {
+		var keep bool
+		var counts redact.Counts
+		content, keep, counts = redact.Content(a.g.redact, path, content)
+		countRedactions(a.g.name, counts)
+		if !keep {
+			return
+		}
+		if limit >= 0 && int64(len(content)) > limit {
+			cut += int64(len(content)) - limit
+			content = content[:limit]
+		}
+	}
+
+	a.files++
+	a.size += int64(len(content))
+	if cut > 0 {
+		a.truncated++
+		a.skippedBytes += cut
+		content = append(content, fileTruncated...)
+	}
+	a.write(path, &taritem{path: a.tarPath(path), fi: fi, size: fileSize, content: content})
+}
+
+// addLink archives the symlink path as a link to its target.
+func (a *archiver) addLink(path string, fi os.FileInfo) {
+	if a.seen[path] {
+		return
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		a.skipped[skipError]++
+		return
+	}
+	a.write(path, &taritem{path: a.tarPath(path), fi: fi, link: target})
+}
+
+// readLimited reads at most limit bytes of path, all of it if limit is
+// negative. It also returns the info and the size of the file.
+func readLimited(path string, limit int64) ([]byte, os.FileInfo, int64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var r io.Reader = fp
+	if limit >= 0 {
+		r = io.LimitReader(fp, limit)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// files of /proc and /sys have no size
+	size := fi.Size()
+	if size < int64(len(content)) {
+		size = int64(len(content))
+	}
+	if limit >= 0 && int64(len(content)) == limit {
+		if n, _ := fp.Read(make([]byte, 1)); n > 0 && size == int64(len(content)) {
+			size++
+		}
+	}
+	return content, fi, size, nil
+}
+
+// tarPath returns the path of path in the archive, under the directory of
+// the configure.
+func (a *archiver) tarPath(path string) string {
+	tarpath := a.g.name
+	if !strings.HasPrefix(path, string(os.PathSeparator)) {
+		tarpath += string(os.PathSeparator)
+	}
+	return tarpath + path
+}
+
+// write adds item, the entry of path, to the archive and its metadata to
+// the metrics.
+func (a *archiver) write(path string, item *taritem) {
+	a.seen[path] = true
+	h, err := updateTar(a.tw, item)
+	if err != nil {
+		a.skipped[skipError]++
+		return
+	}
+
+	name := a.g.name
+	typ := "file"
+	switch h.Typeflag {
+	case tar.TypeDir:
+		typ = "dir"
+	case tar.TypeSymlink:
+		typ = "symlink"
+	default:
+		sum := sha256.Sum256(item.content)
+		a.entries = append(a.entries,
+			prometheus.MustNewConstMetric(fileSizeDesc, prometheus.GaugeValue, float64(item.size), name, path, hex.EncodeToString(sum[:])),
+			prometheus.MustNewConstMetric(fileArchivedDesc, prometheus.GaugeValue, float64(h.Size), name, path),
+		)
+	}
+	a.entries = append(a.entries,
+		prometheus.MustNewConstMetric(fileMtimeDesc, prometheus.GaugeValue, float64(h.ModTime.Unix()), name, path),
+		prometheus.MustNewConstMetric(fileModeDesc, prometheus.GaugeValue, float64(h.Mode), name, path, typ, owner(h.Uname, h.Uid), owner(h.Gname, h.Gid), h.Linkname),
+	)
+}
+
+// owner returns the name of a user or group, or its id if it has none.
+func owner(name string, id int) string {
+	if name != "" {
+		return name
+	}
+	return strconv.Itoa(id)
+}
+
+// metrics returns the stats of the archive.
+func (a *archiver) metrics() []prometheus.Metric {
+	name := a.g.name
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(archiveFilesDesc, prometheus.GaugeValue, float64(a.files), name),
+		prometheus.MustNewConstMetric(archiveBytesDesc, prometheus.GaugeValue, float64(a.size), name),
+		prometheus.MustNewConstMetric(archiveTruncatedDesc, prometheus.GaugeValue, float64(a.truncated), name),
+		prometheus.MustNewConstMetric(archiveSkippedBytesDesc, prometheus.GaugeValue, float64(a.skippedBytes), name),
+	}
+	for _, reason := range []string{skipExcluded, skipDepth, skipSymlink, skipSpecial, skipError} {
+		metrics = append(metrics, prometheus.MustNewConstMetric(archiveSkippedFilesDesc, prometheus.GaugeValue, float64(a.skipped[reason]), name, reason))
+	}
+	return append(metrics, a.entries...)
+}
+
+func describeArchive(ch chan<- *prometheus.Desc) {
+	ch <- archiveFilesDesc
+	ch <- archiveBytesDesc
+	ch <- archiveTruncatedDesc
+	ch <- archiveSkippedFilesDesc
+	ch <- archiveSkippedBytesDesc
+	ch <- fileSizeDesc
+	ch <- fileArchivedDesc
+	ch <- fileMtimeDesc
+	ch <- fileModeDesc
+}
+
+// matchGlobs reports whether path matches one of patterns, patterns without
+// a / match the name of path.
+func matchGlobs(patterns []string, path string) bool {
+	for _, p := range patterns {
+		name := path
+		if !strings.Contains(p, "/") {
+			name = filepath.Base(path)
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// taritem is an entry of an archive, the directory of a configure if fi is
+// nil.
+type taritem struct {
+	path    string
+	fi      os.FileInfo
+	link    string // target of a symlink
+	size    int64  // size of a file, its content may be cut or redacted
+	content []byte
+}
+
+// updateTar adds item to tw with the metadata of its file, owner and group
+// names included, and returns its header.
+func updateTar(tw *tar.Writer, item *taritem) (*tar.Header, error) {
+	var h *tar.Header
+	if item.fi == nil {
+		h = &tar.Header{
+			Typeflag: tar.TypeDir,
+			Mode:     0777,
+			ModTime:  time.Now(),
+		}
+	} else {
+		var err error
+		if h, err = tar.FileInfoHeader(item.fi, item.link); err != nil {
+			return nil, err
+		}
+	}
+	h.Name = item.path
+	if h.Typeflag == tar.TypeReg {
+		// the content may be redacted or truncated
+		h.Size = int64(len(item.content))
+	}
+
+	if err := tw.WriteHeader(h); err != nil {
+		return nil, err
+	}
+	if h.Typeflag == tar.TypeReg {
+		if _, err := tw.Write(item.content); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
@@ -0,0 +1,94 @@
+// +build !windows
+
+package fileinfo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestArchiveSymlinks(t *testing.T) {
+	dir := testTree(t, map[string]string{
+		"etc/a.conf":     "a",
+		"shared/s.conf":  "s",
+		"etc/sub/b.conf": "b",
+	})
+	defer os.RemoveAll(dir)
+	etc := filepath.Join(dir, "etc")
+
+	for link, target := range map[string]string{
+		"etc/link.conf": "a.conf",
+		"etc/shared":    "../shared",
+		"etc/sub/loop":  "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(etc, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		symlinks string
+		want     map[string]string
+		skipped  map[string]int64
+	}{
+		{
+			// the loop back to etc is not walked again
+			symlinks: symlinksFollow,
+			want: map[string]string{
+				"etc/":              "",
+				"etc/a.conf":        "a",
+				"etc/link.conf":     "a",
+				"etc/shared/":       "",
+				"etc/shared/s.conf": "s",
+				"etc/sub/":          "",
+				"etc/sub/b.conf":    "b",
+			},
+			skipped: map[string]int64{skipSymlink: 1, skipSpecial: 1},
+		},
+		{
+			symlinks: symlinksKeep,
+			want: map[string]string{
+				"etc/":           "",
+				"etc/a.conf":     "a",
+				"etc/link.conf":  "-> a.conf",
+				"etc/shared":     "-> ../shared",
+				"etc/sub/":       "",
+				"etc/sub/b.conf": "b",
+				"etc/sub/loop":   "-> ..",
+			},
+			skipped: map[string]int64{skipSpecial: 1},
+		},
+		{
+			symlinks: symlinksSkip,
+			want: map[string]string{
+				"etc/":           "",
+				"etc/a.conf":     "a",
+				"etc/sub/":       "",
+				"etc/sub/b.conf": "b",
+			},
+			skipped: map[string]int64{skipSymlink: 3, skipSpecial: 1},
+		},
+	} {
+		a, got := testArchive(t, &fileGroup{Symlinks: c.symlinks}, dir, etc)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want %v, got %v", c.symlinks, c.want, got)
+		}
+		for _, reason := range []string{skipExcluded, skipDepth, skipSymlink, skipSpecial, skipError} {
+			if a.skipped[reason] != c.skipped[reason] {
+				t.Errorf("%s: want %d files skipped as %s, got %d", c.symlinks, c.skipped[reason], reason, a.skipped[reason])
+			}
+		}
+	}
+
+	// a configured FIFO is skipped too
+	a, got := testArchive(t, &fileGroup{}, dir, filepath.Join(etc, "fifo"))
+	if len(got) != 0 || a.skipped[skipSpecial] != 1 {
+		t.Errorf("want the fifo skipped, got %v, %v", got, a.skipped)
+	}
+}
@@ -0,0 +1,102 @@
+package fileinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/node_exporter/redact"
+)
+
+// Problem is a problem of the fileinfo configure found by Check.
+type Problem struct {
+	// Path is the json path of the problem in the configure, such as
+	// ["configures", "nginx", 2], empty for the whole configure
+	Path    []interface{}
+	Warning bool
+	Msg     string
+}
+
+// Check reports every problem of the fileinfo configure j. Files missing
+// are reported as warnings, files or directories larger than maxSize bytes
+// as errors, 0 disables the size check.
+func Check(j []byte, maxSize int64) []Problem {
+	var cfg fileInfoCfg
+	if err := json.Unmarshal(j, &cfg); err != nil {
+		return []Problem{{Msg: err.Error()}}
+	}
+
+	var problems []Problem
+	for name, g := range cfg.Configures {
+		if g == nil {
+			problems = append(problems, Problem{Path: []interface{}{"configures", name}, Msg: "empty configure"})
+			continue
+		}
+		if field, err := g.parse(name); err != nil {
+			path := []interface{}{"configures", name}
+			if field != "" {
+				path = append(path, field)
+			}
+			problems = append(problems, Problem{Path: path, Msg: err.Error()})
+			continue
+		}
+
+		for i, f := range g.Files {
+			path := []interface{}{"configures", name, i}
+			if !g.list {
+				path = []interface{}{"configures", name, "files", i}
+			}
+
+			size, err := diskUsage(f)
+			switch {
+			case os.IsNotExist(err):
+				problems = append(problems, Problem{Path: path, Warning: true, Msg: fmt.Sprintf("%s does not exist", f)})
+			case err != nil:
+				problems = append(problems, Problem{Path: path, Msg: err.Error()})
+			case maxSize > 0 && size > maxSize:
+				problems = append(problems, Problem{Path: path, Msg: fmt.Sprintf("%s is %d bytes, over the %d bytes limit", f, size, maxSize)})
+			}
+		}
+	}
+
+	for name, rules := range cfg.Redact {
+		path := []interface{}{"redact", name}
+		if _, ok := cfg.Configures[name]; !ok {
+			problems = append(problems, Problem{Path: path, Msg: fmt.Sprintf("redact rules of unknown configure %q", name)})
+			continue
+		}
+		if err := redact.Compile(rules, true); err != nil {
+			if re, ok := err.(*redact.RuleError); ok {
+				path = append(path, re.Index)
+			}
+			problems = append(problems, Problem{Path: path, Msg: err.Error()})
+		}
+	}
+
+	return problems
+}
+
+// diskUsage returns the size of the file, or of all the files under the
+// directory path.
+func diskUsage(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.IsDir() {
+		return fi.Size(), nil
+	}
+
+	var size int64
+	err = filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
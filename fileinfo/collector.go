@@ -3,17 +3,61 @@ package fileinfo
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/node_exporter/rtpanic"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
-	factories      = make(map[string]func(*fileInfoCfg) (Collector, error))
-	collectorState = make(map[string]bool)
-	factoryArgs    = make(map[string]*fileInfoCfg)
+	factories        = make(map[string]func(*fileGroup) (Collector, error))
+	collectorState   = make(map[string]*bool)
+	flagStates       = make(map[string]*bool) // values of the --[no-]fileinfo.collector.<name> flags
+	forcedCollectors = make(map[string]bool)
+	factoryArgs      = make(map[string]*fileGroup)
+
+	// allEnabled is set by EnableAllCollectors, collectors added by
+	// ApplyConfig are then enabled too
+	allEnabled = false
+
+	// collectorStateMtx guards the values of collectorState and factoryArgs,
+	// which can be changed at runtime by SetCollector and ApplyConfig
+	collectorStateMtx = sync.RWMutex{}
+
+	scrapeDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_duration_seconds"),
+		"fileinfo: Duration of a collector scrape.",
+		[]string{"collector"},
+		nil,
+	)
+	scrapeSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_success"),
+		"fileinfo: Whether a collector succeeded, 0 if it failed or panicked.",
+		[]string{"collector"},
+		nil,
+	)
+	scrapePanicsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_panics_total"),
+		"fileinfo: Total number of collector scrapes which panicked.",
+		[]string{"collector"},
+		nil,
+	)
+
+	scrapeQueueWaitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_queue_wait_seconds"),
+		"fileinfo: Time a collector waited for a free worker before it started.",
+		[]string{"collector"},
+		nil,
+	)
+
+	maxConcurrency = kingpin.Flag("fileinfo.max-concurrency", "Maximum number of fileinfo collectors running at once during a scrape, 0 runs all of them at once.").Default("1").Int()
+
+	panicsMtx = sync.Mutex{}
+	panics    = make(map[string]uint64)
 )
 
 type Collector interface {
@@ -24,12 +68,129 @@ type fileInfoHandler struct {
 	unfilteredHandler http.Handler
 }
 
-func registerCollector(collector string, isDefaultEnabled bool, factory func(*fileInfoCfg) (Collector, error), arg *fileInfoCfg) {
-	collectorState[collector] = isDefaultEnabled
+func registerCollector(collector string, isDefaultEnabled bool, factory func(*fileGroup) (Collector, error), arg *fileGroup) error {
+	if _, ok := factories[collector]; ok {
+		return fmt.Errorf("duplicate collector: %s", collector)
+	}
+
+	var helpDefaultState string
+	if isDefaultEnabled {
+		helpDefaultState = "enabled"
+	} else {
+		helpDefaultState = "disabled"
+	}
+
+	flagName := fmt.Sprintf("fileinfo.collector.%s", collector)
+	flagHelp := fmt.Sprintf("Enable the %s fileinfo collector (default: %s).", collector, helpDefaultState)
+	defaultValue := fmt.Sprintf("%v", isDefaultEnabled)
+
+	flag := kingpin.Flag(flagName, flagHelp).Default(defaultValue).Action(collectorFlagAction(collector)).Bool()
+	collectorState[collector] = flag
+	flagStates[collector] = flag
+
 	factories[collector] = factory
 	if arg != nil {
 		factoryArgs[collector] = arg
 	}
+	return nil
+}
+
+// collectorFlagAction records that the collector has been explicitly enabled
+// or disabled from the command line.
+func collectorFlagAction(collector string) func(ctx *kingpin.ParseContext) error {
+	return func(ctx *kingpin.ParseContext) error {
+		forcedCollectors[collector] = true
+		return nil
+	}
+}
+
+// ListAllCollectors returns the enabled state of every registered collector.
+func ListAllCollectors() map[string]bool {
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
+	res := make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		res[name] = *enabled
+	}
+	return res
+}
+
+// SetCollector enables or disables a registered collector. It only affects
+// collectors created afterwards.
+func SetCollector(collector string, isEnabled bool) error {
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	if _, ok := collectorState[collector]; !ok {
+		return fmt.Errorf("missing collector: %s", collector)
+	}
+
+	*collectorState[collector] = isEnabled
+	return nil
+}
+
+// EnableAllCollectors enables every collector that has not been explicitly
+// disabled by a --no-fileinfo.collector.<name> flag.
+func EnableAllCollectors() {
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	allEnabled = true
+	for collector, enabled := range collectorState {
+		if !forcedCollectors[collector] {
+			*enabled = true
+		}
+	}
+}
+
+// ApplyConfig replaces the fileinfo collectors with the ones of the
+// fileinfo configure j. Collectors keep their --[no-]fileinfo.collector.<name>
+// flag if they have one. It returns a function restoring the previous
+// collectors if applying the rest of the config fails.
+func ApplyConfig(j []byte) (func(), error) {
+	groups, err := parseConfig(j)
+	if err != nil {
+		return nil, err
+	}
+
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	oldFactories, oldState, oldArgs := factories, collectorState, factoryArgs
+	oldEnabled := make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		oldEnabled[name] = *enabled
+	}
+
+	factories = make(map[string]func(*fileGroup) (Collector, error))
+	collectorState = make(map[string]*bool)
+	factoryArgs = make(map[string]*fileGroup)
+
+	for _, g := range groups {
+		// reuse the flag value of collectors registered at startup
+		enabled, ok := flagStates[g.name]
+		if !ok {
+			enabled = new(bool)
+		}
+		if !forcedCollectors[g.name] {
+			*enabled = g.enabled() || allEnabled
+		}
+
+		factories[g.name] = NewFileCollector
+		collectorState[g.name] = enabled
+		factoryArgs[g.name] = g
+	}
+
+	return func() {
+		collectorStateMtx.Lock()
+		defer collectorStateMtx.Unlock()
+
+		factories, collectorState, factoryArgs = oldFactories, oldState, oldArgs
+		for name, enabled := range oldEnabled {
+			*collectorState[name] = enabled
+		}
+	}, nil
 }
 
 type FileInfoCollector struct {
@@ -37,13 +198,16 @@ type FileInfoCollector struct {
 }
 
 func NewFileInfoCollector(filters ...string) (*FileInfoCollector, error) {
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
 	f := make(map[string]bool)
 	for _, filter := range filters {
 		enabled, exist := collectorState[filter]
 		if !exist {
 			return nil, fmt.Errorf("missing collector: %s", filter)
 		}
-		if !enabled {
+		if !*enabled {
 			return nil, fmt.Errorf("disabled collector: %s", filter)
 		}
 		f[filter] = true
@@ -51,7 +215,7 @@ func NewFileInfoCollector(filters ...string) (*FileInfoCollector, error) {
 
 	collectors := make(map[string]Collector)
 	for key, enabled := range collectorState {
-		if enabled {
+		if *enabled {
 			collector, err := factories[key](factoryArgs[key]) // call NewxxxCollector()
 			if err != nil {
 				continue
@@ -65,32 +229,99 @@ func NewFileInfoCollector(filters ...string) (*FileInfoCollector, error) {
 }
 
 func (c FileInfoCollector) Describe(ch chan<- *prometheus.Desc) {
-	//ch <- scrapeDurationDesc
-	//ch <- scrapeSuccessDesc
-
+	ch <- scrapeDurationDesc
+	ch <- scrapeSuccessDesc
+	ch <- scrapePanicsDesc
+	ch <- scrapeQueueWaitDesc
+	ch <- cacheAgeDesc
+	ch <- redactionsTotalDesc
+	describeArchive(ch)
 }
 
 func (c FileInfoCollector) Collect(ch chan<- prometheus.Metric) {
-	wg := sync.WaitGroup{}
-	wg.Add(len(c.Collectors))
-
 	log.Debugf("fileinfo try collect...")
 
-	for name, _c := range c.Collectors {
-		go func(name string, ec Collector) {
-			execute(name, ec, ch)
-			wg.Done()
-		}(name, _c)
+	collectQueued(c.Collectors, ch)
+
+	collectPanics(c.Collectors, ch)
+
+	collectRedactions(c.Collectors, ch)
+}
+
+// collectQueued runs the collectors in order on at most maxConcurrency
+// workers.
+func collectQueued(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+
+	queue := make(chan string, len(names))
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
+
+	nworkers := len(names)
+	if *maxConcurrency > 0 && *maxConcurrency < nworkers {
+		nworkers = *maxConcurrency
+	}
+
+	begin := time.Now()
+	wg := sync.WaitGroup{}
+	wg.Add(nworkers)
+
+	for i := 0; i < nworkers; i++ {
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				ch <- prometheus.MustNewConstMetric(scrapeQueueWaitDesc, prometheus.GaugeValue, time.Since(begin).Seconds(), name)
+				execute(name, collectors[name], ch)
+			}
+		}()
 	}
 	wg.Wait()
 }
 
 func execute(name string, c Collector, ch chan<- prometheus.Metric) {
 	begin := time.Now()
-	err := c.Update(ch)
+	err := update(name, c, ch)
 	duration := time.Since(begin)
 
+	var success float64
 	if err != nil {
 		log.Errorf("ERROR: %s collector failed after %fs: %s", name, duration.Seconds(), err)
+	} else {
+		log.Debugf("OK: %s collector succeeded after %fs.", name, duration.Seconds())
+		success = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, name)
+}
+
+// update calls the collector, a panic of the collector only fails its own
+// scrape and is returned as an error.
+func update(name string, c Collector, ch chan<- prometheus.Metric) (err error) {
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		panicsMtx.Lock()
+		panics[name]++
+		panicsMtx.Unlock()
+
+		err = fmt.Errorf("panic: %s", perr)
+	})
+
+	return c.Update(ch)
+}
+
+func collectPanics(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	panicsMtx.Lock()
+	defer panicsMtx.Unlock()
+
+	for name := range collectors {
+		ch <- prometheus.MustNewConstMetric(scrapePanicsDesc, prometheus.CounterValue, float64(panics[name]), name)
 	}
 }
@@ -0,0 +1,84 @@
+package fileinfo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestApplyConfig(t *testing.T) {
+	// the flags of Init are registered once
+	if _, ok := flagStates["apply_flagged"]; !ok {
+		if err := Init([]byte(`{"configures": {"apply_flagged": ["/etc/hosts"]}}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetCollector("apply_flagged", true); err != nil {
+		t.Fatal(err)
+	}
+	before := ListAllCollectors()
+
+	rollback, err := ApplyConfig([]byte(`{"configures": {
+	  "apply_flagged": ["/etc/hosts"],
+	  "apply_new": ["/etc/hostname"],
+	  "apply_off": {"files": ["/etc/passwd"], "enabled": false}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each configure is a collector of its own, a configure with a flag
+	// keeps it
+	want := map[string]bool{"apply_flagged": true, "apply_new": true, "apply_off": false}
+	if got := ListAllCollectors(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want collectors %v, got %v", want, got)
+	}
+	if flagStates["apply_flagged"] != collectorState["apply_flagged"] {
+		t.Errorf("want the flag of apply_flagged kept")
+	}
+
+	c, err := NewFileInfoCollector("apply_new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc, ok := c.Collectors["apply_new"].(*fileCollector); len(c.Collectors) != 1 || !ok || fc.group.name != "apply_new" {
+		t.Errorf("want the apply_new collector only, got %v", c.Collectors)
+	}
+	if _, err := NewFileInfoCollector("apply_off"); err == nil {
+		t.Errorf("want an error for a disabled collector")
+	}
+
+	// an invalid configure changes nothing
+	if _, err := ApplyConfig([]byte(`{"configures": {"apply_bad": {"files": ["/etc"], "max_depth": -1}}}`)); err == nil {
+		t.Errorf("want an error for an invalid configure")
+	}
+	if got := ListAllCollectors(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want collectors %v after an invalid configure, got %v", want, got)
+	}
+
+	// the rollback restores the previous collectors and their state
+	SetCollector("apply_flagged", false)
+	rollback()
+	if got := ListAllCollectors(); !reflect.DeepEqual(got, before) {
+		t.Errorf("want collectors %v after the rollback, got %v", before, got)
+	}
+	if _, err := NewFileInfoCollector("apply_new"); err == nil {
+		t.Errorf("want apply_new gone after the rollback")
+	}
+}
+
+type nopCollector struct{}
+
+func (nopCollector) Update(ch chan<- prometheus.Metric) error { return nil }
+
+func TestDescribe(t *testing.T) {
+	// a pedantic registry fails on a metric which was not described
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(FileInfoCollector{Collectors: map[string]Collector{"nop": nopCollector{}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Error(err)
+	}
+}
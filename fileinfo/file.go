@@ -6,82 +6,245 @@ import (
 	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
-	"strings"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/redact"
 )
 
 const namespace = "file"
 
+var (
+	redactionsTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "redactions", "total"),
+		"fileinfo: Total number of files or lines redacted from the files of a configure.",
+		[]string{"configure", "action"},
+		nil,
+	)
+
+	cacheAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "age_seconds"),
+		"fileinfo: Age of the cached archive served by a configure with an interval.",
+		[]string{"configure"},
+		nil,
+	)
+
+	redactionsMtx   = sync.Mutex{}
+	redactionsCount = make(map[[2]string]uint64) // {configure, action}
+
+	archivesMtx = sync.Mutex{}
+	archives    = make(map[string]*cachedArchive) // by configure
+)
+
 type fileInfoCfg struct {
-	Configures map[string][]string `json:"configures"`
+	Configures map[string]*fileGroup `json:"configures"`
+
+	// Redact are the redact rules of the files of each configure, applied
+	// before they are added to the tarball, see redact/redact.go.
+	Redact map[string][]*redact.Rule `json:"redact"`
+}
+
+// fileGroup is a configure, the files archived by a collector of its own.
+// It is either the list of its files, or an object with its settings.
+type fileGroup struct {
+	Files []string `json:"files"`
+	// Enabled is true by default.
+	Enabled *bool `json:"enabled"`
+	// Interval caches the archive of the group, it is rebuilt by the first
+	// scrape after Interval.
+	Interval string `json:"interval"`
+
+	// Include and Exclude filter the entries of the directories of the
+	// group by glob, a pattern without a / matches the name of the entry.
+	// Exclude also applies to directories.
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	// MaxDepth is how deep directories are walked, 1 for their entries
+	// only; 0 for no limit.
+	MaxDepth int `json:"max_depth"`
+	// MaxFileSize and MaxSize default to --fileinfo.max-file-size and
+	// --fileinfo.max-size.
+	MaxFileSize string `json:"max_file_size"`
+	MaxSize     string `json:"max_size"`
+	// Symlinks in directories are followed, archived as links to their
+	// target with "keep", or skipped with "skip".
+	Symlinks string `json:"symlinks"`
+
+	name                 string
+	list                 bool // whether the group is a list of files
+	interval             time.Duration
+	maxFileSize, maxSize int64
+	redact               []*redact.Rule
+}
+
+func (g *fileGroup) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		g.list = true
+		return json.Unmarshal(b, &g.Files)
+	}
+	type plain fileGroup
+	return json.Unmarshal(b, (*plain)(g))
+}
+
+func (g *fileGroup) enabled() bool {
+	return g.Enabled == nil || *g.Enabled
+}
+
+var configureNameRE = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// parse checks the settings of the group name.
+func (g *fileGroup) parse(name string) (string, error) {
+	g.name = name
+	if !configureNameRE.MatchString(name) {
+		return "", fmt.Errorf("invalid configure name %q", name)
+	}
+	if g.Interval != "" {
+		d, err := time.ParseDuration(g.Interval)
+		if err != nil {
+			return "interval", fmt.Errorf("invalid interval: %s", err)
+		}
+		if d <= 0 {
+			return "interval", fmt.Errorf("interval must be positive: %s", g.Interval)
+		}
+		g.interval = d
+	}
+	return g.parseLimits()
 }
 
 type fileCollector struct {
-	cfg     *fileInfoCfg
+	group   *fileGroup
 	entries *prometheus.Desc
 }
 
-func NewFileCollector(cfg *fileInfoCfg) (Collector, error) {
+func NewFileCollector(g *fileGroup) (Collector, error) {
 	return &fileCollector{
-		cfg: cfg,
+		group: g,
 		entries: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "info"),
-			"", []string{"fileinfo"}, nil)}, nil
+			"", []string{"fileinfo", "configure"}, nil)}, nil
 }
 
-func Init(cfgpath string) {
-	var cfg fileInfoCfg
-	j, err := ioutil.ReadFile(cfgpath)
+// Init registers a collector per configure of the fileinfo configure j, the
+// content of fileinfo.json. It must be called before the command line is
+// parsed, for the --[no-]fileinfo.collector.<name> flags.
+func Init(j []byte) error {
+	groups, err := parseConfig(j)
 	if err != nil {
-		log.Fatalf("init file info failed: %s", cfgpath, err)
+		return err
 	}
 
+	for _, g := range groups {
+		if err := registerCollector(g.name, g.enabled(), NewFileCollector, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseConfig parses and checks the fileinfo configure j, it returns its
+// groups sorted by name.
+func parseConfig(j []byte) ([]*fileGroup, error) {
+	var cfg fileInfoCfg
 	if err := json.Unmarshal(j, &cfg); err != nil {
-		log.Fatalf("json load file info failed: %s", cfgpath, err)
+		return nil, err
 	}
 
-	registerCollector("fileinfo", true, NewFileCollector, &cfg)
+	var groups []*fileGroup
+	for name, g := range cfg.Configures {
+		if g == nil {
+			return nil, fmt.Errorf("%s: empty configure", name)
+		}
+		if _, err := g.parse(name); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		groups = append(groups, g)
+	}
+	for name, rules := range cfg.Redact {
+		g, ok := cfg.Configures[name]
+		if !ok {
+			return nil, fmt.Errorf("redact rules of unknown configure %q", name)
+		}
+		if err := redact.Compile(rules, true); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		g.redact = rules
+	}
+
+	sort.Slice(groups, func(i, k int) bool {
+		return groups[i].name < groups[k].name
+	})
+	return groups, nil
 }
 
 func (ec *fileCollector) Update(ch chan<- prometheus.Metric) error {
-	getFilesInfo(ec, ch)
+	g := ec.group
+	if g.interval <= 0 {
+		metrics, err := getFilesInfo(ec)
+		for _, m := range metrics {
+			ch <- m
+		}
+		return err
+	}
+
+	// the archive is rebuilt by the first scrape after the interval
+	c := cachedArchiveOf(g)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.metrics == nil || time.Since(c.at) >= g.interval {
+		metrics, err := getFilesInfo(ec)
+		if err != nil {
+			return err
+		}
+		c.metrics, c.at = metrics, time.Now()
+	}
+
+	ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, time.Since(c.at).Seconds(), g.name)
+	for _, m := range c.metrics {
+		ch <- m
+	}
 	return nil
 }
 
-var totalSize int64
+// cachedArchive is the last archive of a group with an interval.
+type cachedArchive struct {
+	mtx     sync.Mutex
+	group   *fileGroup
+	metrics []prometheus.Metric
+	at      time.Time
+}
+
+// cachedArchiveOf returns the cache of g, the cache of a previous configure
+// of the same group is dropped.
+func cachedArchiveOf(g *fileGroup) *cachedArchive {
+	archivesMtx.Lock()
+	defer archivesMtx.Unlock()
 
-func getFilesInfo(ec *fileCollector, ch chan<- prometheus.Metric) error {
+	c, ok := archives[g.name]
+	if !ok || c.group != g {
+		c = &cachedArchive{group: g}
+		archives[g.name] = c
+	}
+	return c
+}
+
+// getFilesInfo archives the files of the group of ec, and returns its
+// metrics.
+func getFilesInfo(ec *fileCollector) ([]prometheus.Metric, error) {
 
 	var err error
 	var buf bytes.Buffer
 
-	totalSize = 0
-
+	g := ec.group
 	tw := tar.NewWriter(&buf)
-	for name, files := range ec.cfg.Configures {
-		updateTar(tw, &taritem{
-			path: name,
-			dir:  true,
-		})
-		for _, f := range files {
-			finfo, err := os.Stat(f)
-			if err != nil {
-				continue
-			}
-			if finfo.IsDir() {
-				addItemToTar(tw, f, true, name)
-				addDirToTar(tw, f, name)
-			} else {
-				//TODO: check file size?
-				totalSize += finfo.Size()
-				addItemToTar(tw, f, false, name)
-			}
-		}
+	updateTar(tw, &taritem{path: g.name})
+	a := newArchiver(g, tw)
+	for _, f := range g.Files {
+		a.add(f)
 	}
 
 	tw.Close()
@@ -91,87 +254,41 @@ func getFilesInfo(ec *fileCollector, ch chan<- prometheus.Metric) error {
 	_, err = gzwr.Write(buf.Bytes())
 	if err != nil {
 		gzwr.Close()
-		return err
+		return nil, err
 	}
 
 	if err = gzwr.Close(); err != nil {
-		return err
+		return nil, err
 	}
 
 	raw := base64.RawURLEncoding.EncodeToString(gzbuf.Bytes())
-	ch <- newEnvMetric(ec, raw)
-	return nil
+	return append([]prometheus.Metric{newEnvMetric(ec, raw)}, a.metrics()...), nil
 }
 
 func newEnvMetric(ec *fileCollector, envVal string) prometheus.Metric {
-	return prometheus.MustNewConstMetric(ec.entries, prometheus.GaugeValue, float64(-1), envVal)
+	return prometheus.MustNewConstMetric(ec.entries, prometheus.GaugeValue, float64(-1), envVal, ec.group.name)
 }
 
-type taritem struct {
-	path    string
-	dir     bool
-	content []byte
-}
-
-func updateTar(tw *tar.Writer, item *taritem) error {
-	h := &tar.Header{
-		Name: item.path,
-	}
-	if item.dir {
-		h.Typeflag = tar.TypeDir
-		h.Mode = 0777
-	} else {
-		h.Mode = 0666
-	}
-	var err error
-	if err = tw.WriteHeader(h); err != nil {
-		return err
+func countRedactions(configure string, counts redact.Counts) {
+	redactionsMtx.Lock()
+	defer redactionsMtx.Unlock()
+	for action, n := range counts {
+		redactionsCount[[2]string{configure, action}] += uint64(n)
 	}
-
-	if !item.dir {
-		_, err = tw.Write(item.content)
-	}
-
-	return err
 }
 
-func addItemToTar(tw *tar.Writer, path string, dir bool, namespace string) {
-	var content []byte
-	var err error
-	if !dir {
-		content, err = ioutil.ReadFile(path)
-		if err != nil {
-			return
-		}
-		totalSize += int64(len(content))
-	}
+// collectRedactions exports the redaction counters of the configures with
+// redact rules.
+func collectRedactions(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	redactionsMtx.Lock()
+	defer redactionsMtx.Unlock()
 
-	tarpath := namespace
-	if !strings.HasPrefix(path, string(os.PathSeparator)) {
-		tarpath += string(os.PathSeparator)
-	}
-	tarpath += path
-	item := &taritem{
-		path:    tarpath,
-		dir:     dir,
-		content: content,
-	}
-	updateTar(tw, item)
-}
-
-func addDirToTar(tw *tar.Writer, path string, namespace string) {
-
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		return
-	}
-	for _, f := range files {
-		fullpath := filepath.Join(path, f.Name())
-		if f.IsDir() {
-			addItemToTar(tw, fullpath, true, namespace)
-			addDirToTar(tw, fullpath, namespace)
-		} else {
-			addItemToTar(tw, fullpath, false, namespace)
+	for name, c := range collectors {
+		if fc, ok := c.(*fileCollector); !ok || len(fc.group.redact) == 0 {
+			continue
+		}
+		for _, action := range []string{redact.ActionDrop, redact.ActionHash, redact.ActionMask} {
+			ch <- prometheus.MustNewConstMetric(redactionsTotalDesc, prometheus.CounterValue, float64(redactionsCount[[2]string{name, action}]), name, action)
 		}
 	}
 }
@@ -0,0 +1,55 @@
+package fileinfo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	groups, err := parseConfig([]byte(`{
+	  "configures": {
+	    "ssh": ["/etc/ssh/sshd_config"],
+	    "nginx": {"files": ["/etc/nginx"], "enabled": false, "interval": "5m",
+	              "exclude": ["*.gz"], "max_depth": 2, "max_file_size": "64KB", "symlinks": "skip"}
+	  },
+	  "redact": {"nginx": [{"action": "mask", "regex": "password \\S+"}]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sorted by name
+	if len(groups) != 2 || groups[0].name != "nginx" || groups[1].name != "ssh" {
+		t.Fatalf("unexpected groups %+v", groups)
+	}
+	nginx, ssh := groups[0], groups[1]
+	if nginx.list || nginx.enabled() || nginx.interval != 5*time.Minute || nginx.maxFileSize != 64<<10 || len(nginx.redact) != 1 {
+		t.Errorf("unexpected object group %+v", nginx)
+	}
+	if !ssh.list || !ssh.enabled() || !reflect.DeepEqual(ssh.Files, []string{"/etc/ssh/sshd_config"}) || ssh.redact != nil {
+		t.Errorf("unexpected list group %+v", ssh)
+	}
+
+	for _, c := range []struct {
+		cfg  string
+		want string
+	}{
+		{`{"configures": {"a b": ["/etc"]}}`, "invalid configure name"},
+		{`{"configures": {"etc": null}}`, "empty configure"},
+		{`{"configures": {"etc": {"files": ["/etc"], "interval": "soon"}}}`, "invalid interval"},
+		{`{"configures": {"etc": {"files": ["/etc"], "interval": "-1s"}}}`, "interval must be positive"},
+		{`{"configures": {"etc": {"files": ["/etc"], "max_depth": -1}}}`, "max_depth must not be negative"},
+		{`{"configures": {"etc": {"files": ["/etc"], "exclude": ["["]}}}`, "invalid pattern"},
+		{`{"configures": {"etc": {"files": ["/etc"], "symlinks": "copy"}}}`, "unknown symlinks"},
+		{`{"configures": {"etc": {"files": ["/etc"], "max_size": "0B"}}}`, "max_size must be positive"},
+		{`{"configures": {"etc": ["/etc"]}, "redact": {"var": [{"action": "drop"}]}}`, "unknown configure"},
+		{`{"configures": {"etc": ["/etc"]}, "redact": {"etc": [{"action": "shred"}]}}`, "etc: redact rule 0"},
+	} {
+		_, err := parseConfig([]byte(c.cfg))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: want error %q, got %v", c.cfg, c.want, err)
+		}
+	}
+}
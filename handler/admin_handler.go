@@ -0,0 +1,279 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/node_exporter/collector"
+	"github.com/prometheus/node_exporter/fileinfo"
+	"github.com/prometheus/node_exporter/kv"
+)
+
+const (
+	registryNode     = "node"
+	registryKv       = "kv"
+	registryFileinfo = "fileinfo"
+
+	AdminCollectorsPath = "/api/collectors"
+)
+
+// collectorRegistry is one of the node, kv and fileinfo collector sets as
+// seen by the admin API.
+type collectorRegistry struct {
+	list    func() map[string]bool
+	set     func(string, bool) error
+	handler interface{ Rebuild() error }
+}
+
+var registries = map[string]*collectorRegistry{
+	registryNode:     {list: collector.ListAllCollectors, set: collector.SetCollector},
+	registryKv:       {list: kv.ListAllCollectors, set: kv.SetCollector},
+	registryFileinfo: {list: fileinfo.ListAllCollectors, set: fileinfo.SetCollector},
+}
+
+// collectorStates is the enabled state of collectors per registry, as
+// returned by GET /api/collectors and saved in the admin state file.
+type collectorStates map[string]map[string]bool
+
+// savedStates holds the changes made through the admin API, only those are
+// saved so that flags keep working for the other collectors.
+var savedStates = collectorStates{}
+
+// LoadCollectorStates applies the collector states saved by the admin API
+// in stateFile. A missing file is not an error. It must be called before
+// the handlers are created.
+func LoadCollectorStates(stateFile string) error {
+	if stateFile == "" {
+		return nil
+	}
+
+	j, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(j, &savedStates); err != nil {
+		return fmt.Errorf("load %s failed: %s", stateFile, err)
+	}
+
+	applySavedStates(stateFile)
+	return nil
+}
+
+// applySavedStates applies the changes made through the admin API again,
+// after the collectors were reset by a config reload.
+func applySavedStates(source string) {
+	for regName, collectors := range savedStates {
+		reg, ok := registries[regName]
+		if !ok {
+			log.Printf("[warn] %s: unknown collector registry %s, ignored", source, regName)
+			continue
+		}
+		for name, enabled := range collectors {
+			if err := reg.set(name, enabled); err != nil {
+				log.Printf("[warn] %s: %s, ignored", source, err)
+			}
+		}
+	}
+}
+
+// adminHandler serves the admin API:
+//
+//	GET /api/collectors         list the collectors of every registry
+//	PUT /api/collectors/{name}  enable or disable a collector, the body is
+//	                            {"enabled": true, "registry": "kv"}, the
+//	                            registry may be omitted if name is unique
+//
+// Every request must carry the admin token as a bearer token.
+type adminHandler struct {
+	token     string
+	stateFile string
+}
+
+func NewAdminHandler(token, stateFile string, metrics *metricHandler, kvs *kvHandler, fileinfos *fileInfoHandler) *adminHandler {
+	registries[registryNode].handler = metrics
+	registries[registryKv].handler = kvs
+	registries[registryFileinfo].handler = fileinfos
+
+	return &adminHandler{
+		token:     token,
+		stateFile: stateFile,
+	}
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, h.token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		h.writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminCollectorsPath), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		h.writeJSON(w, http.StatusOK, listCollectorStates())
+	case name != "" && r.Method == http.MethodPut:
+		h.setCollector(w, r, name)
+	default:
+		h.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s %s not allowed", r.Method, r.URL.Path))
+	}
+}
+
+// authorized reports whether r carries token as a bearer token.
+func authorized(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+func (h *adminHandler) setCollector(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Registry string `json:"registry"`
+		Enabled  *bool  `json:"enabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+	if req.Enabled == nil {
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("missing field: enabled"))
+		return
+	}
+
+	regName, code, err := findRegistry(name, req.Registry)
+	if err != nil {
+		h.writeError(w, code, err)
+		return
+	}
+
+	// the saved state and the rebuilt handlers must agree with the last
+	// update
+	updateMtx.Lock()
+	defer updateMtx.Unlock()
+
+	reg := registries[regName]
+	prev := reg.list()[name]
+	if err := reg.set(name, *req.Enabled); err != nil {
+		h.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Printf("[info] %s collector %s set enabled=%v by admin API", regName, name, *req.Enabled)
+
+	if reg.handler != nil {
+		if err := reg.handler.Rebuild(); err != nil {
+			// the handler still serves the old collectors, keep the state
+			// in line with them
+			if err := reg.set(name, prev); err != nil {
+				log.Printf("[error] restore %s collector %s failed: %s", regName, name, err)
+			}
+			h.writeError(w, http.StatusInternalServerError, fmt.Errorf("rebuild %s handler failed: %s", regName, err))
+			return
+		}
+	}
+
+	if savedStates[regName] == nil {
+		savedStates[regName] = map[string]bool{}
+	}
+	savedStates[regName][name] = *req.Enabled
+
+	if err := h.saveStates(); err != nil {
+		log.Printf("[error] save collector state to %s failed: %s", h.stateFile, err)
+		h.writeError(w, http.StatusInternalServerError, fmt.Errorf("collector updated, but its state was not saved: %s", err))
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"registry": regName,
+		"name":     name,
+		"enabled":  *req.Enabled,
+	})
+}
+
+// findRegistry returns the registry of the collector name, along with the
+// HTTP status to answer with on error.
+func findRegistry(name, regName string) (string, int, error) {
+	if regName != "" {
+		if _, ok := registries[regName]; !ok {
+			return "", http.StatusBadRequest, fmt.Errorf("unknown registry: %s", regName)
+		}
+		return regName, 0, nil
+	}
+
+	var found []string
+	for n, reg := range registries {
+		if _, ok := reg.list()[name]; ok {
+			found = append(found, n)
+		}
+	}
+	sort.Strings(found)
+
+	switch len(found) {
+	case 0:
+		return "", http.StatusNotFound, fmt.Errorf("missing collector: %s", name)
+	case 1:
+		return found[0], 0, nil
+	default:
+		return "", http.StatusConflict, fmt.Errorf("collector %s exists in registries %s, set registry", name, strings.Join(found, ", "))
+	}
+}
+
+func listCollectorStates() collectorStates {
+	states := collectorStates{}
+	for name, reg := range registries {
+		states[name] = reg.list()
+	}
+	return states
+}
+
+// saveStates writes the changes made through the admin API to the state
+// file, so that they survive restarts.
+func (h *adminHandler) saveStates() error {
+	if h.stateFile == "" {
+		return nil
+	}
+
+	j, err := json.MarshalIndent(savedStates, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(h.stateFile), "."+filepath.Base(h.stateFile)+".tmp")
+	if err := ioutil.WriteFile(tmp, j, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.stateFile)
+}
+
+func (h *adminHandler) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("[error] marshal admin API response failed: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+func (h *adminHandler) writeError(w http.ResponseWriter, code int, err error) {
+	h.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is a collector registry of the admin API with fixed
+// collectors.
+type fakeRegistry struct {
+	mtx      sync.Mutex
+	states   map[string]bool
+	rebuilds int
+	// rebuildErr is returned by Rebuild when set
+	rebuildErr error
+}
+
+func (f *fakeRegistry) list() map[string]bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	res := map[string]bool{}
+	for name, enabled := range f.states {
+		res[name] = enabled
+	}
+	return res
+}
+
+func (f *fakeRegistry) set(name string, enabled bool) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if _, ok := f.states[name]; !ok {
+		return fmt.Errorf("missing collector: %s", name)
+	}
+	f.states[name] = enabled
+	return nil
+}
+
+func (f *fakeRegistry) Rebuild() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.rebuilds++
+	return f.rebuildErr
+}
+
+// withFakeRegistries replaces the registries of the admin API for a test.
+func withFakeRegistries(t *testing.T) (node, kvs *fakeRegistry) {
+	node = &fakeRegistry{states: map[string]bool{"cpu": true, "users": true}}
+	kvs = &fakeRegistry{states: map[string]bool{"users": true, "hosts": false}}
+
+	saved, savedStatesBefore := registries, savedStates
+	registries = map[string]*collectorRegistry{
+		registryNode: {list: node.list, set: node.set, handler: node},
+		registryKv:   {list: kvs.list, set: kvs.set, handler: kvs},
+	}
+	savedStates = collectorStates{}
+	t.Cleanup(func() {
+		registries, savedStates = saved, savedStatesBefore
+	})
+	return node, kvs
+}
+
+func adminRequest(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	withFakeRegistries(t)
+
+	for _, c := range []struct {
+		token, auth string
+		code        int
+	}{
+		{"secret", "secret", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "wrong", http.StatusUnauthorized},
+		{"secret", "secret2", http.StatusUnauthorized},
+		// without a token the API is closed
+		{"", "", http.StatusUnauthorized},
+	} {
+		h := &adminHandler{token: c.token}
+		w := adminRequest(h, "GET", AdminCollectorsPath, c.auth, "")
+		if w.Code != c.code {
+			t.Errorf("token %q, auth %q: want %d, got %d", c.token, c.auth, c.code, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q, auth %q: want a WWW-Authenticate header", c.token, c.auth)
+		}
+	}
+
+	// basic auth is not a bearer token
+	r := httptest.NewRequest("GET", AdminCollectorsPath, nil)
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	(&adminHandler{token: "secret"}).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("basic auth: want %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAdminSetCollector(t *testing.T) {
+	node, kvs := withFakeRegistries(t)
+	stateFile := filepath.Join(t.TempDir(), "collectors.json")
+	h := &adminHandler{token: "secret", stateFile: stateFile}
+
+	w := adminRequest(h, "PUT", AdminCollectorsPath+"/cpu", "secret", `{"enabled": false}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	w = adminRequest(h, "PUT", AdminCollectorsPath+"/hosts", "secret", `{"enabled": true, "registry": "kv"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if node.rebuilds != 1 || kvs.rebuilds != 1 {
+		t.Errorf("want a rebuild of each handler, got %d and %d", node.rebuilds, kvs.rebuilds)
+	}
+
+	w = adminRequest(h, "GET", AdminCollectorsPath, "secret", "")
+	var states collectorStates
+	if err := json.Unmarshal(w.Body.Bytes(), &states); err != nil {
+		t.Fatal(err)
+	}
+	want := collectorStates{
+		registryNode: {"cpu": false, "users": true},
+		registryKv:   {"users": true, "hosts": true},
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("want %v, got %v", want, states)
+	}
+
+	// only the changes are saved, and the temporary file is renamed
+	j, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved collectorStates
+	if err := json.Unmarshal(j, &saved); err != nil {
+		t.Fatal(err)
+	}
+	wantSaved := collectorStates{registryNode: {"cpu": false}, registryKv: {"hosts": true}}
+	if !reflect.DeepEqual(saved, wantSaved) {
+		t.Errorf("want %v saved, got %v", wantSaved, saved)
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(stateFile), ".*.tmp")); len(files) > 0 {
+		t.Errorf("want no temporary file left, got %v", files)
+	}
+
+	// the saved states are applied on the next start
+	node, kvs = withFakeRegistries(t)
+	if err := LoadCollectorStates(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if node.states["cpu"] || !kvs.states["hosts"] {
+		t.Errorf("want the saved states applied, got %v and %v", node.states, kvs.states)
+	}
+
+	if err := LoadCollectorStates(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("want a missing state file ignored, got %v", err)
+	}
+	ioutil.WriteFile(stateFile, []byte("{"), 0644)
+	if err := LoadCollectorStates(stateFile); err == nil {
+		t.Error("want an error for an invalid state file")
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	withFakeRegistries(t)
+	h := &adminHandler{token: "secret"}
+
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+		msg                string
+	}{
+		{"PUT", "/missing", `{"enabled": true}`, http.StatusNotFound, "missing collector: missing"},
+		{"PUT", "/missing", `{"enabled": true, "registry": "kv"}`, http.StatusNotFound, "missing collector: missing"},
+		{"PUT", "/cpu", `{"enabled": true, "registry": "textfile"}`, http.StatusBadRequest, "unknown registry"},
+		{"PUT", "/users", `{"enabled": true}`, http.StatusConflict, "registries kv, node"},
+		{"PUT", "/cpu", `{}`, http.StatusBadRequest, "missing field: enabled"},
+		{"PUT", "/cpu", `enabled`, http.StatusBadRequest, "invalid request body"},
+		{"DELETE", "/cpu", "", http.StatusMethodNotAllowed, "not allowed"},
+		{"PUT", "", `{"enabled": true}`, http.StatusMethodNotAllowed, "not allowed"},
+	} {
+		w := adminRequest(h, c.method, AdminCollectorsPath+c.path, "secret", c.body)
+		var res struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if w.Code != c.code || !strings.Contains(res.Error, c.msg) {
+			t.Errorf("%s %s %s: want %d %q, got %d %q", c.method, c.path, c.body, c.code, c.msg, w.Code, res.Error)
+		}
+	}
+
+	// a failed update saves nothing
+	if len(savedStates) != 0 {
+		t.Errorf("want no saved state, got %v", savedStates)
+	}
+}
+
+func TestAdminSaveError(t *testing.T) {
+	withFakeRegistries(t)
+	dir := filepath.Join(t.TempDir(), "missing")
+	h := &adminHandler{token: "secret", stateFile: filepath.Join(dir, "collectors.json")}
+
+	w := adminRequest(h, "PUT", AdminCollectorsPath+"/cpu", "secret", `{"enabled": false}`)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "not saved") {
+		t.Errorf("want a save error, got %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("want nothing written, got %v", err)
+	}
+}
+
+func TestAdminRebuildError(t *testing.T) {
+	node, _ := withFakeRegistries(t)
+	node.rebuildErr = fmt.Errorf("broken")
+	h := &adminHandler{token: "secret"}
+
+	w := adminRequest(h, "PUT", AdminCollectorsPath+"/cpu", "secret", `{"enabled": false, "registry": "node"}`)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "rebuild node handler failed") {
+		t.Errorf("want a rebuild error, got %d %s", w.Code, w.Body)
+	}
+
+	// the collector keeps the state the handler still serves
+	if !node.list()["cpu"] {
+		t.Errorf("want cpu enabled again after the failed rebuild")
+	}
+	if len(savedStates) != 0 {
+		t.Errorf("want no saved state, got %v", savedStates)
+	}
+}
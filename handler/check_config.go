@@ -0,0 +1,397 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/collector"
+	"github.com/prometheus/node_exporter/fileinfo"
+	"github.com/prometheus/node_exporter/kv"
+	"github.com/prometheus/node_exporter/rtpanic"
+)
+
+// ConfigProblem is a problem of the configuration found by CheckConfig.
+type ConfigProblem struct {
+	File    string
+	Line    int // 0 if unknown
+	Column  int
+	Path    string // such as kvs[3].type
+	Warning bool
+	Msg     string
+}
+
+func (p ConfigProblem) String() string {
+	var b strings.Builder
+	b.WriteString(p.File)
+	if p.Line > 0 {
+		fmt.Fprintf(&b, ":%d", p.Line)
+	}
+	if p.Column > 0 {
+		fmt.Fprintf(&b, ":%d", p.Column)
+	}
+	if p.Warning {
+		b.WriteString(": warning: ")
+	} else {
+		b.WriteString(": error: ")
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path + ": ")
+	}
+	b.WriteString(p.Msg)
+	return b.String()
+}
+
+// configSource is the content of a configure file, or of a section of the
+// unified configure file.
+type configSource struct {
+	file string
+	data []byte        // content of file
+	path []interface{} // json path of the section in file
+}
+
+// CheckConfig loads the config from files like LoadConfig and reports
+// every problem found, instead of stopping at the first one. Files and
+// directories of fileinfo larger than maxFileSize are reported. The command
+// line must be parsed, its collector flags are checked too.
+func CheckConfig(files ConfigFiles, maxFileSize int64) []ConfigProblem {
+	var problems []ConfigProblem
+
+	cfg := &Config{Version: configVersion}
+	kvSrc := &configSource{file: files.Kv}
+	fileinfoSrc := &configSource{file: files.Fileinfo}
+
+	if files.File != "" {
+		src := &configSource{file: files.File}
+		c, err := src.load(parseConfig)
+		if err != nil {
+			problems = append(problems, src.problem(nil, false, err))
+		} else {
+			cfg = c
+			problems = append(problems, checkWebConfig(src, &cfg.Web)...)
+			for _, err := range collector.CheckConfig(cfg.Collectors) {
+				problems = append(problems, src.problem([]interface{}{"collectors"}, false, err))
+			}
+
+			if cfg.Kv != nil {
+				kvSrc = &configSource{file: files.File, data: src.data, path: []interface{}{"kv"}}
+			}
+			if cfg.Fileinfo != nil {
+				fileinfoSrc = &configSource{file: files.File, data: src.data, path: []interface{}{"fileinfo"}}
+			}
+		}
+	}
+
+	if j, err := kvSrc.section(cfg.Kv); err != nil {
+		problems = append(problems, kvSrc.problem(nil, false, err))
+	} else {
+		for _, p := range kv.Check(j) {
+			problems = append(problems, kvSrc.problem(p.Path, p.Warning, fmt.Errorf("%s", p.Msg)))
+		}
+	}
+
+	if j, err := fileinfoSrc.section(cfg.Fileinfo); err != nil {
+		problems = append(problems, fileinfoSrc.problem(nil, false, err))
+	} else {
+		for _, p := range fileinfo.Check(j, maxFileSize) {
+			problems = append(problems, fileinfoSrc.problem(p.Path, p.Warning, fmt.Errorf("%s", p.Msg)))
+		}
+	}
+
+	for _, err := range collector.CheckFlags() {
+		problems = append(problems, ConfigProblem{File: "command line", Msg: err.Error()})
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		return problems[i].Line < problems[j].Line
+	})
+	return problems
+}
+
+func checkWebConfig(src *configSource, web *WebConfig) []ConfigProblem {
+	var problems []ConfigProblem
+
+	for _, ws := range web.listenSettings() {
+		if err := checkListenSetting(ws.name, ws.value); err != nil {
+			problems = append(problems, src.problem([]interface{}{"web", ws.name}, false, err))
+		}
+	}
+	if web.Labels != nil {
+		if _, err := web.Labels.labels(); err != nil {
+			problems = append(problems, src.problem([]interface{}{"web", "labels"}, false, err))
+		}
+	}
+	for i, r := range web.MetricRelabelConfigs {
+		if err := r.init(); err != nil {
+			problems = append(problems, src.problem([]interface{}{"web", "metric_relabel_configs", i}, false, err))
+		}
+	}
+	return problems
+}
+
+// load reads the file of src and parses it with parse.
+func (src *configSource) load(parse func([]byte) (*Config, error)) (*Config, error) {
+	data, err := ioutil.ReadFile(src.file)
+	if err != nil {
+		return nil, err
+	}
+	src.data = data
+	return parse(data)
+}
+
+// section returns the json of the section, reading the file of src if the
+// section is not in the unified configure file.
+func (src *configSource) section(j json.RawMessage) (json.RawMessage, error) {
+	if src.data != nil {
+		return j, nil
+	}
+
+	data, err := ioutil.ReadFile(src.file)
+	if err != nil {
+		return nil, err
+	}
+	src.data = data
+	return yaml.YAMLToJSON(data)
+}
+
+var yamlLineRE = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// problem creates the problem err at path of the section. Its position is
+// known if the file is in json, or if err tells it.
+func (src *configSource) problem(path []interface{}, warning bool, err error) ConfigProblem {
+	p := ConfigProblem{File: src.file, Warning: warning, Msg: err.Error()}
+
+	fullPath := append(append([]interface{}{}, src.path...), path...)
+	p.Path = formatPath(fullPath)
+
+	if m := yamlLineRE.FindStringSubmatch(p.Msg); m != nil {
+		p.Line, _ = strconv.Atoi(m[1])
+		p.Msg = strings.TrimPrefix(p.Msg, m[0])
+		return p
+	}
+
+	// the offsets of json errors are in the json converted from YAML, not
+	// in the file
+	if e, ok := err.(*json.UnmarshalTypeError); ok && e.Field != "" && len(path) == 0 {
+		for _, f := range strings.Split(e.Field, ".") {
+			fullPath = append(fullPath, f)
+		}
+		p.Path = formatPath(fullPath)
+	}
+
+	offset, ok := jsonOffset(src.data, fullPath)
+	if !ok || len(fullPath) == 0 {
+		return p
+	}
+
+	p.Line, p.Column = lineColumn(src.data, offset)
+	return p
+}
+
+func formatPath(path []interface{}) string {
+	var b strings.Builder
+	for _, e := range path {
+		switch e := e.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", e)
+		default:
+			if b.Len() > 0 {
+				b.WriteString(".")
+			}
+			fmt.Fprintf(&b, "%v", e)
+		}
+	}
+	return b.String()
+}
+
+// jsonOffset returns the offset of the value at path in the json data, it
+// fails if data is not json, such as a YAML configure file.
+func jsonOffset(data []byte, path []interface{}) (int64, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	return seekJSON(dec, path)
+}
+
+func seekJSON(dec *json.Decoder, path []interface{}) (int64, bool) {
+	if len(path) == 0 {
+		return dec.InputOffset(), true
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, false
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			offset := dec.InputOffset()
+			key, err := dec.Token()
+			if err != nil {
+				return 0, false
+			}
+			if key == path[0] {
+				if len(path) == 1 {
+					return offset, true
+				}
+				return seekJSON(dec, path[1:])
+			}
+			if !skipJSON(dec) {
+				return 0, false
+			}
+		}
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if i == path[0] {
+				return seekJSON(dec, path[1:])
+			}
+			if !skipJSON(dec) {
+				return 0, false
+			}
+		}
+	}
+	return 0, false
+}
+
+func skipJSON(dec *json.Decoder) bool {
+	var v json.RawMessage
+	return dec.Decode(&v) == nil
+}
+
+// lineColumn returns the position of the first token at or after offset.
+func lineColumn(data []byte, offset int64) (int, int) {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	line, col := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// DryRunResult is the result of a collector run by DryRun.
+type DryRunResult struct {
+	Registry string
+	Name     string
+	Duration time.Duration
+	Metrics  int
+	Err      error
+}
+
+// updater is implemented by the collectors of every registry.
+type updater interface {
+	Update(ch chan<- prometheus.Metric) error
+}
+
+// DryRun runs every enabled collector once, each one is abandoned after
+// timeout.
+func DryRun(timeout time.Duration) []DryRunResult {
+	var results []DryRunResult
+
+	if nc, err := collector.NewNodeCollector(); err != nil {
+		results = append(results, DryRunResult{Registry: registryNode, Err: err})
+	} else {
+		for name, c := range nc.Collectors {
+			results = append(results, dryRun(registryNode, name, c, timeout))
+		}
+	}
+
+	if kc, err := kv.NewKvCollector(kv.FormatBase64); err != nil {
+		results = append(results, DryRunResult{Registry: registryKv, Err: err})
+	} else {
+		for name, c := range kc.Collectors {
+			results = append(results, dryRun(registryKv, name, c, timeout))
+		}
+	}
+
+	if fc, err := fileinfo.NewFileInfoCollector(); err != nil {
+		results = append(results, DryRunResult{Registry: registryFileinfo, Err: err})
+	} else {
+		for name, c := range fc.Collectors {
+			results = append(results, dryRun(registryFileinfo, name, c, timeout))
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Registry != results[j].Registry {
+			return results[i].Registry < results[j].Registry
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+func dryRun(registry, name string, c updater, timeout time.Duration) DryRunResult {
+	res := DryRunResult{Registry: registry, Name: name}
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() {
+			close(ch)
+			done <- err
+		}()
+		defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+			err = fmt.Errorf("panic: %s", perr)
+		})
+		err = c.Update(ch)
+	}()
+
+	begin := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				res.Duration = time.Since(begin)
+				res.Err = <-done
+				return res
+			}
+			res.Metrics++
+		case <-timer.C:
+			res.Duration = time.Since(begin)
+			res.Err = fmt.Errorf("timed out after %v", timeout)
+			// the collector is left running, drain it
+			go func() {
+				for range ch {
+				}
+			}()
+			return res
+		}
+	}
+}
+
+// PrintDryRun writes a summary of results to w.
+func PrintDryRun(w io.Writer, results []DryRunResult) {
+	for _, r := range results {
+		status := "ok"
+		if r.Err != nil {
+			status = "FAILED: " + r.Err.Error()
+		}
+		fmt.Fprintf(w, "%-9s %-24s %10s %6d metrics  %s\n", r.Registry, r.Name, r.Duration.Round(time.Microsecond), r.Metrics, status)
+	}
+}
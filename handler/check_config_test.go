@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConfigProblemPosition(t *testing.T) {
+	src := &configSource{
+		file: "kv.json",
+		data: []byte(`{
+  "kvs": [
+    {"sub_system": "users"},
+    {"sub_system": "hosts", "type": "sql"}
+  ]
+}`),
+	}
+
+	p := src.problem([]interface{}{"kvs", 1, "type"}, false, errors.New(`unsupported type "sql"`))
+	if got, want := p.String(), `kv.json:4:29: error: kvs[1].type: unsupported type "sql"`; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	p = src.problem([]interface{}{"kvs", 5}, true, errors.New("missing"))
+	if got, want := p.String(), `kv.json: warning: kvs[5]: missing`; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/node_exporter/collector"
+)
+
+// collectorStatusHandler reports the failure and quarantine state of the
+// node collectors as JSON.
+type collectorStatusHandler struct{}
+
+func NewCollectorStatusHandler() *collectorStatusHandler {
+	return &collectorStatusHandler{}
+}
+
+func (h *collectorStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j, err := json.MarshalIndent(collector.CollectorHealthStatus(), "", "  ")
+	if err != nil {
+		log.Printf("[error] marshal collector status failed: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
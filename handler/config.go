@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/node_exporter/collector"
+	"github.com/prometheus/node_exporter/fileinfo"
+	"github.com/prometheus/node_exporter/kv"
+)
+
+const (
+	configVersion = 1
+
+	ReloadPath = "/-/reload"
+)
+
+// Config is the unified configure file, in YAML or JSON:
+//
+//	version: 1
+//	web:
+//	  listen_address: localhost:9100
+//	  telemetry_path: /metrics
+//	  kv_path: /kvs/json
+//	  fileinfo_path: /fileinfos
+//	  labels: {static: {env: prod}, auto_detect: [hostname]}
+//	  metric_relabel_configs: [...]
+//	collectors:
+//	  wifi: {enabled: false}
+//	  vmstat: {timeout: 2s, options: {fields: "^(oom_kill|pgpg).*"}}
+//	kv: {kvs: [...]}                # the content of kv.json
+//	fileinfo: {configures: {...}}   # the content of fileinfo.json
+//
+// Settings missing from the file keep their command line values, kv and
+// fileinfo fall back to the --env-cfg and --fileinfo-cfg files.
+type Config struct {
+	Version    int                                   `json:"version"`
+	Web        WebConfig                             `json:"web"`
+	Collectors map[string]*collector.CollectorConfig `json:"collectors"`
+	Kv         json.RawMessage                       `json:"kv"`
+	Fileinfo   json.RawMessage                       `json:"fileinfo"`
+}
+
+// WebConfig is the configure of the web server and of the metrics served
+// by the handlers. The listen address and the paths are only read at
+// startup, a reload changing them is logged and needs a restart.
+type WebConfig struct {
+	ListenAddress        string          `json:"listen_address"`
+	TelemetryPath        string          `json:"telemetry_path"`
+	KvPath               string          `json:"kv_path"`
+	FileinfoPath         string          `json:"fileinfo_path"`
+	Labels               *ConstLabelsCfg `json:"labels"`
+	MetricRelabelConfigs []*RelabelRule  `json:"metric_relabel_configs"`
+}
+
+type webSetting struct {
+	name, value string
+}
+
+// listenSettings returns the settings of w only read at startup.
+func (w *WebConfig) listenSettings() []webSetting {
+	return []webSetting{
+		{"listen_address", w.ListenAddress},
+		{"telemetry_path", w.TelemetryPath},
+		{"kv_path", w.KvPath},
+		{"fileinfo_path", w.FileinfoPath},
+	}
+}
+
+// checkListenSetting checks the value of the listen setting name, empty
+// values keep the command line one.
+func checkListenSetting(name, value string) error {
+	switch {
+	case value == "":
+		return nil
+	case name == "listen_address":
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return err
+		}
+	case !strings.HasPrefix(value, "/"):
+		return fmt.Errorf("path %q must start with /", value)
+	}
+	return nil
+}
+
+// ConfigFiles are the files the config is loaded from.
+type ConfigFiles struct {
+	File     string // the unified configure file, optional
+	Kv       string // kv.json, used if File has no kv section
+	Fileinfo string // fileinfo.json, used if File has no fileinfo section
+}
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "node_exporter",
+		Name:      "config_last_reload_success",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "node_exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+
+	// the command line values of the web settings, used when the config
+	// file does not set them
+	baseLabels []*dto.LabelPair
+	baseRules  []*RelabelRule
+	baseSaved  = false
+
+	// startWeb is the web section applied at startup, the listen settings
+	// of later configs are compared to it
+	startWeb *WebConfig
+
+	// updateMtx serializes config reloads and admin API updates
+	updateMtx = sync.Mutex{}
+)
+
+// LoadConfig reads and parses the config from files.
+func LoadConfig(files ConfigFiles) (*Config, error) {
+	cfg := &Config{Version: configVersion}
+
+	if files.File != "" {
+		data, err := ioutil.ReadFile(files.File)
+		if err != nil {
+			return nil, err
+		}
+		if cfg, err = parseConfig(data); err != nil {
+			return nil, fmt.Errorf("load %s failed: %s", files.File, err)
+		}
+	}
+
+	var err error
+	if cfg.Kv == nil {
+		if cfg.Kv, err = readConfigSection(files.Kv); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Fileinfo == nil {
+		if cfg.Fileinfo, err = readConfigSection(files.Fileinfo); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Version != configVersion {
+		return nil, fmt.Errorf("unsupported version %d, expect %d", cfg.Version, configVersion)
+	}
+	return &cfg, nil
+}
+
+// readConfigSection reads the kv.json or fileinfo.json file, which may be
+// in YAML as well.
+func readConfigSection(file string) (json.RawMessage, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("load %s failed: %s", file, err)
+	}
+	return j, nil
+}
+
+// ApplyConfig applies cfg at startup, after the command line is parsed and
+// before the handlers are created.
+func ApplyConfig(cfg *Config) error {
+	updateMtx.Lock()
+	defer updateMtx.Unlock()
+
+	if _, err := applyConfig(cfg); err != nil {
+		return err
+	}
+	startWeb = &cfg.Web
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	return nil
+}
+
+// applyConfig checks and applies cfg. It returns a function restoring the
+// previous config, the handlers are not rebuilt.
+func applyConfig(cfg *Config) (func(), error) {
+	outputMtx.Lock()
+	if !baseSaved {
+		baseLabels, baseRules, baseSaved = constLabels, relabelRules, true
+	}
+	outputMtx.Unlock()
+
+	for _, ws := range cfg.Web.listenSettings() {
+		if err := checkListenSetting(ws.name, ws.value); err != nil {
+			return nil, fmt.Errorf("web.%s: %s", ws.name, err)
+		}
+	}
+
+	labels, rules := baseLabels, baseRules
+	if cfg.Web.Labels != nil {
+		var err error
+		if labels, err = cfg.Web.Labels.labels(); err != nil {
+			return nil, fmt.Errorf("web.labels: %s", err)
+		}
+	}
+	if cfg.Web.MetricRelabelConfigs != nil {
+		for i, r := range cfg.Web.MetricRelabelConfigs {
+			if err := r.init(); err != nil {
+				return nil, fmt.Errorf("web.metric_relabel_configs: rule %d: %s", i, err)
+			}
+		}
+		rules = cfg.Web.MetricRelabelConfigs
+	}
+
+	var rollbacks []func()
+	rollback := func() {
+		for i := len(rollbacks) - 1; i >= 0; i-- {
+			rollbacks[i]()
+		}
+	}
+
+	for _, section := range []struct {
+		name  string
+		apply func() (func(), error)
+	}{
+		{"collectors", func() (func(), error) { return collector.ApplyConfig(cfg.Collectors) }},
+		{"kv", func() (func(), error) { return kv.ApplyConfig(cfg.Kv) }},
+		{"fileinfo", func() (func(), error) { return fileinfo.ApplyConfig(cfg.Fileinfo) }},
+	} {
+		r, err := section.apply()
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("%s: %s", section.name, err)
+		}
+		rollbacks = append(rollbacks, r)
+	}
+
+	outputMtx.Lock()
+	oldLabels, oldRules := constLabels, relabelRules
+	constLabels, relabelRules = labels, rules
+	outputMtx.Unlock()
+
+	rollbacks = append(rollbacks, func() {
+		outputMtx.Lock()
+		constLabels, relabelRules = oldLabels, oldRules
+		outputMtx.Unlock()
+	})
+
+	// the changes made through the admin API win over the config
+	applySavedStates("admin state")
+	return rollback, nil
+}
+
+// Reloader reloads the config on SIGHUP or on a POST to ReloadPath. A new
+// config is only swapped in if it is valid and every handler can be rebuilt
+// with it, the previous config is kept otherwise.
+type Reloader struct {
+	files    ConfigFiles
+	token    string
+	handlers []interface{ Rebuild() error }
+}
+
+// NewReloader creates a Reloader of the config from files. Reload requests
+// must carry token as a bearer token, like admin API requests, they are all
+// refused without a token.
+func NewReloader(files ConfigFiles, token string, metrics *metricHandler, kvs *kvHandler, fileinfos *fileInfoHandler) *Reloader {
+	return &Reloader{
+		files:    files,
+		token:    token,
+		handlers: []interface{ Rebuild() error }{metrics, kvs, fileinfos},
+	}
+}
+
+// Reload loads, checks and applies the config.
+func (r *Reloader) Reload() (err error) {
+	updateMtx.Lock()
+	defer updateMtx.Unlock()
+
+	defer func() {
+		if err != nil {
+			configReloadSuccess.Set(0)
+			return
+		}
+		configReloadSuccess.Set(1)
+		configReloadSeconds.SetToCurrentTime()
+	}()
+
+	cfg, err := LoadConfig(r.files)
+	if err != nil {
+		return err
+	}
+
+	rollback, err := applyConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range r.handlers {
+		if err = h.Rebuild(); err != nil {
+			rollback()
+			r.rebuild()
+			return fmt.Errorf("rebuild handler failed: %s", err)
+		}
+	}
+
+	if startWeb != nil {
+		started := startWeb.listenSettings()
+		for i, ws := range cfg.Web.listenSettings() {
+			if ws.value != started[i].value {
+				log.Printf("[warn] web.%s changed to %q, restart to apply it", ws.name, ws.value)
+			}
+		}
+	}
+	return nil
+}
+
+// rebuild recreates the handlers after a failed reload is rolled back.
+func (r *Reloader) rebuild() {
+	for _, h := range r.handlers {
+		if err := h.Rebuild(); err != nil {
+			log.Printf("[error] rebuild handler with the previous config failed: %s", err)
+		}
+	}
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("%s %s not allowed", req.Method, req.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(req, r.token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	begin := time.Now()
+	if err := r.Reload(); err != nil {
+		log.Printf("[error] reload config failed: %s", err)
+		http.Error(w, fmt.Sprintf("reload config failed: %s", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[info] config reloaded in %v", time.Since(begin))
+}
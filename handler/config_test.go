@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+version: 1
+web:
+  listen_address: 0.0.0.0:9100
+  telemetry_path: /node/metrics
+  labels: {static: {env: prod}}
+collectors:
+  wifi: {enabled: false}
+  vmstat: {timeout: 2s, options: {fields: "^oom_kill"}}
+kv: {kvs: []}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Web.ListenAddress != "0.0.0.0:9100" || cfg.Web.TelemetryPath != "/node/metrics" || cfg.Web.KvPath != "" {
+		t.Errorf("unexpected web settings: %+v", cfg.Web)
+	}
+	if cfg.Web.Labels.Static["env"] != "prod" {
+		t.Errorf("unexpected labels: %+v", cfg.Web.Labels)
+	}
+	if wifi := cfg.Collectors["wifi"]; wifi == nil || wifi.Enabled == nil || *wifi.Enabled {
+		t.Errorf("wifi should be disabled: %+v", wifi)
+	}
+	if cfg.Collectors["vmstat"].Options["fields"] != "^oom_kill" {
+		t.Errorf("unexpected vmstat options: %+v", cfg.Collectors["vmstat"])
+	}
+	if string(cfg.Kv) != `{"kvs":[]}` {
+		t.Errorf("unexpected kv section: %s", cfg.Kv)
+	}
+	if cfg.Fileinfo != nil {
+		t.Errorf("fileinfo section should be missing, got %s", cfg.Fileinfo)
+	}
+
+	for data, want := range map[string]string{
+		`{"version": 2}`:            "unsupported version",
+		"version: 1\nfoo: bar\n":    "unknown field",
+		"version: 1\nweb: [1, 2]\n": "cannot unmarshal",
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: want error containing %q, got %v", data, want, err)
+		}
+	}
+}
+
+func TestCheckListenSetting(t *testing.T) {
+	for _, c := range []struct {
+		name, value, want string
+	}{
+		{"listen_address", "", ""},
+		{"listen_address", ":9100", ""},
+		{"listen_address", "localhost", "missing port"},
+		{"telemetry_path", "/metrics", ""},
+		{"kv_path", "kvs", "must start with /"},
+	} {
+		err := checkListenSetting(c.name, c.value)
+		if (c.want == "" && err != nil) || (c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want))) {
+			t.Errorf("%s %q: want error %q, got %v", c.name, c.value, c.want, err)
+		}
+	}
+}
+
+func TestReloaderAuthorization(t *testing.T) {
+	for _, c := range []struct {
+		token, auth string
+		code        int
+	}{
+		// the config files are missing, so authorized reloads fail
+		{"secret", "secret", http.StatusInternalServerError},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "wrong", http.StatusUnauthorized},
+		// without a token reloads are refused
+		{"", "", http.StatusUnauthorized},
+	} {
+		r := &Reloader{token: c.token}
+		w := adminRequest(r, "POST", ReloadPath, c.auth, "")
+		if w.Code != c.code {
+			t.Errorf("token %q, auth %q: want %d, got %d", c.token, c.auth, c.code, w.Code)
+		}
+	}
+
+	w := adminRequest(&Reloader{token: "secret"}, "GET", ReloadPath, "secret", "")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
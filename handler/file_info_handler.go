@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -11,11 +13,21 @@ import (
 )
 
 type fileInfoHandler struct {
+	mtx               sync.RWMutex // guards unfilteredHandler
 	unfilteredHandler http.Handler
+	// snapshot serves unfiltered scrapes from a background collection if
+	// its interval is set.
+	snapshot snapshotHolder
 }
 
-func NewFileInfoHandler() *fileInfoHandler {
-	h := &fileInfoHandler{}
+func NewFileInfoHandler(collectInterval time.Duration) *fileInfoHandler {
+	h := &fileInfoHandler{
+		snapshot: snapshotHolder{
+			name:      "fileinfo collectors",
+			namespace: "file",
+			interval:  collectInterval,
+		},
+	}
 
 	if ih, err := h.innerHandler(); err != nil {
 		log.Printf("[error] couldn't create fileinfo handler: %s", err)
@@ -32,7 +44,11 @@ func (h *fileInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//log.Printf("[debug] env collect query:", filters)
 
 	if len(filters) == 0 {
-		h.unfilteredHandler.ServeHTTP(w, r)
+		h.mtx.RLock()
+		uh := h.unfilteredHandler
+		h.mtx.RUnlock()
+
+		uh.ServeHTTP(w, r)
 		return
 	}
 
@@ -46,6 +62,20 @@ func (h *fileInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fh.ServeHTTP(w, r)
 }
 
+// Rebuild recreates the unfiltered handler so that it picks up collectors
+// enabled or disabled since it was created.
+func (h *fileInfoHandler) Rebuild() error {
+	ih, err := h.innerHandler()
+	if err != nil {
+		return err
+	}
+
+	h.mtx.Lock()
+	h.unfilteredHandler = ih
+	h.mtx.Unlock()
+	return nil
+}
+
 func (h *fileInfoHandler) innerHandler(f ...string) (http.Handler, error) {
 	c, err := fileinfo.NewFileInfoCollector(f...)
 	if err != nil {
@@ -71,8 +101,13 @@ func (h *fileInfoHandler) innerHandler(f ...string) (http.Handler, error) {
 		return nil, fmt.Errorf("couldn't register file_info collector: %s", err)
 	}
 
+	var g prometheus.Gatherer = r
+	if len(f) == 0 {
+		g = h.snapshot.wrap(r)
+	}
+
 	handler := promhttp.HandlerFor(
-		prometheus.Gatherers{r},
+		wrapGatherer(registryFileinfo, g),
 		promhttp.HandlerOpts{
 			ErrorHandling: promhttp.ContinueOnError,
 		},
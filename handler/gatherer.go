@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// processedGatherer applies the constant labels and the relabel rules of a
+// registry to the metrics of a Gatherer.
+type processedGatherer struct {
+	prometheus.Gatherer
+	registry string
+	labels   []*dto.LabelPair
+	rules    []*RelabelRule
+}
+
+// wrapGatherer wraps g, the gatherer of all metrics of registry, with the
+// constant labels and relabel rules, g is returned as is if there are none.
+func wrapGatherer(registry string, g prometheus.Gatherer) prometheus.Gatherer {
+	outputMtx.RLock()
+	defer outputMtx.RUnlock()
+
+	rules := relabelRulesOf(registry)
+	if len(constLabels) == 0 && len(rules) == 0 {
+		return g
+	}
+	return &processedGatherer{Gatherer: g, registry: registry, labels: constLabels, rules: rules}
+}
+
+// Gather implements prometheus.Gatherer. The gathered metric families may be
+// shared with a snapshot, so they are copied instead of modified.
+func (g *processedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+
+	res := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		nmf := &dto.MetricFamily{
+			Name:   mf.Name,
+			Help:   mf.Help,
+			Type:   mf.Type,
+			Metric: make([]*dto.Metric, 0, len(mf.Metric)),
+		}
+
+		seen := make(map[string]bool, len(mf.Metric))
+		for _, m := range mf.Metric {
+			labels, keep := relabel(g.rules, mf.GetName(), addConstLabels(g.labels, m.Label))
+			if !keep {
+				continue
+			}
+
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+			// dropping or rewriting labels may make series identical,
+			// only the first one is kept
+			sig := signature(labels)
+			if seen[sig] {
+				log.Printf("[warn] %s: duplicated series %s{%s} after relabeling, dropped", g.registry, mf.GetName(), sig)
+				continue
+			}
+			seen[sig] = true
+
+			nmf.Metric = append(nmf.Metric, &dto.Metric{
+				Label:       labels,
+				Gauge:       m.Gauge,
+				Counter:     m.Counter,
+				Summary:     m.Summary,
+				Untyped:     m.Untyped,
+				Histogram:   m.Histogram,
+				TimestampMs: m.TimestampMs,
+			})
+		}
+
+		if len(nmf.Metric) > 0 {
+			res = append(res, nmf)
+		}
+	}
+
+	return res, err
+}
+
+func signature(labels []*dto.LabelPair) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.GetName()+"="+strconv.Quote(l.GetValue()))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/node_exporter/kv"
+)
+
+// KvChangesPath serves the row changes of the kv collectors with change
+// detection.
+const KvChangesPath = "/kvs/changes"
+
+// kvChangesHandler lists the kv changes, optionally of a single collector
+// (?collector=users) and after a time (?since=, RFC 3339 or unix seconds).
+type kvChangesHandler struct{}
+
+func NewKvChangesHandler() *kvChangesHandler {
+	return &kvChangesHandler{}
+}
+
+func (h *kvChangesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes := kv.Changes(r.URL.Query().Get("collector"), since)
+	j, err := json.MarshalIndent(map[string]interface{}{"changes": changes}, "", "  ")
+	if err != nil {
+		log.Printf("[error] marshal kv changes failed: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q, want RFC 3339 or unix seconds", s)
+	}
+	return time.Unix(0, int64(sec*1e9)), nil
+}
@@ -1,33 +1,56 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/node_exporter/kv"
 )
 
+// snapshotFormats are the formats of the background collection of the kv
+// collectors.
+var snapshotFormats = []kv.Format{kv.FormatLabels, kv.FormatBase64}
+
 type kvHandler struct {
-	unfilteredHandler http.Handler
+	mtx sync.RWMutex // guards unfilteredHandlers and views
+	// unfilteredHandlers are the unfiltered handlers of the formats
+	// requested so far
+	unfilteredHandlers map[kv.Format]http.Handler
 	// exporterMetricsRegistry is a separate registry for the metrics about
 	// the exporter itself.
 	exporterMetricsRegistry *prometheus.Registry
+	// snapshot serves unfiltered scrapes from a background collection if
+	// its interval is set. The collection runs the collectors once and
+	// exports their results in each format, views returns the gatherer of
+	// a format.
+	snapshot *snapshotHolder
+	views    func(name string) prometheus.Gatherer
 }
 
-func NewKvHandler() *kvHandler {
+func NewKvHandler(collectInterval time.Duration) *kvHandler {
 	h := &kvHandler{
+		unfilteredHandlers:      map[kv.Format]http.Handler{},
 		exporterMetricsRegistry: prometheus.NewRegistry(),
+		snapshot: &snapshotHolder{
+			name:      "kv collectors",
+			namespace: "kv_node",
+			interval:  collectInterval,
+		},
 	}
 
-	if ih, err := h.innerHandler(); err != nil {
+	// the format of the default --web.telemetry-env-info-path, the others
+	// are created on their first scrape
+	if _, err := h.unfilteredHandler(kv.FormatBase64); err != nil {
 		log.Printf("[error] couldn't create metric handler: %s", err)
-	} else {
-		h.unfilteredHandler = ih
 	}
 
 	return h
@@ -35,20 +58,34 @@ func NewKvHandler() *kvHandler {
 
 func (h *kvHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	filters := r.URL.Query()["collect[]"]
-	if strings.Contains(r.URL.Path, "json") {
-		kv.JsonFormat = true
-	} else {
-		kv.JsonFormat = false
+
+	format, err := requestFormat(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
 	// log.Printf("[debug] kv collect query:", filters)
 
+	if format == kv.FormatJSON {
+		h.serveJSON(w, filters)
+		return
+	}
+
 	if len(filters) == 0 {
-		h.unfilteredHandler.ServeHTTP(w, r)
+		uh, err := h.unfilteredHandler(format)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("couldn't create metrics handler: %s", err)))
+			return
+		}
+
+		uh.ServeHTTP(w, r)
 		return
 	}
 
-	fh, err := h.innerHandler(filters...)
+	fh, err := h.innerHandler(format, filters...)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("couldn't create filtered metrics handler: %s", err)))
@@ -58,8 +95,171 @@ func (h *kvHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fh.ServeHTTP(w, r)
 }
 
-func (h *kvHandler) innerHandler(f ...string) (http.Handler, error) {
-	c, err := kv.NewKvCollector(f...)
+// requestFormat returns the format asked by ?format=, or the Accept header
+// for json. Paths containing "json", such as /kvs/json, default to the
+// base64 format, others to the labels format.
+func requestFormat(r *http.Request) (kv.Format, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return kv.ParseFormat(f)
+	}
+
+	// the media type preferred by the client comes first
+	accept := strings.Split(r.Header.Get("Accept"), ",")[0]
+	if strings.TrimSpace(strings.Split(accept, ";")[0]) == "application/json" {
+		return kv.FormatJSON, nil
+	}
+
+	if strings.Contains(r.URL.Path, "json") {
+		return kv.FormatBase64, nil
+	}
+	return kv.FormatLabels, nil
+}
+
+// serveJSON writes the rows of the collectors as a json document.
+func (h *kvHandler) serveJSON(w http.ResponseWriter, filters []string) {
+	c, err := kv.NewKvCollector(kv.FormatJSON, filters...)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("couldn't create collector: %s", err)))
+		return
+	}
+
+	doc := struct {
+		Collectors map[string]*kv.DocumentEntry `json:"collectors"`
+	}{labelDocument(c.Document())}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Printf("[error] write kv json document failed: %s", err)
+	}
+}
+
+// labelDocument processes the entries of a json document like the series of
+// the base64 format: the constant labels are added and the relabel rules of
+// the kv registry applied to the labels of each collector, an entry whose
+// series would be dropped is removed.
+func labelDocument(entries map[string]*kv.DocumentEntry) map[string]*kv.DocumentEntry {
+	outputMtx.RLock()
+	labels, rules := constLabels, relabelRulesOf(registryKv)
+	outputMtx.RUnlock()
+
+	for name, e := range entries {
+		lps, keep := relabel(rules, kv.MetricName(name), labels)
+		if !keep {
+			delete(entries, name)
+			continue
+		}
+		if len(lps) == 0 {
+			continue
+		}
+
+		e.Labels = make(map[string]string, len(lps))
+		for _, l := range lps {
+			e.Labels[l.GetName()] = l.GetValue()
+		}
+	}
+	return entries
+}
+
+// unfilteredHandler returns the unfiltered handler of format, it is
+// created on the first call.
+func (h *kvHandler) unfilteredHandler(format kv.Format) (http.Handler, error) {
+	h.mtx.RLock()
+	uh, ok := h.unfilteredHandlers[format]
+	h.mtx.RUnlock()
+	if ok {
+		return uh, nil
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if uh, ok := h.unfilteredHandlers[format]; ok {
+		return uh, nil
+	}
+	if h.views == nil && h.snapshot.interval > 0 {
+		if err := h.resetSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+	uh, err := h.innerHandler(format)
+	if err != nil {
+		return nil, err
+	}
+	h.unfilteredHandlers[format] = uh
+	return uh, nil
+}
+
+// Rebuild recreates the unfiltered handlers so that they pick up collectors
+// enabled or disabled since they were created.
+func (h *kvHandler) Rebuild() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.views != nil {
+		if err := h.resetSnapshot(); err != nil {
+			return err
+		}
+	}
+
+	handlers := make(map[kv.Format]http.Handler, len(h.unfilteredHandlers))
+	for format := range h.unfilteredHandlers {
+		ih, err := h.innerHandler(format)
+		if err != nil {
+			return err
+		}
+		handlers[format] = ih
+	}
+
+	h.unfilteredHandlers = handlers
+	return nil
+}
+
+// resetSnapshot starts the background collection of the collectors enabled
+// now, h.mtx must be held.
+func (h *kvHandler) resetSnapshot() error {
+	c, err := kv.NewKvCollector(kv.FormatBase64)
+	if err != nil {
+		return fmt.Errorf("couldn't create collector: %s", err)
+	}
+	h.views = h.snapshot.wrapViews(kvFormats{c})
+	return nil
+}
+
+// kvFormats exports one run of the kv collectors in each of the
+// snapshotFormats, which are its views.
+type kvFormats struct {
+	collector *kv.KvCollector
+}
+
+func (g kvFormats) GatherViews() (map[string][]*dto.MetricFamily, error) {
+	fetched := g.collector.Fetch()
+
+	views := make(map[string][]*dto.MetricFamily, len(snapshotFormats))
+	var errs prometheus.MultiError
+	for _, format := range snapshotFormats {
+		r := prometheus.NewRegistry()
+		if err := r.Register(fetched.Collector(format)); err != nil {
+			return nil, fmt.Errorf("couldn't register kv collector: %s", err)
+		}
+
+		mfs, err := r.Gather()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		views[string(format)] = mfs
+	}
+
+	if len(errs) > 0 {
+		return views, errs
+	}
+	return views, nil
+}
+
+func (h *kvHandler) innerHandler(format kv.Format, f ...string) (http.Handler, error) {
+	c, err := kv.NewKvCollector(format, f...)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create collector: %s", err)
 	}
@@ -78,13 +278,19 @@ func (h *kvHandler) innerHandler(f ...string) (http.Handler, error) {
 		}
 	}
 
-	r := prometheus.NewRegistry()
-	if err := r.Register(c); err != nil {
-		return nil, fmt.Errorf("couldn't register kv collector: %s", err)
+	var g prometheus.Gatherer
+	if len(f) == 0 && h.views != nil {
+		g = h.views(string(format))
+	} else {
+		r := prometheus.NewRegistry()
+		if err := r.Register(c); err != nil {
+			return nil, fmt.Errorf("couldn't register kv collector: %s", err)
+		}
+		g = r
 	}
 
 	handler := promhttp.HandlerFor(
-		prometheus.Gatherers{h.exporterMetricsRegistry, r},
+		wrapGatherer(registryKv, prometheus.Gatherers{h.exporterMetricsRegistry, g}),
 		promhttp.HandlerOpts{
 			ErrorHandling: promhttp.ContinueOnError,
 		},
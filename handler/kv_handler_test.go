@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/node_exporter/kv"
+)
+
+func TestRequestFormat(t *testing.T) {
+	tests := []struct {
+		url    string
+		accept string
+		want   kv.Format
+		err    bool
+	}{
+		{url: "/kvs", want: kv.FormatLabels},
+		{url: "/kvs/json", want: kv.FormatBase64},
+		{url: "/kvs/json?format=labels", want: kv.FormatLabels},
+		{url: "/kvs?format=json", want: kv.FormatJSON},
+		{url: "/kvs", accept: "application/json", want: kv.FormatJSON},
+		{url: "/kvs/json", accept: "application/json;q=0.9, text/plain", want: kv.FormatJSON},
+		{url: "/kvs/json", accept: "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", want: kv.FormatBase64},
+		{url: "/kvs?format=xml", err: true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		got, err := requestFormat(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: want an error, got %s", test.url, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s (Accept: %s): want %s, got %s, %v", test.url, test.accept, test.want, got, err)
+		}
+	}
+}
+
+func TestLabelDocument(t *testing.T) {
+	rules := []*RelabelRule{
+		{SourceLabels: []string{"__name__"}, Regex: proto("kv_node_secret"), Action: relabelDrop},
+		{SourceLabels: []string{"host"}, Regex: proto("(.*)"), TargetLabel: "instance", Replacement: proto("$1:9100")},
+		{SourceLabels: []string{"host"}, Regex: proto("(.*)"), Action: relabelDrop, Registries: []string{registryNode}},
+	}
+	for _, r := range rules {
+		if err := r.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outputMtx.Lock()
+	oldLabels, oldRules := constLabels, relabelRules
+	constLabels = []*dto.LabelPair{{Name: proto("host"), Value: proto("db1")}}
+	relabelRules = rules
+	outputMtx.Unlock()
+	defer func() {
+		outputMtx.Lock()
+		constLabels, relabelRules = oldLabels, oldRules
+		outputMtx.Unlock()
+	}()
+
+	got := labelDocument(map[string]*kv.DocumentEntry{
+		"motd":   {},
+		"secret": {},
+	})
+
+	if _, ok := got["secret"]; ok {
+		t.Errorf("want the dropped entry removed, got %v", got)
+	}
+	want := map[string]string{"host": "db1", "instance": "db1:9100"}
+	if e, ok := got["motd"]; !ok || !reflect.DeepEqual(e.Labels, want) {
+		t.Errorf("want the labels %v, got %v", want, got)
+	}
+}
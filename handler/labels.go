@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/node_exporter/kv"
+)
+
+const (
+	autoLabelHostname  = "hostname"
+	autoLabelMachineID = "machine_id"
+	autoLabelPrimaryIP = "primary_ip"
+
+	// routeFile is the IPv4 routing table of Linux
+	routeFile = "/proc/net/route"
+)
+
+// ConstLabelsCfg is the configure of the labels added to every metric of
+// the /metrics, /kvs and /fileinfos handlers, such as:
+//
+//	{
+//	  "static": {"uploader_uid": "uid-xxx", "env": "prod", "region": "cn-hangzhou"},
+//	  "auto_detect": ["hostname", "machine_id", "primary_ip"]
+//	}
+//
+// Auto detected labels are named after their detector and are overridden by
+// a static label of the same name.
+type ConstLabelsCfg struct {
+	Static     map[string]string `json:"static"`
+	AutoDetect []string          `json:"auto_detect"`
+}
+
+var (
+	// outputMtx guards constLabels and relabelRules, which are replaced
+	// when the config is reloaded
+	outputMtx   = sync.RWMutex{}
+	constLabels []*dto.LabelPair
+
+	autoLabelDetectors = map[string]func() (string, error){
+		autoLabelHostname:  os.Hostname,
+		autoLabelMachineID: detectMachineID,
+		autoLabelPrimaryIP: detectPrimaryIP,
+	}
+)
+
+// LoadConstLabels loads the constant labels from cfgFile. It must be called
+// before the handlers are created.
+func LoadConstLabels(cfgFile string) error {
+	j, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	var cfg ConstLabelsCfg
+	if err := json.Unmarshal(j, &cfg); err != nil {
+		return fmt.Errorf("load %s failed: %s", cfgFile, err)
+	}
+
+	labels, err := cfg.labels()
+	if err != nil {
+		return fmt.Errorf("load %s failed: %s", cfgFile, err)
+	}
+
+	constLabels = labels
+	return nil
+}
+
+func (cfg *ConstLabelsCfg) labels() ([]*dto.LabelPair, error) {
+	values := map[string]string{}
+
+	for _, name := range cfg.AutoDetect {
+		detect, ok := autoLabelDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown auto detected label: %s", name)
+		}
+
+		v, err := detect()
+		if err != nil {
+			log.Printf("[warn] detect label %s failed: %s, ignored", name, err)
+			continue
+		}
+		values[name] = v
+	}
+
+	for name, v := range cfg.Static {
+		values[name] = v
+	}
+
+	var labels []*dto.LabelPair
+	for name, v := range values {
+		// reserved names are renamed the same way as kv tags
+		if tuned := kv.TuneTag(name); tuned != name {
+			log.Printf("[warn] label %s is reserved, renamed to %s", name, tuned)
+			name = tuned
+		}
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name: %s", name)
+		}
+
+		labels = append(labels, &dto.LabelPair{Name: proto(name), Value: proto(v)})
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels, nil
+}
+
+func detectMachineID() (string, error) {
+	var err error
+	for _, f := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		var id []byte
+		if id, err = ioutil.ReadFile(f); err == nil {
+			return strings.TrimSpace(string(id)), nil
+		}
+	}
+	return "", err
+}
+
+// detectPrimaryIP returns the address of the interfaces up, see primaryIP.
+// Nothing is sent, so that it also works on hosts without a way out.
+func detectPrimaryIP() (string, error) {
+	netIfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	ifaces := make([]netInterface, 0, len(netIfaces))
+	for _, i := range netIfaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		ifaces = append(ifaces, netInterface{name: i.Name, flags: i.Flags, addrs: addrs})
+	}
+
+	route, _ := ioutil.ReadFile(routeFile)
+	return primaryIP(ifaces, defaultRouteInterface(route))
+}
+
+type netInterface struct {
+	name  string
+	flags net.Flags
+	addrs []net.Addr
+}
+
+// primaryIP returns the first global unicast address of ifaces, IPv4
+// first, from the interface named def first.
+func primaryIP(ifaces []netInterface, def string) (string, error) {
+	sort.SliceStable(ifaces, func(i, j int) bool {
+		return ifaces[i].name == def && ifaces[j].name != def
+	})
+
+	for _, v4 := range []bool{true, false} {
+		for _, i := range ifaces {
+			if i.flags&net.FlagUp == 0 || i.flags&net.FlagLoopback != 0 {
+				continue
+			}
+			for _, addr := range i.addrs {
+				ipnet, ok := addr.(*net.IPNet)
+				if !ok || !ipnet.IP.IsGlobalUnicast() || (ipnet.IP.To4() != nil) != v4 {
+					continue
+				}
+				return ipnet.IP.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no global unicast address found")
+}
+
+// defaultRouteInterface returns the interface of the default route in the
+// content of /proc/net/route, "" if there is none.
+func defaultRouteInterface(route []byte) string {
+	for _, line := range strings.Split(string(route), "\n") {
+		// Iface Destination Gateway Flags ... Mask ...
+		fields := strings.Fields(line)
+		if len(fields) > 7 && fields[1] == "00000000" && fields[7] == "00000000" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// addConstLabels returns labels with constLabels added. A label of the same
+// name as a constant label is renamed by appending "_" to it, the same way
+// reserved kv tags are.
+func addConstLabels(constLabels, labels []*dto.LabelPair) []*dto.LabelPair {
+	if len(constLabels) == 0 {
+		return labels
+	}
+
+	taken := make(map[string]bool, len(labels)+len(constLabels))
+	for _, l := range constLabels {
+		taken[l.GetName()] = true
+	}
+
+	res := make([]*dto.LabelPair, 0, len(labels)+len(constLabels))
+	res = append(res, constLabels...)
+	for _, l := range labels {
+		name := l.GetName()
+		if taken[name] {
+			for taken[name] {
+				name += "_"
+			}
+			l = &dto.LabelPair{Name: proto(name), Value: l.Value}
+		}
+		taken[name] = true
+		res = append(res, l)
+	}
+
+	return res
+}
+
+func proto(s string) *string {
+	return &s
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func labelPairs(kv ...string) []*dto.LabelPair {
+	var res []*dto.LabelPair
+	for i := 0; i < len(kv); i += 2 {
+		res = append(res, &dto.LabelPair{Name: proto(kv[i]), Value: proto(kv[i+1])})
+	}
+	return res
+}
+
+func TestAddConstLabels(t *testing.T) {
+	consts := labelPairs("env", "prod", "host", "web-1")
+
+	for _, c := range []struct {
+		labels, want []*dto.LabelPair
+	}{
+		{nil, consts},
+		{
+			labelPairs("device", "eth0"),
+			labelPairs("env", "prod", "host", "web-1", "device", "eth0"),
+		},
+		// a metric label named after a constant label is renamed
+		{
+			labelPairs("host", "db-1", "device", "eth0"),
+			labelPairs("env", "prod", "host", "web-1", "host_", "db-1", "device", "eth0"),
+		},
+		// until its name is free
+		{
+			labelPairs("host_", "a", "host", "b"),
+			labelPairs("env", "prod", "host", "web-1", "host_", "a", "host__", "b"),
+		},
+		{
+			labelPairs("host", "b", "host_", "a"),
+			labelPairs("env", "prod", "host", "web-1", "host_", "b", "host__", "a"),
+		},
+	} {
+		if got := addConstLabels(consts, c.labels); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: want %v, got %v", c.labels, c.want, got)
+		}
+	}
+
+	labels := labelPairs("host", "db-1")
+	if got := addConstLabels(nil, labels); !reflect.DeepEqual(got, labels) {
+		t.Errorf("want the labels unchanged without constant labels, got %v", got)
+	}
+}
+
+func TestConstLabelsCfg(t *testing.T) {
+	saved := autoLabelDetectors
+	autoLabelDetectors = map[string]func() (string, error){
+		autoLabelHostname:  func() (string, error) { return "web-1", nil },
+		autoLabelPrimaryIP: func() (string, error) { return "", net.UnknownNetworkError("none") },
+	}
+	defer func() { autoLabelDetectors = saved }()
+
+	cfg := &ConstLabelsCfg{
+		Static:     map[string]string{"env": "prod", "hostname": "override", "instance": "x"},
+		AutoDetect: []string{autoLabelHostname, autoLabelPrimaryIP},
+	}
+	labels, err := cfg.labels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// static labels win, failed detections are left out and reserved names
+	// renamed like kv tags
+	want := labelPairs("env", "prod", "hostname", "override", "instance_", "x")
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("want %v, got %v", want, labels)
+	}
+
+	for _, cfg := range []*ConstLabelsCfg{
+		{AutoDetect: []string{"mac_address"}},
+		{Static: map[string]string{"a-b": "x"}},
+	} {
+		if _, err := cfg.labels(); err == nil {
+			t.Errorf("%+v: want an error", cfg)
+		}
+	}
+}
+
+func TestPrimaryIP(t *testing.T) {
+	addrs := func(cidrs ...string) []net.Addr {
+		var res []net.Addr
+		for _, c := range cidrs {
+			ip, ipnet, err := net.ParseCIDR(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipnet.IP = ip
+			res = append(res, ipnet)
+		}
+		return res
+	}
+	up := net.FlagUp
+
+	lo := netInterface{"lo", up | net.FlagLoopback, addrs("127.0.0.1/8", "::1/128")}
+	eth0 := netInterface{"eth0", up, addrs("fe80::1/64", "10.0.0.5/24")}
+	eth1 := netInterface{"eth1", up, addrs("192.168.1.9/24")}
+	down := netInterface{"eth2", 0, addrs("172.16.0.1/16")}
+	v6 := netInterface{"eth3", up, addrs("fe80::2/64", "2001:db8::5/64")}
+
+	for _, c := range []struct {
+		ifaces []netInterface
+		def    string
+		want   string
+	}{
+		{[]netInterface{lo, eth0, eth1}, "", "10.0.0.5"},
+		{[]netInterface{lo, eth0, eth1}, "eth1", "192.168.1.9"},
+		{[]netInterface{lo, down, eth1}, "eth2", "192.168.1.9"},
+		// IPv4 first, link local addresses are skipped
+		{[]netInterface{lo, v6, eth1}, "eth3", "192.168.1.9"},
+		{[]netInterface{lo, v6}, "", "2001:db8::5"},
+		{[]netInterface{lo, down}, "", ""},
+	} {
+		got, err := primaryIP(c.ifaces, c.def)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%s: want an error, got %s", c.def, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: want %s, got %s, %v", c.def, c.want, got, err)
+		}
+	}
+}
+
+func TestDefaultRouteInterface(t *testing.T) {
+	route := []byte(`Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+eth0	00000000	0100000A	0003	0	0	100	00000000	0	0	0
+eth0	0000000A	00000000	0001	0	0	100	00FFFFFF	0	0	0
+`)
+	if got := defaultRouteInterface(route); got != "eth0" {
+		t.Errorf("want eth0, got %q", got)
+	}
+	if got := defaultRouteInterface(route[:120]); got != "" {
+		t.Errorf("want no default route, got %q", got)
+	}
+	if got := defaultRouteInterface(nil); got != "" {
+		t.Errorf("want no default route, got %q", got)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -16,18 +18,28 @@ import (
 // created on the fly, if filtering is requested. Create instances with
 // newHandler.
 type metricHandler struct {
+	mtx               sync.RWMutex // guards unfilteredHandler
 	unfilteredHandler http.Handler
 	// exporterMetricsRegistry is a separate registry for the metrics about
 	// the exporter itself.
 	exporterMetricsRegistry *prometheus.Registry
 	includeExporterMetrics  bool
+	// snapshot serves unfiltered scrapes from a background collection if
+	// its interval is set.
+	snapshot snapshotHolder
 }
 
-func NewMetricHandler(includeExporterMetrics bool) *metricHandler {
+func NewMetricHandler(includeExporterMetrics bool, collectInterval time.Duration) *metricHandler {
 	h := &metricHandler{
 		exporterMetricsRegistry: prometheus.NewRegistry(),
 		includeExporterMetrics:  includeExporterMetrics,
+		snapshot: snapshotHolder{
+			name:      "node collectors",
+			namespace: "node",
+			interval:  collectInterval,
+		},
 	}
+	h.exporterMetricsRegistry.MustRegister(configReloadSuccess, configReloadSeconds)
 	if h.includeExporterMetrics {
 		h.exporterMetricsRegistry.MustRegister(
 			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
@@ -48,13 +60,17 @@ func (h *metricHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if len(filters) == 0 {
 		// No filters, use the prepared unfiltered handler.
-		h.unfilteredHandler.ServeHTTP(w, r)
+		h.mtx.RLock()
+		uh := h.unfilteredHandler
+		h.mtx.RUnlock()
+
+		uh.ServeHTTP(w, r)
 		return
 	}
 	// To serve filtered metrics, we create a filtering handler on the fly.
 	filteredHandler, err := h.innerHandler(filters...)
 	if err != nil {
-		log.Printf("[warn] Couldn't create filtered metrics handler:", err)
+		log.Printf("[warn] Couldn't create filtered metrics handler: %s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("Couldn't create filtered metrics handler: %s", err)))
 		return
@@ -62,6 +78,21 @@ func (h *metricHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	filteredHandler.ServeHTTP(w, r)
 }
 
+// Rebuild recreates the unfiltered handler so that it picks up collectors
+// enabled or disabled since it was created. Scrapes in flight finish on the
+// previous handler.
+func (h *metricHandler) Rebuild() error {
+	ih, err := h.innerHandler()
+	if err != nil {
+		return err
+	}
+
+	h.mtx.Lock()
+	h.unfilteredHandler = ih
+	h.mtx.Unlock()
+	return nil
+}
+
 // innerHandler is used to create both the one unfiltered http.Handler to be
 // wrapped by the outer handler and also the filtered handlers created on the
 // fly. The former is accomplished by calling innerHandler without any arguments
@@ -95,8 +126,13 @@ func (h *metricHandler) innerHandler(filters ...string) (http.Handler, error) {
 		return nil, fmt.Errorf("couldn't register node collector: %s", err)
 	}
 
+	var g prometheus.Gatherer = r
+	if len(filters) == 0 {
+		g = h.snapshot.wrap(r)
+	}
+
 	handler := promhttp.HandlerFor(
-		prometheus.Gatherers{h.exporterMetricsRegistry, r},
+		wrapGatherer(registryNode, prometheus.Gatherers{h.exporterMetricsRegistry, g}),
 		promhttp.HandlerOpts{
 			ErrorHandling: promhttp.ContinueOnError,
 		},
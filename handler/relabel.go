@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelMap  = "labelmap"
+)
+
+// RelabelRule is a Prometheus style metric relabel rule. The metric name is
+// available as the __name__ source label, it can not be changed.
+type RelabelRule struct {
+	SourceLabels []string `json:"source_labels"`
+	Separator    *string  `json:"separator"` // ";" by default
+	Regex        *string  `json:"regex"`     // "(.*)" by default
+	TargetLabel  string   `json:"target_label"`
+	Replacement  *string  `json:"replacement"` // "$1" by default
+	Action       string   `json:"action"`      // "replace" by default
+
+	// Registries limits the rule to some of the node, kv and fileinfo
+	// registries, the rule applies to all of them if empty.
+	Registries []string `json:"registries"`
+
+	regex *regexp.Regexp
+}
+
+// RelabelCfg is the configure of the relabel rules applied to the metrics of
+// /metrics, /kvs and /fileinfos, after the constant labels are added.
+type RelabelCfg struct {
+	MetricRelabelConfigs []*RelabelRule `json:"metric_relabel_configs"`
+}
+
+var relabelRules []*RelabelRule
+
+// LoadRelabelRules loads the relabel rules from cfgFile. It must be called
+// before the handlers are created.
+func LoadRelabelRules(cfgFile string) error {
+	j, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	var cfg RelabelCfg
+	if err := json.Unmarshal(j, &cfg); err != nil {
+		return fmt.Errorf("load %s failed: %s", cfgFile, err)
+	}
+
+	for i, r := range cfg.MetricRelabelConfigs {
+		if err := r.init(); err != nil {
+			return fmt.Errorf("load %s failed: rule %d: %s", cfgFile, i, err)
+		}
+	}
+
+	relabelRules = cfg.MetricRelabelConfigs
+	return nil
+}
+
+func (r *RelabelRule) init() error {
+	if r.Separator == nil {
+		r.Separator = proto(";")
+	}
+	if r.Regex == nil {
+		r.Regex = proto("(.*)")
+	}
+	if r.Replacement == nil {
+		r.Replacement = proto("$1")
+	}
+	if r.Action == "" {
+		r.Action = relabelReplace
+	}
+
+	re, err := regexp.Compile("^(?:" + *r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %s", *r.Regex, err)
+	}
+	r.regex = re
+
+	for _, name := range r.Registries {
+		if _, ok := registries[name]; !ok {
+			return fmt.Errorf("unknown registry %q", name)
+		}
+	}
+
+	switch r.Action {
+	case relabelReplace:
+		if r.TargetLabel == model.MetricNameLabel {
+			return fmt.Errorf("metric name can not be replaced")
+		}
+		if !model.LabelName(r.TargetLabel).IsValid() {
+			return fmt.Errorf("invalid target_label %q", r.TargetLabel)
+		}
+		fallthrough
+	case relabelKeep, relabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("source_labels required by action %s", r.Action)
+		}
+	case relabelLabelDrop, relabelLabelMap:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	return nil
+}
+
+func (r *RelabelRule) appliesTo(registry string) bool {
+	if len(r.Registries) == 0 {
+		return true
+	}
+	for _, name := range r.Registries {
+		if name == registry {
+			return true
+		}
+	}
+	return false
+}
+
+func relabelRulesOf(registry string) []*RelabelRule {
+	var rules []*RelabelRule
+	for _, r := range relabelRules {
+		if r.appliesTo(registry) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// relabel applies rules to the labels of a metric of family name. The
+// returned labels are unsorted, and false is returned if the metric is
+// dropped.
+func relabel(rules []*RelabelRule, name string, labels []*dto.LabelPair) ([]*dto.LabelPair, bool) {
+	if len(rules) == 0 {
+		return labels, true
+	}
+
+	lset := make(map[string]string, len(labels)+1)
+	for _, l := range labels {
+		lset[l.GetName()] = l.GetValue()
+	}
+	lset[model.MetricNameLabel] = name
+
+	for _, r := range rules {
+		if !r.apply(lset) {
+			return nil, false
+		}
+	}
+
+	res := make([]*dto.LabelPair, 0, len(lset))
+	for n, v := range lset {
+		if n == model.MetricNameLabel {
+			continue
+		}
+		res = append(res, &dto.LabelPair{Name: proto(n), Value: proto(v)})
+	}
+	return res, true
+}
+
+func (r *RelabelRule) apply(lset map[string]string) bool {
+	switch r.Action {
+	case relabelKeep, relabelDrop, relabelReplace:
+		values := make([]string, 0, len(r.SourceLabels))
+		for _, n := range r.SourceLabels {
+			values = append(values, lset[n])
+		}
+		val := strings.Join(values, *r.Separator)
+
+		idx := r.regex.FindStringSubmatchIndex(val)
+		switch r.Action {
+		case relabelKeep:
+			return idx != nil
+		case relabelDrop:
+			return idx == nil
+		}
+
+		if idx == nil {
+			break
+		}
+		target := string(r.regex.ExpandString(nil, *r.Replacement, val, idx))
+		if target == "" {
+			delete(lset, r.TargetLabel)
+		} else {
+			lset[r.TargetLabel] = target
+		}
+
+	case relabelLabelDrop:
+		for n := range lset {
+			if n != model.MetricNameLabel && r.regex.MatchString(n) {
+				delete(lset, n)
+			}
+		}
+
+	case relabelLabelMap:
+		mapped := map[string]string{}
+		for n, v := range lset {
+			if n == model.MetricNameLabel || !r.regex.MatchString(n) {
+				continue
+			}
+			target := r.regex.ReplaceAllString(n, *r.Replacement)
+			if target != model.MetricNameLabel && model.LabelName(target).IsValid() {
+				mapped[target] = v
+			}
+		}
+		for n, v := range mapped {
+			lset[n] = v
+		}
+	}
+
+	return true
+}
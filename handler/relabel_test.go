@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRelabel(t *testing.T) {
+	rules := []*RelabelRule{
+		{SourceLabels: []string{"__name__", "device"}, Regex: proto("node_network_.*;veth.*"), Action: relabelDrop},
+		{SourceLabels: []string{"device"}, Regex: proto("(e.*)"), TargetLabel: "nic", Replacement: proto("if_$1")},
+		{Regex: proto("tmp_(.*)"), Action: relabelLabelMap},
+		{Regex: proto("tmp_.*"), Action: relabelLabelDrop},
+	}
+	for _, r := range rules {
+		if err := r.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string // "" if dropped
+	}{
+		{"node_network_up", map[string]string{"device": "veth01"}, ""},
+		{"node_network_up", map[string]string{"device": "eth0"}, "device=eth0,nic=if_eth0"},
+		{"node_load1", map[string]string{"tmp_a": "1"}, "a=1"},
+	}
+
+	for _, test := range tests {
+		var labels []*dto.LabelPair
+		for n, v := range test.labels {
+			labels = append(labels, &dto.LabelPair{Name: proto(n), Value: proto(v)})
+		}
+
+		res, keep := relabel(rules, test.name, labels)
+		got := ""
+		if keep {
+			var parts []string
+			for _, l := range res {
+				parts = append(parts, l.GetName()+"="+l.GetValue())
+			}
+			sort.Strings(parts)
+			got = strings.Join(parts, ",")
+		}
+		if got != test.want {
+			t.Errorf("%s%v: want %q, got %q", test.name, test.labels, test.want, got)
+		}
+	}
+}
+
+func TestRelabelRuleInit(t *testing.T) {
+	for _, r := range []*RelabelRule{
+		{SourceLabels: []string{"a"}, TargetLabel: "__name__"},
+		{SourceLabels: []string{"a"}, TargetLabel: "b", Action: "hashmod"},
+		{Action: relabelKeep},
+		{Action: relabelLabelDrop, Regex: proto("(")},
+		{Action: relabelLabelDrop, Registries: []string{"foo"}},
+	} {
+		if err := r.init(); err == nil {
+			t.Errorf("%+v: expected error", r)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// viewGatherer gathers several views of one collection, such as the results
+// of the kv collectors exported in each format.
+type viewGatherer interface {
+	GatherViews() (map[string][]*dto.MetricFamily, error)
+}
+
+// singleView is the view of a prometheus.Gatherer, named "".
+type singleView struct {
+	prometheus.Gatherer
+}
+
+func (v singleView) GatherViews() (map[string][]*dto.MetricFamily, error) {
+	mfs, err := v.Gather()
+	return map[string][]*dto.MetricFamily{"": mfs}, err
+}
+
+// snapshotGatherer runs a prometheus.Gatherer on a fixed interval in the
+// background and serves the last complete result, so that any number of
+// scrapers only cost one collection per interval. A failed collection keeps
+// the last good snapshot, whose age keeps growing. The snapshot of a
+// viewGatherer serves each of its views with view.
+type snapshotGatherer struct {
+	name     string
+	interval time.Duration
+	refresh  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mtx      sync.RWMutex
+	gatherer viewGatherer
+	// gen is bumped by reset, a collection of a previous gatherer is dropped
+	gen uint64
+	// ready is closed by the first collection of gen
+	ready    chan struct{}
+	views    map[string][]*dto.MetricFamily
+	err      error
+	at       time.Time
+	duration time.Duration
+
+	ageDesc      *prometheus.Desc
+	durationDesc *prometheus.Desc
+}
+
+func newSnapshotGatherer(name, namespace string, g prometheus.Gatherer, interval time.Duration) *snapshotGatherer {
+	return newViewSnapshot(name, namespace, singleView{g}, interval)
+}
+
+func newViewSnapshot(name, namespace string, g viewGatherer, interval time.Duration) *snapshotGatherer {
+	s := &snapshotGatherer{
+		name:     name,
+		interval: interval,
+		refresh:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		gatherer: g,
+		ready:    make(chan struct{}),
+		ageDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "snapshot", "age_seconds"),
+			"Age of the cached collection served to scrapers.",
+			nil, nil),
+		durationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "snapshot", "collection_duration_seconds"),
+			"Duration of the last background collection.",
+			nil, nil),
+	}
+
+	go s.run()
+	return s
+}
+
+func (s *snapshotGatherer) run() {
+	tick := time.NewTicker(s.interval)
+	defer tick.Stop()
+
+	for {
+		s.update()
+
+		select {
+		case <-tick.C:
+		case <-s.refresh:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// stop ends the background collections, the last snapshot is still served.
+func (s *snapshotGatherer) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// reset replaces the gatherer behind the snapshot. The stale snapshot is
+// dropped right away and a new background collection is started.
+func (s *snapshotGatherer) reset(g prometheus.Gatherer) {
+	s.resetViews(singleView{g})
+}
+
+func (s *snapshotGatherer) resetViews(g viewGatherer) {
+	s.mtx.Lock()
+	s.gatherer = g
+	s.gen++
+	if !s.at.IsZero() {
+		// scrapers waiting for the first collection keep waiting on the
+		// open channel
+		s.ready = make(chan struct{})
+	}
+	s.views = nil
+	s.err = nil
+	s.at = time.Time{}
+	s.mtx.Unlock()
+
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *snapshotGatherer) update() {
+	s.mtx.RLock()
+	g, gen := s.gatherer, s.gen
+	s.mtx.RUnlock()
+
+	begin := time.Now()
+	views, err := g.GatherViews()
+	duration := time.Since(begin)
+
+	log.Printf("[debug] background collection of %s done in %s", s.name, duration)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if gen != s.gen {
+		// reset during the collection, the refresh it queued collects again
+		return
+	}
+	s.duration = duration
+	if err != nil && !s.at.IsZero() && s.err == nil {
+		log.Printf("[warn] background collection of %s got errors, keeping the snapshot of %s: %s", s.name, s.at.Format(time.RFC3339), err)
+		return
+	}
+	if err != nil {
+		log.Printf("[warn] background collection of %s got errors: %s", s.name, err)
+	}
+
+	first := s.at.IsZero()
+	s.views = views
+	s.err = err
+	s.at = time.Now()
+	if first {
+		close(s.ready)
+	}
+}
+
+// Gather implements prometheus.Gatherer. Until the first background
+// collection completes, it waits for it.
+func (s *snapshotGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return s.gatherView("")
+}
+
+// view returns the gatherer of the view name of the snapshot.
+func (s *snapshotGatherer) view(name string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return s.gatherView(name)
+	})
+}
+
+func (s *snapshotGatherer) gatherView(name string) ([]*dto.MetricFamily, error) {
+	s.mtx.RLock()
+	ready := s.ready
+	s.mtx.RUnlock()
+
+	select {
+	case <-ready:
+	case <-s.done:
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.views[name], s.err
+}
+
+// Describe implements prometheus.Collector.
+func (s *snapshotGatherer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.ageDesc
+	ch <- s.durationDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *snapshotGatherer) Collect(ch chan<- prometheus.Metric) {
+	s.mtx.RLock()
+	at, duration := s.at, s.duration
+	s.mtx.RUnlock()
+
+	if at.IsZero() {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(s.ageDesc, prometheus.GaugeValue, time.Since(at).Seconds())
+	ch <- prometheus.MustNewConstMetric(s.durationDesc, prometheus.GaugeValue, duration.Seconds())
+}
+
+// snapshotHolder keeps the background snapshot of a handler across
+// rebuilds of its unfiltered handler.
+type snapshotHolder struct {
+	name      string
+	namespace string
+	interval  time.Duration
+
+	mtx      sync.Mutex
+	snapshot *snapshotGatherer
+	meta     *prometheus.Registry
+}
+
+// wrap returns g served from a background snapshot refreshed every
+// interval, or g itself if interval is 0.
+func (h *snapshotHolder) wrap(g prometheus.Gatherer) prometheus.Gatherer {
+	if h.interval <= 0 {
+		return g
+	}
+	return h.wrapViews(singleView{g})("")
+}
+
+// wrapViews serves the views of g from a background snapshot refreshed
+// every interval, it returns the gatherer of each view. interval must be
+// set.
+func (h *snapshotHolder) wrapViews(g viewGatherer) func(name string) prometheus.Gatherer {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.snapshot == nil {
+		h.snapshot = newViewSnapshot(h.name, h.namespace, g, h.interval)
+		h.meta = prometheus.NewRegistry()
+		h.meta.MustRegister(h.snapshot)
+	} else {
+		h.snapshot.resetViews(g)
+	}
+
+	snapshot, meta := h.snapshot, h.meta
+	return func(name string) prometheus.Gatherer {
+		return prometheus.Gatherers{snapshot.view(name), meta}
+	}
+}
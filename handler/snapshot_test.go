@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeGatherer returns a family named after its call count, or err.
+type fakeGatherer struct {
+	mtx   sync.Mutex
+	calls int
+	err   error
+	block chan struct{} // if set, Gather waits for it
+}
+
+func (g *fakeGatherer) Gather() ([]*dto.MetricFamily, error) {
+	if g.block != nil {
+		<-g.block
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.calls++
+	if g.err != nil {
+		return nil, g.err
+	}
+	return []*dto.MetricFamily{{Name: proto(fmt.Sprintf("run_%d", g.calls))}}, nil
+}
+
+func (g *fakeGatherer) setErr(err error) {
+	g.mtx.Lock()
+	g.err = err
+	g.mtx.Unlock()
+}
+
+func gatheredName(t *testing.T, s *snapshotGatherer) string {
+	t.Helper()
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 {
+		t.Fatalf("want a family, got %v", mfs)
+	}
+	return mfs[0].GetName()
+}
+
+func TestSnapshotFirstFill(t *testing.T) {
+	g := &fakeGatherer{block: make(chan struct{})}
+	s := newSnapshotGatherer("test", "test", g, time.Hour)
+	defer s.stop()
+
+	got := make(chan string)
+	go func() {
+		got <- gatheredName(t, s)
+	}()
+
+	// scrapes wait for the background collection, and do not collect
+	// themselves
+	select {
+	case name := <-got:
+		t.Fatalf("want the scrape to wait for the first collection, got %s", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(g.block)
+	if name := <-got; name != "run_1" {
+		t.Errorf("want run_1, got %s", name)
+	}
+	if g.calls != 1 {
+		t.Errorf("want a single collection, got %d", g.calls)
+	}
+}
+
+func TestSnapshotKeepsLastGood(t *testing.T) {
+	g := &fakeGatherer{}
+	s := newSnapshotGatherer("test", "test", g, time.Hour)
+	defer s.stop()
+
+	if name := gatheredName(t, s); name != "run_1" {
+		t.Fatalf("want run_1, got %s", name)
+	}
+	s.mtx.RLock()
+	at := s.at
+	s.mtx.RUnlock()
+
+	g.setErr(errors.New("collection failed"))
+	s.update()
+	if name := gatheredName(t, s); name != "run_1" {
+		t.Errorf("want the last good snapshot, got %s", name)
+	}
+	s.mtx.RLock()
+	if !s.at.Equal(at) {
+		t.Errorf("want the time of the last good snapshot %s, got %s", at, s.at)
+	}
+	s.mtx.RUnlock()
+
+	g.setErr(nil)
+	s.update()
+	if name := gatheredName(t, s); name != "run_3" {
+		t.Errorf("want run_3, got %s", name)
+	}
+
+	// without a good snapshot the error is served
+	g.setErr(errors.New("collection failed"))
+	s.reset(g)
+	if _, err := s.Gather(); err == nil {
+		t.Error("want the error of the first collection")
+	}
+}
+
+func TestSnapshotStop(t *testing.T) {
+	g := &fakeGatherer{}
+	s := newSnapshotGatherer("test", "test", g, 10*time.Millisecond)
+	gatheredName(t, s)
+
+	s.stop()
+	s.stop() // stopping twice is fine
+	time.Sleep(30 * time.Millisecond)
+
+	g.mtx.Lock()
+	calls := g.calls
+	g.mtx.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.calls != calls {
+		t.Errorf("want no collection after stop, got %d more", g.calls-calls)
+	}
+}
+
+func TestSnapshotStopBeforeFirstFill(t *testing.T) {
+	g := &fakeGatherer{block: make(chan struct{})}
+	defer close(g.block)
+	s := newSnapshotGatherer("test", "test", g, time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		s.Gather()
+		close(done)
+	}()
+	s.stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("want scrapes waiting for the first collection to return once stopped")
+	}
+}
@@ -0,0 +1,228 @@
+package kv
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/rtpanic"
+)
+
+// The results of the entries with an interval are cached, whatever the
+// output format, and refreshed in the background by the first scrape
+// after the interval. A failed refresh keeps serving the last good result,
+// flagged as stale, until it is older than the max_age of the entry.
+
+var (
+	cacheAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "age_seconds"),
+		"envinfo: Age of the cached result served by a collector with an interval.",
+		[]string{"collector"},
+		nil,
+	)
+	cacheStaleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "stale"),
+		"envinfo: Whether the last refresh of a cached collector failed and its last good result is served.",
+		[]string{"collector"},
+		nil,
+	)
+
+	resultsMtx = sync.Mutex{}
+	results    = make(map[string]*cachedResult) // by sub_system
+)
+
+// kvResult is the data of a collector run, rendered in every format.
+type kvResult struct {
+	rows    []map[string]string // osquery and native collectors
+	files   []catFile           // cat collectors
+	missing []string            // patterns of the cat collectors not found
+}
+
+type cachedResult struct {
+	mtx        sync.Mutex
+	cfg        *kvCfg // the entry the result is of
+	result     *kvResult
+	at         time.Time // time of result
+	lastRun    time.Time // start of the last run, successful or not
+	err        error     // error of the last run, result is stale if set
+	refreshing bool
+}
+
+// fetch returns the result of kc with its age, and whether it is stale.
+// Collectors without interval run every time.
+func (kc *kvCollector) fetch() (*kvResult, time.Duration, bool, error) {
+	if kc.cfg.interval <= 0 {
+		res, err := kc.run()
+		return res, 0, false, err
+	}
+
+	c := cachedResultOf(kc.cfg)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// the first run is synchronous, concurrent scrapes wait for it; until
+	// one succeeds, a failed run is retried once per interval and its
+	// error served in between
+	if c.result == nil {
+		if c.err != nil && time.Since(c.lastRun) < kc.cfg.interval {
+			return nil, 0, false, c.err
+		}
+		begin := time.Now()
+		res, err := kc.run()
+		c.lastRun = begin
+		if err != nil {
+			c.err = err
+			return nil, 0, false, err
+		}
+		c.result, c.at, c.err = res, time.Now(), nil
+		return res, 0, false, nil
+	}
+
+	if time.Since(c.lastRun) >= kc.cfg.interval && !c.refreshing {
+		c.refreshing = true
+		go c.refresh(kc)
+	}
+
+	age := time.Since(c.at)
+	if c.err != nil && age > kc.cfg.maxAge {
+		return nil, age, true, fmt.Errorf("last good result expired after %v: %s", kc.cfg.maxAge, c.err)
+	}
+	return c.result, age, c.err != nil, nil
+}
+
+// cachedResultOf returns the cache of the entry cfg. The cache of a
+// previous configure of the same sub_system is dropped.
+func cachedResultOf(cfg *kvCfg) *cachedResult {
+	resultsMtx.Lock()
+	defer resultsMtx.Unlock()
+
+	c, ok := results[cfg.SubSystem]
+	if !ok || c.cfg != cfg {
+		c = &cachedResult{cfg: cfg}
+		results[cfg.SubSystem] = c
+	}
+	return c
+}
+
+func (c *cachedResult) refresh(kc *kvCollector) {
+	begin := time.Now()
+	res, err := runRecovered(kc)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.refreshing = false
+	c.lastRun = begin
+	if err != nil {
+		log.Printf("[warn] refresh of %s failed, serve the result of %s: %s", kc.cfg.SubSystem, c.at.Format(time.RFC3339), err)
+		c.err = err
+		return
+	}
+	c.result, c.at, c.err = res, time.Now(), nil
+}
+
+// runRecovered runs kc out of a scrape, a panic is returned as an error.
+func runRecovered(kc *kvCollector) (res *kvResult, err error) {
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		panicsMtx.Lock()
+		panics[kc.cfg.SubSystem]++
+		panicsMtx.Unlock()
+
+		err = fmt.Errorf("panic: %s", perr)
+	})
+	return kc.run()
+}
+
+// run collects the data of kc, redacts it and records its changes.
+func (kc *kvCollector) run() (*kvResult, error) {
+	begin := time.Now()
+	res, err := kc.collect()
+	if err != nil {
+		return nil, err
+	}
+	redactResult(kc.cfg, res)
+	recordChanges(kc.cfg, begin, res)
+	return res, nil
+}
+
+// collect collects the data of kc, bounded by its timeout.
+func (kc *kvCollector) collect() (*kvResult, error) {
+	switch kc.cfg.Type {
+	case kvCollectorTypeCat:
+		return withTimeout(kc.cfg.timeout, func() (*kvResult, error) {
+			files, missing, err := kc.cat()
+			return &kvResult{files: files, missing: missing}, err
+		})
+	case kvCollectorTypeOSQuery:
+		rows, err := doQuery(kc.cfg)
+		return &kvResult{rows: rows}, err
+	case kvCollectorTypeNative:
+		rows, err := doNative(kc.cfg, queryTimeout(kc.cfg))
+		return &kvResult{rows: rows}, err
+	case kvCollectorTypeExec:
+		rows, err := doExec(kc.cfg)
+		return &kvResult{rows: rows}, err
+	}
+	return nil, fmt.Errorf("unsupported type %s", kc.cfg.Type)
+}
+
+// withTimeout calls f, which is abandoned after timeout if it is not 0.
+// The result of f is handed over by a channel, an abandoned f can't write
+// to anything the caller reads.
+func withTimeout(timeout time.Duration, f func() (*kvResult, error)) (*kvResult, error) {
+	if timeout <= 0 {
+		return f()
+	}
+
+	type result struct {
+		res *kvResult
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() {
+			done <- r
+		}()
+		defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+			r = result{err: fmt.Errorf("panic: %s", perr)}
+		})
+		r.res, r.err = f()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-timer.C:
+		return nil, &timeoutError{timeout: timeout}
+	}
+}
+
+// timeoutError is the error of a collector stopped by its timeout, it is a
+// net.Error like the timeouts of the osqueryd socket.
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string   { return fmt.Sprintf("timed out after %v", e.timeout) }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func describeCache(ch chan<- *prometheus.Desc) {
+	ch <- cacheAgeDesc
+	ch <- cacheStaleDesc
+}
+
+func cacheMetrics(ch chan<- prometheus.Metric, name string, age time.Duration, stale bool) {
+	staleValue := 0.0
+	if stale {
+		staleValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, age.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(cacheStaleDesc, prometheus.GaugeValue, staleValue, name)
+}
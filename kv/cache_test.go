@@ -0,0 +1,145 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFetchCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "motd")
+	if err := ioutil.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &kvCfg{SubSystem: "motd", Type: kvCollectorTypeExec, Command: "cat", Args: []string{file}, Interval: "50ms", MaxAge: "200ms"}
+	if _, err := cfg.parseExec(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.parseDurations(); err != nil {
+		t.Fatal(err)
+	}
+	kc := &kvCollector{cfg: cfg}
+
+	// fetch waits for the pending refresh of kc, then fetches
+	fetch := func() (string, bool, error) {
+		c := cachedResultOf(cfg)
+		for {
+			c.mtx.Lock()
+			refreshing := c.refreshing
+			c.mtx.Unlock()
+			if !refreshing {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		res, _, stale, err := kc.fetch()
+		if err != nil {
+			return "", stale, err
+		}
+		return res.rows[0]["output"], stale, nil
+	}
+	expect := func(content string, stale bool) {
+		t.Helper()
+		got, gotStale, err := fetch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != content || gotStale != stale {
+			t.Fatalf("want %q (stale %v), got %q (stale %v)", content, stale, got, gotStale)
+		}
+	}
+
+	expect("a", false)
+
+	// served from the cache until the interval is over, then refreshed in
+	// the background
+	ioutil.WriteFile(file, []byte("b"), 0644)
+	expect("a", false)
+	time.Sleep(60 * time.Millisecond)
+	expect("a", false)
+	expect("b", false)
+
+	// cat fails on a missing file, the last good result is stale
+	os.Remove(file)
+	time.Sleep(60 * time.Millisecond)
+	expect("b", false)
+	expect("b", true)
+
+	// until it expires
+	time.Sleep(200 * time.Millisecond)
+	if _, stale, err := fetch(); err == nil || !stale {
+		t.Fatalf("want an expired result, got stale %v, error %v", stale, err)
+	}
+}
+
+func TestParseDurations(t *testing.T) {
+	for _, c := range []struct {
+		cfg   kvCfg
+		field string
+	}{
+		{kvCfg{Interval: "1m", Timeout: "10s"}, ""},
+		{kvCfg{Interval: "1m", MaxAge: "30s"}, "max_age"},
+		{kvCfg{MaxAge: "1h"}, "max_age"},
+		{kvCfg{Timeout: "-1s"}, "timeout"},
+		{kvCfg{Interval: "often"}, "interval"},
+	} {
+		err := c.cfg.parseDurations()
+		if c.field == "" && err != nil {
+			t.Errorf("%+v: unexpected error %s", c.cfg, err)
+		}
+		if c.field != "" && (err == nil || err.field != c.field) {
+			t.Errorf("%+v: want an error on %s, got %v", c.cfg, c.field, err)
+		}
+	}
+
+	cfg := kvCfg{Interval: "1m"}
+	cfg.parseDurations()
+	if cfg.maxAge != 3*time.Minute {
+		t.Errorf("want a default max_age of 3m, got %v", cfg.maxAge)
+	}
+}
+
+func TestFetchFirstRunFailed(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "motd")
+
+	cfg := &kvCfg{SubSystem: "motd_missing", Type: kvCollectorTypeExec, Command: "cat", Args: []string{file}, Interval: "100ms"}
+	if _, err := cfg.parseExec(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.parseDurations(); err != nil {
+		t.Fatal(err)
+	}
+	kc := &kvCollector{cfg: cfg}
+
+	if _, _, _, err := kc.fetch(); err == nil {
+		t.Fatal("want the error of the first run")
+	}
+
+	// the failed run is not retried before the interval is over
+	if err := ioutil.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := kc.fetch(); err == nil {
+		t.Fatal("want the error of the first run until the interval is over")
+	}
+
+	time.Sleep(110 * time.Millisecond)
+	res, _, _, err := kc.fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.rows[0]["output"]; got != "a" {
+		t.Errorf("want %q, got %q", "a", got)
+	}
+}
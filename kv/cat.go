@@ -0,0 +1,300 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/alecthomas/units"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/redact"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// cat entries read their files, which may be glob patterns or directories
+// whose regular files are read, not recursively. Their lines may be
+// filtered by Include and Exclude, and a file longer than MaxFileSize, or
+// than what is left of the MaxSize of the entry, is cut and ends with
+// catTruncated. Files of an entry with redact rules are read up to
+// redact.ReadMargin past their limit and redacted before they are cut. A
+// file or directory which can't be read is reported like a missing one.
+
+const catTruncated = "\n[truncated]\n"
+
+var (
+	catMaxFileSize = kingpin.Flag("kv.cat.max-file-size", "Default size a file read by a cat kv entry is truncated to, 0 for no limit.").Default("1MB").Bytes()
+	catMaxSize     = kingpin.Flag("kv.cat.max-size", "Default total size of the files read by a cat kv entry, 0 for no limit.").Default("4MB").Bytes()
+)
+
+type catFile struct {
+	path      string
+	content   []byte
+	truncated bool
+}
+
+// parseCat checks the cat settings of kc, it returns the json name of the
+// invalid field.
+func (kc *kvCfg) parseCat() (string, error) {
+	if len(kc.Files) == 0 {
+		return "files", fmt.Errorf("no files to cat")
+	}
+	for _, f := range kc.Files {
+		if _, err := filepath.Match(f, ""); err != nil {
+			return "files", fmt.Errorf("invalid pattern %q: %s", f, err)
+		}
+	}
+
+	for _, r := range []struct {
+		name string
+		expr string
+		dst  **regexp.Regexp
+	}{
+		{"include", kc.Include, &kc.include},
+		{"exclude", kc.Exclude, &kc.exclude},
+	} {
+		if r.expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(r.expr)
+		if err != nil {
+			return r.name, fmt.Errorf("invalid %s: %s", r.name, err)
+		}
+		*r.dst = re
+	}
+
+	for _, s := range []struct {
+		name  string
+		value string
+		dst   *int64
+	}{
+		{"max_file_size", kc.MaxFileSize, &kc.maxFileSize},
+		{"max_size", kc.MaxSize, &kc.maxSize},
+	} {
+		if s.value == "" {
+			continue
+		}
+		n, err := units.ParseBase2Bytes(s.value)
+		if err != nil {
+			return s.name, fmt.Errorf("invalid %s: %s", s.name, err)
+		}
+		if n <= 0 {
+			return s.name, fmt.Errorf("%s must be positive: %s", s.name, s.value)
+		}
+		*s.dst = int64(n)
+	}
+	return "", nil
+}
+
+// cat reads the files of a cat collector, only the ones of the first
+// pattern found if Any is set. It also returns the patterns which were not
+// found, and the paths which could not be read.
+func (kc *kvCollector) cat() ([]catFile, []string, error) {
+	maxFileSize, maxSize := kc.cfg.maxFileSize, kc.cfg.maxSize
+	if maxFileSize == 0 {
+		maxFileSize = int64(*catMaxFileSize)
+	}
+	if maxSize == 0 {
+		maxSize = int64(*catMaxSize)
+	}
+
+	var files []catFile
+	var missing []string
+	var size int64
+	for _, pattern := range kc.cfg.Files {
+		paths, unreadable, err := catPaths(pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		missing = append(missing, unreadable...)
+		if len(paths) == 0 {
+			if len(unreadable) == 0 {
+				missing = append(missing, pattern)
+			}
+			continue
+		}
+
+		read := 0
+		for _, path := range paths {
+			limit := int64(-1)
+			if maxFileSize > 0 {
+				limit = maxFileSize
+			}
+			if maxSize > 0 {
+				left := maxSize - size
+				if left < 0 {
+					left = 0
+				}
+				if limit < 0 || left < limit {
+					limit = left
+				}
+			}
+
+			// files are redacted before they are cut, a secret crossing
+			// the limit would not match its rule once cut
+			readLimit := limit
+			if len(kc.cfg.Redact) > 0 {
+				readLimit = redact.ReadLimit(limit)
+			}
+			f, err := readCatFile(path, readLimit, kc.cfg.include, kc.cfg.exclude)
+			if err != nil {
+				log.Printf("[warn] %s: %s", kc.cfg.SubSystem, err)
+				missing = append(missing, path)
+				continue
+			}
+			read++
+			if len(kc.cfg.Redact) > 0 {
+				if !redactFile(kc.cfg, &f) {
+					continue
+				}
+				f.truncate(limit)
+			}
+			size += int64(len(f.content))
+			if f.truncated {
+				f.content = append(f.content, catTruncated...)
+			}
+			files = append(files, f)
+		}
+
+		if kc.cfg.Any && read > 0 {
+			return files, nil, nil
+		}
+	}
+	return files, missing, nil
+}
+
+// catPaths returns the regular files of pattern, sorted, and the
+// directories of pattern which could not be read.
+func catPaths(pattern string) ([]string, []string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var paths, unreadable []string
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		if fi.Mode().IsRegular() {
+			paths = append(paths, m)
+			continue
+		}
+		if !fi.IsDir() {
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(m)
+		if err != nil {
+			log.Printf("[warn] %s", err)
+			unreadable = append(unreadable, m)
+			continue
+		}
+		for _, e := range entries {
+			// ReadDir does not follow symlinks
+			if fi, err := os.Stat(filepath.Join(m, e.Name())); err == nil && fi.Mode().IsRegular() {
+				paths = append(paths, filepath.Join(m, e.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, unreadable, nil
+}
+
+// readCatFile reads at most limit bytes of the lines of path kept by the
+// include and exclude filters, limit is ignored if negative.
+func readCatFile(path string, limit int64, include, exclude *regexp.Regexp) (catFile, error) {
+	res := catFile{path: path}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	defer fp.Close()
+
+	var r io.Reader = fp
+	if include == nil && exclude == nil {
+		if limit >= 0 {
+			r = io.LimitReader(fp, limit+1)
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return res, err
+		}
+		res.content = content
+	} else {
+		var buf bytes.Buffer
+		br := bufio.NewReader(fp)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 && keepLine(line, include, exclude) {
+				buf.Write(line)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return res, err
+			}
+			if limit >= 0 && int64(buf.Len()) > limit {
+				break
+			}
+		}
+		res.content = buf.Bytes()
+	}
+
+	res.truncate(limit)
+	return res, nil
+}
+
+// truncate cuts the content of f to limit bytes, limit is ignored if
+// negative.
+func (f *catFile) truncate(limit int64) {
+	if limit >= 0 && int64(len(f.content)) > limit {
+		f.content, f.truncated = f.content[:limit], true
+	}
+}
+
+func keepLine(line []byte, include, exclude *regexp.Regexp) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	if include != nil && !include.Match(line) {
+		return false
+	}
+	return exclude == nil || !exclude.Match(line)
+}
+
+func gzipped(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fileMissingMetric reports whether files of kc were not found, as
+// kv_node_<sub_system>_file_missing.
+func fileMissingMetric(kc *kvCollector, missing []string) prometheus.Metric {
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, kc.cfg.SubSystem, "file_missing"),
+		"envinfo: Whether files of the cat collector were not found or could not be read, all of them if it reads the first one found.",
+		nil, nil)
+
+	v := 0.0
+	if len(missing) > 0 {
+		v = 1
+	}
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+}
@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestCat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"sshd_config":           "# comment\nPort 22\nPermitRootLogin no\n",
+		"sysctl.d/10-net.conf":  "net.ipv4.ip_forward = 1\n",
+		"sysctl.d/20-vm.conf":   "vm.swappiness = 10\n",
+		"sysctl.d/sub/ignored":  "x\n",
+		"limits.d/big.conf":     "0123456789",
+		"limits.d/nofile.conf":  "* soft nofile 1024\n",
+		"limits.d/nproc.conf":   "* soft nproc 4096\n",
+		"limits.d/zz-last.conf": "unread\n",
+	} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cat := func(cfg *kvCfg) (map[string]string, []string) {
+		t.Helper()
+		cfg.Type = kvCollectorTypeCat
+		if _, err := cfg.parseCat(); err != nil {
+			t.Fatal(err)
+		}
+		files, missing, err := (&kvCollector{cfg: cfg}).cat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := map[string]string{}
+		for _, f := range files {
+			rel, _ := filepath.Rel(dir, f.path)
+			res[rel] = string(f.content)
+		}
+		return res, missing
+	}
+
+	// directories are read, not recursively, and globs expanded
+	files, missing := cat(&kvCfg{Files: []string{
+		filepath.Join(dir, "sysctl.d"),
+		filepath.Join(dir, "ssh*"),
+		filepath.Join(dir, "missing.conf"),
+	}, Exclude: "^#"})
+	want := map[string]string{
+		"sysctl.d/10-net.conf": "net.ipv4.ip_forward = 1\n",
+		"sysctl.d/20-vm.conf":  "vm.swappiness = 10\n",
+		"sshd_config":          "Port 22\nPermitRootLogin no\n",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("want %v, got %v", want, files)
+	}
+	if len(missing) != 1 || missing[0] != filepath.Join(dir, "missing.conf") {
+		t.Errorf("unexpected missing files %v", missing)
+	}
+
+	// a file is cut at max_file_size, and at what is left of max_size
+	files, _ = cat(&kvCfg{Files: []string{filepath.Join(dir, "limits.d")}, MaxFileSize: "4B", MaxSize: "10B"})
+	want = map[string]string{
+		"limits.d/big.conf":     "0123" + catTruncated,
+		"limits.d/nofile.conf":  "* so" + catTruncated,
+		"limits.d/nproc.conf":   "* " + catTruncated,
+		"limits.d/zz-last.conf": catTruncated,
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("want %v, got %v", want, files)
+	}
+
+	files, _ = cat(&kvCfg{Files: []string{filepath.Join(dir, "limits.d/n*")}, Include: "nproc|nofile", Exclude: "nofile"})
+	want = map[string]string{
+		"limits.d/nofile.conf": "",
+		"limits.d/nproc.conf":  "* soft nproc 4096\n",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("want %v, got %v", want, files)
+	}
+
+	// only the first pattern found
+	files, missing = cat(&kvCfg{Files: []string{filepath.Join(dir, "none"), filepath.Join(dir, "sysctl.d/2*"), filepath.Join(dir, "sshd_config")}, Any: true})
+	if len(files) != 1 || files["sysctl.d/20-vm.conf"] == "" || missing != nil {
+		t.Errorf("unexpected any files %v, missing %v", files, missing)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	// an unreadable file is missing, the others are kept; /proc/self/mem
+	// fails to read even as root
+	unreadable := filepath.Join(dir, "sysctl.d/30-mem.conf")
+	if err := os.Symlink("/proc/self/mem", unreadable); err != nil {
+		t.Fatal(err)
+	}
+	files, missing = cat(&kvCfg{Files: []string{filepath.Join(dir, "sysctl.d")}})
+	if len(files) != 2 || files["sysctl.d/10-net.conf"] == "" || !reflect.DeepEqual(missing, []string{unreadable}) {
+		t.Errorf("unexpected files %v, missing %v", files, missing)
+	}
+
+	// nor is it the first pattern found
+	files, missing = cat(&kvCfg{Files: []string{unreadable, filepath.Join(dir, "sshd_config")}, Any: true})
+	if len(files) != 1 || files["sshd_config"] == "" || missing != nil {
+		t.Errorf("unexpected any files %v, missing %v", files, missing)
+	}
+}
+
+// writeFiles writes the files of contents under dir.
+func writeFiles(t *testing.T, dir string, contents map[string]string) {
+	for name, content := range contents {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package kv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// The entries with changes set keep their previous result, and each new
+// result is diffed with it row by row. Rows are matched by the values of
+// their keys columns, or as a whole if the entry has no keys or if several
+// rows have the same keys. The files of cat entries are rows of their path
+// and sha256.
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+var (
+	changesPath    = kingpin.Flag("kv.changes.file", "File the last results and changes of the kv collectors with change detection are saved to, kv_changes.json under the install directory if unset.").Default("").String()
+	changesHistory = kingpin.Flag("kv.changes.history", "Number of changes kept per kv collector with change detection.").Default("100").Int()
+
+	changesTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "changes", "total"),
+		"envinfo: Total number of rows added, removed or changed between two results of a collector.",
+		[]string{"collector", "change"},
+		nil,
+	)
+	keyCollisionsTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "changes", "key_collisions_total"),
+		"envinfo: Total number of rows of a collector with the keys of another row of the same result.",
+		[]string{"collector"},
+		nil,
+	)
+
+	changesMtx  = sync.Mutex{}
+	changesFile = "" // set by LoadChanges, the changes are not saved if empty
+	changes     = make(map[string]*changeState)
+	changeCount = make(map[[2]string]uint64) // {collector, change}
+	collisions  = make(map[string]uint64)    // by collector
+)
+
+// Change is the difference between two results of a collector.
+type Change struct {
+	Collector string              `json:"collector"`
+	Time      time.Time           `json:"time"`
+	Added     []map[string]string `json:"added,omitempty"`
+	Removed   []map[string]string `json:"removed,omitempty"`
+	Changed   []RowChange         `json:"changed,omitempty"`
+}
+
+// RowChange is a row whose keys are the same in both results, but not the
+// other columns.
+type RowChange struct {
+	Before map[string]string `json:"before"`
+	After  map[string]string `json:"after"`
+}
+
+// changeState is the last result of a collector, and its last changes.
+type changeState struct {
+	At      time.Time           `json:"at"`
+	Rows    []map[string]string `json:"rows"`
+	Changes []*Change           `json:"changes"`
+}
+
+// LoadChanges loads the previous results and changes saved by the last run,
+// and saves them from then on. A missing file is not an error.
+func LoadChanges(dir string) error {
+	changesMtx.Lock()
+	defer changesMtx.Unlock()
+
+	file := *changesPath
+	if file == "" {
+		file = filepath.Join(dir, "kv_changes.json")
+	}
+	changesFile = file
+
+	j, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]*changeState
+	if err := json.Unmarshal(j, &saved); err != nil {
+		return fmt.Errorf("load kv changes %s failed: %s", file, err)
+	}
+	for name, state := range saved {
+		if state != nil {
+			changes[name] = state
+		}
+	}
+	return nil
+}
+
+// Changes returns the changes of collector, or of every collector if
+// empty, made after since, oldest first.
+func Changes(collector string, since time.Time) []*Change {
+	changesMtx.Lock()
+	defer changesMtx.Unlock()
+
+	res := []*Change{}
+	for name, state := range changes {
+		if collector != "" && name != collector {
+			continue
+		}
+		for _, c := range state.Changes {
+			if c.Time.After(since) {
+				res = append(res, c)
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if !res[i].Time.Equal(res[j].Time) {
+			return res[i].Time.Before(res[j].Time)
+		}
+		return res[i].Collector < res[j].Collector
+	})
+	return res
+}
+
+// recordChanges diffs res, a result of cfg started at begin, with the
+// previous one. Results of runs started before the previous one are
+// ignored, they are older.
+func recordChanges(cfg *kvCfg, begin time.Time, res *kvResult) {
+	if !cfg.Changes {
+		return
+	}
+
+	rows, keys := res.rows, cfg.Keys
+	if cfg.Type == kvCollectorTypeCat {
+		keys = []string{"path"}
+		rows = make([]map[string]string, 0, len(res.files))
+		for _, f := range res.files {
+			sum := sha256.Sum256(f.content)
+			rows = append(rows, map[string]string{"path": f.path, "sha256": hex.EncodeToString(sum[:])})
+		}
+	}
+
+	changesMtx.Lock()
+	defer changesMtx.Unlock()
+
+	if _, n := keyRows(rows, keys); n > 0 {
+		collisions[cfg.SubSystem] += uint64(n)
+		log.Printf("[warn] %s: %d rows with the keys of another row, rows are matched as a whole", cfg.SubSystem, n)
+	}
+
+	state, ok := changes[cfg.SubSystem]
+	if ok && begin.Before(state.At) {
+		return
+	}
+	if !ok {
+		// the first result is the baseline
+		changes[cfg.SubSystem] = &changeState{At: begin, Rows: rows}
+		saveChanges()
+		return
+	}
+
+	state.At = begin
+	c := diffRows(state.Rows, rows, keys)
+	if c == nil {
+		return
+	}
+	state.Rows = rows
+
+	c.Collector, c.Time = cfg.SubSystem, time.Now()
+	state.Changes = append(state.Changes, c)
+	if n := len(state.Changes) - *changesHistory; n > 0 {
+		state.Changes = append([]*Change(nil), state.Changes[n:]...)
+	}
+
+	changeCount[[2]string{cfg.SubSystem, changeAdded}] += uint64(len(c.Added))
+	changeCount[[2]string{cfg.SubSystem, changeRemoved}] += uint64(len(c.Removed))
+	changeCount[[2]string{cfg.SubSystem, changeChanged}] += uint64(len(c.Changed))
+
+	log.Printf("[info] %s changed: %d added, %d removed, %d changed", cfg.SubSystem, len(c.Added), len(c.Removed), len(c.Changed))
+	saveChanges()
+}
+
+// diffRows returns the rows added, removed and changed from before to
+// after, nil if there are none. If several rows of a result have the same
+// keys, the rows are matched as a whole.
+func diffRows(before, after []map[string]string, keys []string) *Change {
+	b, nb := keyRows(before, keys)
+	a, na := keyRows(after, keys)
+	if nb > 0 || na > 0 {
+		b, _ = keyRows(before, nil)
+		a, _ = keyRows(after, nil)
+	}
+
+	c := &Change{}
+	for _, k := range sortedKeys(a) {
+		old, ok := b[k]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, a[k])
+		case !reflect.DeepEqual(old, a[k]):
+			c.Changed = append(c.Changed, RowChange{Before: old, After: a[k]})
+		}
+	}
+	for _, k := range sortedKeys(b) {
+		if _, ok := a[k]; !ok {
+			c.Removed = append(c.Removed, b[k])
+		}
+	}
+
+	if c.Added == nil && c.Removed == nil && c.Changed == nil {
+		return nil
+	}
+	return c
+}
+
+// keyRows indexes rows by the values of their keys columns, or by the
+// whole row without keys. It returns the number of rows with the keys of a
+// previous row, which are not indexed.
+func keyRows(rows []map[string]string, keys []string) (map[string]map[string]string, int) {
+	res := make(map[string]map[string]string, len(rows))
+	n := 0
+	for _, row := range rows {
+		var k []byte
+		if len(keys) == 0 {
+			k, _ = json.Marshal(row) // sorted by column
+		} else {
+			values := make([]string, len(keys))
+			for i, key := range keys {
+				values[i] = row[key]
+			}
+			k, _ = json.Marshal(values)
+		}
+		if _, ok := res[string(k)]; ok {
+			if len(keys) > 0 {
+				n++
+			}
+			continue
+		}
+		res[string(k)] = row
+	}
+	return res, n
+}
+
+func sortedKeys(m map[string]map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveChanges writes the changes to changesFile, changesMtx must be held.
+func saveChanges() {
+	if changesFile == "" {
+		return
+	}
+
+	j, err := json.Marshal(changes)
+	if err != nil {
+		log.Printf("[error] marshal kv changes failed: %s", err)
+		return
+	}
+
+	tmp := filepath.Join(filepath.Dir(changesFile), "."+filepath.Base(changesFile)+".tmp")
+	if err := ioutil.WriteFile(tmp, j, 0600); err != nil {
+		log.Printf("[error] save kv changes failed: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, changesFile); err != nil {
+		log.Printf("[error] save kv changes failed: %s", err)
+	}
+}
+
+func describeChanges(ch chan<- *prometheus.Desc) {
+	ch <- changesTotalDesc
+	ch <- keyCollisionsTotalDesc
+}
+
+// collectChanges exports the change counters of the collectors with change
+// detection.
+func collectChanges(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	changesMtx.Lock()
+	defer changesMtx.Unlock()
+
+	for name, c := range collectors {
+		kc, ok := c.(*kvCollector)
+		if !ok || !kc.cfg.Changes {
+			continue
+		}
+		for _, change := range []string{changeAdded, changeRemoved, changeChanged} {
+			ch <- prometheus.MustNewConstMetric(changesTotalDesc, prometheus.CounterValue, float64(changeCount[[2]string{name, change}]), name, change)
+		}
+		if len(kc.cfg.Keys) > 0 {
+			ch <- prometheus.MustNewConstMetric(keyCollisionsTotalDesc, prometheus.CounterValue, float64(collisions[name]), name)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffRows(t *testing.T) {
+	before := []map[string]string{
+		{"uid": "0", "username": "root", "shell": "/bin/bash"},
+		{"uid": "1000", "username": "alice", "shell": "/bin/bash"},
+		{"uid": "1001", "username": "bob", "shell": "/bin/bash"},
+	}
+	after := []map[string]string{
+		{"uid": "0", "username": "root", "shell": "/bin/bash"},
+		{"uid": "1000", "username": "alice", "shell": "/bin/zsh"},
+		{"uid": "1002", "username": "eve", "shell": "/bin/sh"},
+	}
+
+	want := &Change{
+		Added:   []map[string]string{after[2]},
+		Removed: []map[string]string{before[2]},
+		Changed: []RowChange{{Before: before[1], After: after[1]}},
+	}
+	if got := diffRows(before, after, []string{"uid"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	// without keys a changed row is removed and added
+	got := diffRows(before, after, nil)
+	if len(got.Added) != 2 || len(got.Removed) != 2 || got.Changed != nil {
+		t.Errorf("unexpected changes without keys %+v", got)
+	}
+
+	if got := diffRows(before, before, nil); got != nil {
+		t.Errorf("want no changes, got %+v", got)
+	}
+
+	// rows of the same keys are matched as a whole, none is lost
+	dup := append([]map[string]string{{"uid": "0", "username": "toor", "shell": "/bin/sh"}}, before...)
+	if _, n := keyRows(dup, []string{"uid"}); n != 1 {
+		t.Errorf("want 1 key collision, got %d", n)
+	}
+	got = diffRows(before, dup, []string{"uid"})
+	if want := []map[string]string{dup[0]}; got == nil || !reflect.DeepEqual(got.Added, want) || got.Removed != nil || got.Changed != nil {
+		t.Errorf("want %v added, got %+v", want, got)
+	}
+	got = diffRows(dup, before, []string{"uid"})
+	if want := []map[string]string{dup[0]}; got == nil || !reflect.DeepEqual(got.Removed, want) || got.Added != nil || got.Changed != nil {
+		t.Errorf("want %v removed, got %+v", want, got)
+	}
+}
+
+func TestRecordChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	*changesHistory = 10 // the flags are not parsed
+	if err := LoadChanges(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		changesFile = ""
+		changes = make(map[string]*changeState)
+	}()
+
+	cfg := &kvCfg{SubSystem: "ports", Changes: true, Keys: []string{"port"}}
+	begin := time.Now()
+	recordChanges(cfg, begin, &kvResult{rows: []map[string]string{{"port": "22"}}})
+	recordChanges(cfg, begin.Add(time.Second), &kvResult{rows: []map[string]string{{"port": "22"}, {"port": "80"}}})
+	// older than the last result
+	recordChanges(cfg, begin, &kvResult{rows: nil})
+
+	got := Changes("ports", time.Time{})
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Added, []map[string]string{{"port": "80"}}) {
+		t.Fatalf("unexpected changes %+v", got)
+	}
+
+	// the changes survive a restart
+	changes = make(map[string]*changeState)
+	if err := LoadChanges(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "kv_changes.json")); err != nil {
+		t.Fatal(err)
+	}
+	if got := Changes("", time.Time{}); len(got) != 1 || got[0].Collector != "ports" {
+		t.Errorf("unexpected loaded changes %+v", got)
+	}
+	if got := Changes("", time.Now()); len(got) != 0 {
+		t.Errorf("want no changes since now, got %+v", got)
+	}
+}
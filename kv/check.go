@@ -0,0 +1,190 @@
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/node_exporter/redact"
+)
+
+// Problem is a problem of the kv configure found by Check.
+type Problem struct {
+	// Path is the json path of the problem in the configure, such as
+	// ["kvs", 3, "type"], empty for the whole configure
+	Path    []interface{}
+	Warning bool
+	Msg     string
+}
+
+// Check reports every problem of the kv configure j, the entries of all the
+// platforms are checked.
+func Check(j []byte) []Problem {
+	var kvCfgs kvCfgs
+	if err := json.Unmarshal(j, &kvCfgs); err != nil {
+		return []Problem{{Msg: err.Error()}}
+	}
+
+	var problems []Problem
+	report := func(i int, field string, warning bool, format string, args ...interface{}) {
+		path := []interface{}{"kvs", i}
+		if field != "" {
+			path = append(path, field)
+		}
+		problems = append(problems, Problem{Path: path, Warning: warning, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	// the native tables of other platforms are not known here
+	checkNative := func(i int, kc *kvCfg) {
+		if kc.Table == "" {
+			report(i, "table", false, "table missing")
+		} else if kc.Platform == runtime.GOOS {
+			if err := checkNativeTable(kc.Table); err != nil {
+				report(i, "table", false, "%s", err)
+			}
+		}
+		for j, f := range kc.Filters {
+			if f == nil || f.Column == "" {
+				report(i, "filters", false, "filter %d: column missing", j)
+			}
+		}
+	}
+
+	// platforms of each sub_system
+	platforms := map[string]map[string]bool{}
+
+	for i, kc := range kvCfgs.Kvs {
+		if kc.SubSystem == "" {
+			report(i, "sub_system", false, "sub_system missing")
+		} else if !model.IsValidMetricName(model.LabelValue(namespace + "_" + kc.SubSystem)) {
+			report(i, "sub_system", false, "invalid sub_system %q", kc.SubSystem)
+		}
+
+		switch kc.Platform {
+		case kvPlatformLinux, kvPlatformWindows:
+		case "":
+			report(i, "platform", true, "platform missing, the entry is never collected")
+		default:
+			report(i, "platform", true, "unknown platform %q", kc.Platform)
+		}
+
+		// the same sub_system may be collected on each platform, the
+		// duplicates of other platforms are not found by Init
+		if platforms[kc.SubSystem] == nil {
+			platforms[kc.SubSystem] = map[string]bool{}
+		}
+		if platforms[kc.SubSystem][kc.Platform] {
+			report(i, "sub_system", false, "duplicate sub_system %q on platform %s", kc.SubSystem, kc.Platform)
+		}
+		platforms[kc.SubSystem][kc.Platform] = true
+
+		switch kc.Type {
+		case kvCollectorTypeCat:
+			if field, err := kc.parseCat(); err != nil {
+				report(i, field, false, "%s", err)
+			}
+		case kvCollectorTypeOSQuery:
+			if err := checkSQL(kc.SQL); err != nil {
+				report(i, "sql", false, "malformed sql: %s", err)
+			}
+			if field, err := kc.parseMaxOutput(); err != nil {
+				report(i, field, false, "%s", err)
+			}
+			if kc.Table != "" {
+				checkNative(i, kc)
+			}
+		case kvCollectorTypeNative:
+			checkNative(i, kc)
+		case kvCollectorTypeExec:
+			if field, err := kc.parseExec(); err != nil {
+				report(i, field, false, "%s", err)
+			}
+		default:
+			report(i, "type", false, "unsupported type %q", kc.Type)
+		}
+
+		for _, tag := range kc.Tags {
+			if !model.LabelName(tag).IsValid() {
+				report(i, "tags", false, "invalid tag %q", tag)
+			} else if IsForbidTag(tag) {
+				report(i, "tags", true, "tag %q is reserved, exported as %q", tag, TuneTag(tag))
+			}
+		}
+
+		if err := kc.parseDurations(); err != nil {
+			report(i, err.field, false, "%s", err)
+		}
+
+		if err := kc.checkKeys(); err != nil {
+			report(i, "keys", false, "%s", err)
+		}
+		if len(kc.Keys) > 0 && !kc.Changes {
+			report(i, "keys", true, "keys without changes, they are not used")
+		}
+
+		if err := kc.parseSchema(); err != nil {
+			report(i, "schema", false, "%s", err)
+		}
+
+		if err := kc.parseRedact(); err != nil {
+			report(i, "redact", false, "%s", err)
+		}
+		for _, r := range kc.Redact {
+			if r == nil || r.Action != redact.ActionDrop {
+				continue
+			}
+			for _, c := range r.Columns {
+				if contains(kc.Keys, c) {
+					report(i, "redact", true, "key %q dropped by a redact rule", c)
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkSQL does basic checks of an osquery statement, it is not parsed.
+func checkSQL(sql string) error {
+	sql = strings.TrimSpace(sql)
+	if sql == "" {
+		return fmt.Errorf("sql missing")
+	}
+
+	fields := strings.Fields(sql)
+	switch strings.ToLower(fields[0]) {
+	case "select", "with":
+	default:
+		return fmt.Errorf("not a query: %s", fields[0])
+	}
+
+	var quote rune
+	depth := 0
+	for _, c := range sql {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced parentheses")
+			}
+		}
+	}
+
+	if quote != 0 {
+		return fmt.Errorf("unterminated string")
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced parentheses")
+	}
+	return nil
+}
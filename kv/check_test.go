@@ -0,0 +1,50 @@
+package kv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	j := []byte(`{"kvs": [
+		{"sub_system": "users", "platform": "linux", "type": "osquery", "sql": "select * from users", "tags": ["json"]},
+		{"sub_system": "users", "platform": "windows", "type": "osquery", "sql": "select * from users"},
+		{"sub_system": "users", "platform": "linux", "type": "osquery", "sql": "select * from (users"},
+		{"sub_system": "hosts", "platform": "linux", "type": "sql", "tags": ["job"]}
+	]}`)
+
+	want := map[string]bool{
+		"[kvs 2 sub_system] false": true,
+		"[kvs 2 sql] false":        true,
+		"[kvs 3 type] false":       true,
+		"[kvs 3 tags] true":        true,
+	}
+
+	problems := Check(j)
+	for _, p := range problems {
+		key := fmt.Sprintf("%v %v", p.Path, p.Warning)
+		if !want[key] {
+			t.Errorf("unexpected problem %s: %s", key, p.Msg)
+		}
+		delete(want, key)
+	}
+	for key := range want {
+		t.Errorf("missing problem %s", key)
+	}
+}
+
+func TestCheckSQL(t *testing.T) {
+	for sql, ok := range map[string]bool{
+		"select * from users":                     true,
+		"SELECT name FROM users WHERE uid IN (0)": true,
+		"select ')' from users":                   true,
+		"":                                        false,
+		"drop table users":                        false,
+		"select * from users where (uid = 1":      false,
+		"select * from users where name = 'root":  false,
+	} {
+		if err := checkSQL(sql); (err == nil) != ok {
+			t.Errorf("%q: unexpected result %v", sql, err)
+		}
+	}
+}
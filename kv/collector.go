@@ -1,33 +1,60 @@
 package kv
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os/exec"
+	"net"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/rtpanic"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 const namespace = "kv_node"
 
-type queryResult struct {
-	rawJson    string
-	formatJson []map[string]string
+// Format is the output format of the kv collectors.
+type Format string
+
+const (
+	// FormatLabels exports a series per row, with a label per column
+	FormatLabels Format = "labels"
+	// FormatBase64 exports a series per collector, with the rows in json
+	// encoded in base64 as the value of its tag
+	FormatBase64 Format = "base64"
+	// FormatJSON is a json document of the rows of every collector, see
+	// Document
+	FormatJSON Format = "json"
+)
+
+// ParseFormat parses the name of a format.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatLabels, FormatBase64, FormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q", s)
 }
 
 var (
 	OSQuerydPath = ""
-	// run osquery:  ./osqueryd -S --json 'select * from users'
-	//   -S: run as shell mode
-	//   --json: output result in json format
 
-	factories      = make(map[string]func(*kvCfg) (Collector, error))
-	collectorState = make(map[string]bool)
-	factoryArgs    = make(map[string]*kvCfg)
+	factories        = make(map[string]func(*kvCfg, Format) (Collector, error))
+	collectorState   = make(map[string]*bool)
+	forcedCollectors = make(map[string]bool)
+	factoryArgs      = make(map[string]*kvCfg)
+	flagStates       = make(map[string]*bool) // values of the --[no-]kv.collector.<name> flags
+
+	// collectorStateMtx guards collectorState, factories and factoryArgs,
+	// which can be changed at runtime by SetCollector and ApplyConfig
+	collectorStateMtx = sync.RWMutex{}
+
+	// allEnabled is set by EnableAllCollectors, collectors added by
+	// ApplyConfig are enabled then
+	allEnabled = false
 
 	scrapeDurationDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "scrape", "collector_duration_seconds"),
@@ -37,36 +64,176 @@ var (
 	)
 	scrapeSuccessDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "scrape", "collector_success"),
-		"envinfo: Whether a collector succeeded.",
+		"envinfo: Whether a collector succeeded, 0 if it failed or panicked.",
 		[]string{"collector"},
 		nil,
 	)
+	scrapePanicsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_panics_total"),
+		"envinfo: Total number of collector scrapes which panicked.",
+		[]string{"collector"},
+		nil,
+	)
+
+	scrapeQueueWaitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_queue_wait_seconds"),
+		"envinfo: Time a collector waited for a free worker before it started.",
+		[]string{"collector"},
+		nil,
+	)
+
+	maxConcurrency = kingpin.Flag("kv.max-concurrency", "Maximum number of kv collectors running at once during a scrape, 0 runs all of them at once.").Default("4").Int()
+
+	panicsMtx = sync.Mutex{}
+	panics    = make(map[string]uint64)
 )
 
 type Collector interface {
 	Update(ch chan<- prometheus.Metric) error
 }
 
-func registerCollector(collector string, isDefaultEnabled bool, factory func(*kvCfg) (Collector, error), arg *kvCfg) {
-	collectorState[collector] = isDefaultEnabled
+func registerCollector(collector string, isDefaultEnabled bool, factory func(*kvCfg, Format) (Collector, error), arg *kvCfg) error {
+	if _, ok := factories[collector]; ok {
+		return fmt.Errorf("duplicate collector: %s", collector)
+	}
+
+	var helpDefaultState string
+	if isDefaultEnabled {
+		helpDefaultState = "enabled"
+	} else {
+		helpDefaultState = "disabled"
+	}
+
+	flagName := fmt.Sprintf("kv.collector.%s", collector)
+	flagHelp := fmt.Sprintf("Enable the %s kv collector (default: %s).", collector, helpDefaultState)
+	defaultValue := fmt.Sprintf("%v", isDefaultEnabled)
+
+	flag := kingpin.Flag(flagName, flagHelp).Default(defaultValue).Action(collectorFlagAction(collector)).Bool()
+	collectorState[collector] = flag
+	flagStates[collector] = flag
+
 	factories[collector] = factory
 	if arg != nil {
 		factoryArgs[collector] = arg
 	}
+	return nil
+}
+
+// collectorFlagAction records that the collector has been explicitly enabled
+// or disabled from the command line.
+func collectorFlagAction(collector string) func(ctx *kingpin.ParseContext) error {
+	return func(ctx *kingpin.ParseContext) error {
+		forcedCollectors[collector] = true
+		return nil
+	}
+}
+
+// ListAllCollectors returns the enabled state of every registered collector.
+func ListAllCollectors() map[string]bool {
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
+	res := make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		res[name] = *enabled
+	}
+	return res
+}
+
+// SetCollector enables or disables a registered collector. It only affects
+// collectors created afterwards.
+func SetCollector(collector string, isEnabled bool) error {
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	if _, ok := collectorState[collector]; !ok {
+		return fmt.Errorf("missing collector: %s", collector)
+	}
+
+	*collectorState[collector] = isEnabled
+	return nil
+}
+
+// EnableAllCollectors enables every collector that has not been explicitly
+// disabled by a --no-kv.collector.<name> flag.
+func EnableAllCollectors() {
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	allEnabled = true
+	for collector, enabled := range collectorState {
+		if !forcedCollectors[collector] {
+			*enabled = true
+		}
+	}
+}
+
+// ApplyConfig replaces the kv collectors with the ones of the kv configure
+// j. Collectors keep their --[no-]kv.collector.<name> flag if they have
+// one. It returns a function restoring the previous collectors if applying
+// the rest of the config fails.
+func ApplyConfig(j []byte) (func(), error) {
+	kcs, err := parseConfig(j)
+	if err != nil {
+		return nil, err
+	}
+
+	collectorStateMtx.Lock()
+	defer collectorStateMtx.Unlock()
+
+	oldFactories, oldState, oldArgs := factories, collectorState, factoryArgs
+	oldEnabled := make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		oldEnabled[name] = *enabled
+	}
+
+	factories = make(map[string]func(*kvCfg, Format) (Collector, error))
+	collectorState = make(map[string]*bool)
+	factoryArgs = make(map[string]*kvCfg)
+
+	for _, kc := range kcs {
+		// reuse the flag value of collectors registered at startup
+		enabled, ok := flagStates[kc.SubSystem]
+		if !ok {
+			enabled = new(bool)
+		}
+		if !forcedCollectors[kc.SubSystem] {
+			*enabled = kc.Enabled || allEnabled
+		}
+
+		factories[kc.SubSystem] = NewNodeCollector
+		collectorState[kc.SubSystem] = enabled
+		factoryArgs[kc.SubSystem] = kc
+	}
+
+	return func() {
+		collectorStateMtx.Lock()
+		defer collectorStateMtx.Unlock()
+
+		factories, collectorState, factoryArgs = oldFactories, oldState, oldArgs
+		for name, enabled := range oldEnabled {
+			*collectorState[name] = enabled
+		}
+	}, nil
 }
 
 type KvCollector struct {
 	Collectors map[string]Collector
 }
 
-func NewKvCollector(filters ...string) (*KvCollector, error) {
+// NewKvCollector creates the enabled collectors, or the ones of filters,
+// exporting their metrics in format.
+func NewKvCollector(format Format, filters ...string) (*KvCollector, error) {
+	collectorStateMtx.RLock()
+	defer collectorStateMtx.RUnlock()
+
 	f := make(map[string]bool)
 	for _, filter := range filters {
 		enabled, exist := collectorState[filter]
 		if !exist {
 			return nil, fmt.Errorf("missing collector: %s", filter)
 		}
-		if !enabled {
+		if !*enabled {
 			return nil, fmt.Errorf("disabled collector: %s", filter)
 		}
 		f[filter] = true
@@ -74,8 +241,8 @@ func NewKvCollector(filters ...string) (*KvCollector, error) {
 
 	collectors := make(map[string]Collector)
 	for key, enabled := range collectorState {
-		if enabled {
-			collector, err := factories[key](factoryArgs[key]) // call NewxxxCollector()
+		if *enabled {
+			collector, err := factories[key](factoryArgs[key], format) // call NewxxxCollector()
 			if err != nil {
 				continue
 			}
@@ -90,64 +257,390 @@ func NewKvCollector(filters ...string) (*KvCollector, error) {
 func (c KvCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- scrapeDurationDesc
 	ch <- scrapeSuccessDesc
+	ch <- scrapePanicsDesc
+	ch <- scrapeQueueWaitDesc
+	describeCache(ch)
+	describeChanges(ch)
+	describeRedactions(ch)
+	describeOSQueryd(ch)
+	describeExec(ch)
 }
 
 func (c KvCollector) Collect(ch chan<- prometheus.Metric) {
-	wg := sync.WaitGroup{}
-	wg.Add(len(c.Collectors))
-
 	// log.Printf("[debug] envinfo try collect...")
 
-	for name, _c := range c.Collectors {
-		go func(name string, ec Collector) {
-			execute(name, ec, ch)
-			wg.Done()
-		}(name, _c)
+	collectQueued(c.Collectors, ch)
+
+	collectStats(c.Collectors, ch)
+}
+
+// collectStats exports the metrics about the collectors besides their
+// results.
+func collectStats(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	collectPanics(collectors, ch)
+
+	collectChanges(collectors, ch)
+
+	collectRedactions(collectors, ch)
+
+	collectOSQueryd(ch)
+
+	collectExec(collectors, ch)
+}
+
+// prioritized is implemented by collectors with a configured priority,
+// lower priorities run first.
+type prioritized interface {
+	priority() int
+}
+
+func priorityOf(c Collector) int {
+	if p, ok := c.(prioritized); ok {
+		return p.priority()
+	}
+	return 0
+}
+
+// collectQueued runs the collectors in order on at most maxConcurrency
+// workers.
+func collectQueued(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	begin := time.Now()
+	runQueued(collectors, func(name string, c Collector) {
+		ch <- prometheus.MustNewConstMetric(scrapeQueueWaitDesc, prometheus.GaugeValue, time.Since(begin).Seconds(), name)
+		execute(name, c, ch)
+	})
+}
+
+// runQueued calls run for each collector, in order of priority, on at most
+// maxConcurrency workers.
+func runQueued(collectors map[string]Collector, run func(name string, c Collector)) {
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := priorityOf(collectors[names[i]]), priorityOf(collectors[names[j]])
+		if pi != pj {
+			return pi < pj
+		}
+		return names[i] < names[j]
+	})
+
+	queue := make(chan string, len(names))
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
+
+	nworkers := len(names)
+	if *maxConcurrency > 0 && *maxConcurrency < nworkers {
+		nworkers = *maxConcurrency
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(nworkers)
+
+	for i := 0; i < nworkers; i++ {
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				run(name, collectors[name])
+			}
+		}()
 	}
 	wg.Wait()
 }
 
+// Fetched are the results of one run of the collectors, exported in each
+// format by the collector of Collector, so that the formats share the run.
+type Fetched struct {
+	collectors map[string]Collector
+	results    map[string]*fetchResult
+}
+
+type fetchResult struct {
+	res      *kvResult
+	age      time.Duration
+	stale    bool
+	err      error
+	wait     time.Duration // time queued before the run
+	duration time.Duration
+}
+
+// Fetch runs the collectors once.
+func (c KvCollector) Fetch() *Fetched {
+	mtx := sync.Mutex{}
+	f := &Fetched{
+		collectors: c.Collectors,
+		results:    make(map[string]*fetchResult, len(c.Collectors)),
+	}
+
+	begin := time.Now()
+	runQueued(c.Collectors, func(name string, c Collector) {
+		r := &fetchResult{wait: time.Since(begin)}
+		start := time.Now()
+		r.res, r.age, r.stale, r.err = fetchRecovered(name, c)
+		r.duration = time.Since(start)
+		if r.err != nil {
+			log.Printf("[error] collector %s failed after %fs: %s", name, r.duration.Seconds(), r.err)
+		}
+
+		mtx.Lock()
+		f.results[name] = r
+		mtx.Unlock()
+	})
+	return f
+}
+
+// fetchRecovered fetches the result of c, a panic is returned as an error.
+func fetchRecovered(name string, c Collector) (res *kvResult, age time.Duration, stale bool, err error) {
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		panicsMtx.Lock()
+		panics[name]++
+		panicsMtx.Unlock()
+
+		err = fmt.Errorf("panic: %s", perr)
+	})
+
+	kc, ok := c.(*kvCollector)
+	if !ok {
+		return nil, 0, false, fmt.Errorf("not a kv collector")
+	}
+	return kc.fetch()
+}
+
+// Collector returns the collector exporting f in format, like a
+// KvCollector of format.
+func (f *Fetched) Collector(format Format) prometheus.Collector {
+	return &fetchedCollector{fetched: f, format: format}
+}
+
+type fetchedCollector struct {
+	fetched *Fetched
+	format  Format
+}
+
+func (c *fetchedCollector) Describe(ch chan<- *prometheus.Desc) {
+	KvCollector{}.Describe(ch)
+}
+
+func (c *fetchedCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, r := range c.fetched.results {
+		ch <- prometheus.MustNewConstMetric(scrapeQueueWaitDesc, prometheus.GaugeValue, r.wait.Seconds(), name)
+
+		err := renderRecovered(name, c.fetched.collectors[name], ch, c.format, r)
+
+		var success float64
+		if err == nil {
+			success = 1
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, r.duration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, name)
+	}
+
+	collectStats(c.fetched.collectors, ch)
+}
+
+// renderRecovered exports r, the result of c, in format. A panic is
+// returned as an error.
+func renderRecovered(name string, c Collector, ch chan<- prometheus.Metric, format Format, r *fetchResult) (err error) {
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		panicsMtx.Lock()
+		panics[name]++
+		panicsMtx.Unlock()
+
+		err = fmt.Errorf("panic: %s", perr)
+	})
+
+	kc, ok := c.(*kvCollector)
+	if !ok {
+		return r.err
+	}
+	err = kc.render(ch, format, r.res, r.age, r.stale, r.err)
+	if err != nil && r.err == nil {
+		// the errors of the fetch are logged by Fetch
+		log.Printf("[error] collector %s failed: %s", name, err)
+	}
+	return err
+}
+
+// DocumentEntry is the result of a collector in the json document of
+// FormatJSON.
+type DocumentEntry struct {
+	Type string `json:"type"`
+	// Rows are the rows of the osquery and native collectors
+	Rows interface{} `json:"rows,omitempty"`
+	// Files are the contents of the files of the cat collectors, by path
+	Files map[string]string `json:"files,omitempty"`
+	// Missing are the files of the cat collectors not found or unreadable
+	Missing []string `json:"missing,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	// AgeSeconds and Stale are set for the collectors with an interval, see
+	// the kv_node_cache_* metrics
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+	Stale      bool     `json:"stale,omitempty"`
+	// Labels are the labels the series of the collector would have in the
+	// base64 format, without its tags, set by the handler
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Document runs the collectors and returns their results by collector.
+func (c KvCollector) Document() map[string]*DocumentEntry {
+	mtx := sync.Mutex{}
+	res := make(map[string]*DocumentEntry, len(c.Collectors))
+
+	runQueued(c.Collectors, func(name string, c Collector) {
+		e := document(name, c)
+		mtx.Lock()
+		res[name] = e
+		mtx.Unlock()
+	})
+	return res
+}
+
+func document(name string, c Collector) (e *DocumentEntry) {
+	kc, ok := c.(*kvCollector)
+	if !ok {
+		return &DocumentEntry{Error: "not a kv collector"}
+	}
+
+	e = &DocumentEntry{Type: kc.cfg.Type}
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		panicsMtx.Lock()
+		panics[name]++
+		panicsMtx.Unlock()
+
+		e.Error = fmt.Sprintf("panic: %s", perr)
+	})
+
+	res, age, stale, err := kc.fetch()
+	if kc.cfg.interval > 0 && (err == nil || stale) {
+		seconds := age.Seconds()
+		e.AgeSeconds, e.Stale = &seconds, stale
+	}
+	if err == nil {
+		if kc.cfg.Type == kvCollectorTypeCat {
+			e.Files = make(map[string]string, len(res.files))
+			for _, f := range res.files {
+				e.Files[f.path] = string(f.content)
+			}
+			e.Missing = res.missing
+		} else {
+			rows := res.rows
+			if rows == nil {
+				rows = []map[string]string{}
+			}
+			e.Rows = rows
+		}
+	}
+
+	if err != nil {
+		log.Printf("[error] collector %s failed: %s", name, err)
+		e.Error = err.Error()
+	}
+	return e
+}
+
 func execute(name string, c Collector, ch chan<- prometheus.Metric) {
 	begin := time.Now()
-	err := c.Update(ch)
+	err := update(name, c, ch)
 	duration := time.Since(begin)
 
+	var success float64
 	if err != nil {
 		log.Printf("[error] collector %s failed after %fs: %s", name, duration.Seconds(), err)
+	} else {
+		success = 1
 	}
+
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, name)
 }
 
-func doCat(path string) (string, error) {
+// update calls the collector, a panic of the collector only fails its own
+// scrape and is returned as an error.
+func update(name string, c Collector, ch chan<- prometheus.Metric) (err error) {
+	defer rtpanic.Recover(nil, func(_ []byte, perr error) {
+		panicsMtx.Lock()
+		panics[name]++
+		panicsMtx.Unlock()
 
-	cmd := exec.Command(`cat`, []string{path}...)
+		err = fmt.Errorf("panic: %s", perr)
+	})
 
-	out, err := cmd.Output()
-	if err != nil {
-		return "", err
+	return c.Update(ch)
+}
+
+func collectPanics(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	panicsMtx.Lock()
+	defer panicsMtx.Unlock()
+
+	for name := range collectors {
+		ch <- prometheus.MustNewConstMetric(scrapePanicsDesc, prometheus.CounterValue, float64(panics[name]), name)
 	}
+}
 
-	res := base64.RawURLEncoding.EncodeToString(out)
+// doQuery runs the sql of kc on the osqueryd daemon if it is up, or on a
+// new osqueryd run in shell mode:  ./osqueryd -S --json 'select * from users'
+// The query is stopped after the timeout of kc, or
+// --kv.osqueryd.query-timeout. If the shell mode fails too, such as without
+// an osqueryd binary, the rows are read from the native table of kc if it
+// has one.
+func doQuery(kc *kvCfg) ([]map[string]string, error) {
+	timeout := queryTimeout(kc)
+
+	if d := daemon; d != nil && d.isUp() {
+		rows, err := thriftQuery(d.socket, kc.SQL, timeout)
+		countQuery(queryModeDaemon, err)
+		if err == nil {
+			return rows, nil
+		}
+
+		// the shell mode fails the same on a bad query, and would take as
+		// long on a slow one
+		if _, ok := err.(*osqueryStatusError); ok {
+			return nil, err
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, fmt.Errorf("osqueryd query timed out after %v", timeout)
+		}
+		log.Printf("[warn] osqueryd query failed: %s, fall back to shell mode", err)
+	}
 
-	return res, nil
+	rows, err := shellQuery(kc, timeout)
+	countQuery(queryModeShell, err)
+	if err != nil && kc.Table != "" {
+		log.Printf("[warn] %s: osquery failed: %s, fall back to the native table %s", kc.SubSystem, err, kc.Table)
+		rows, err = doNative(kc, timeout)
+		countQuery(queryModeNative, err)
+	}
+	return rows, err
 }
 
-func doQuery(sql string) (*queryResult, error) {
-	cmd := exec.Command(OSQuerydPath, []string{`-S`, `--json`, sql}...)
+// queryTimeout returns the timeout of the osquery and native entry kc,
+// --kv.osqueryd.query-timeout by default.
+func queryTimeout(kc *kvCfg) time.Duration {
+	if kc.timeout > 0 {
+		return kc.timeout
+	}
+	return *osquerydQueryTimeout
+}
 
-	out, err := cmd.Output()
+func shellQuery(kc *kvCfg, timeout time.Duration) ([]map[string]string, error) {
+	out, err := (&command{
+		collector: kc.SubSystem,
+		path:      OSQuerydPath,
+		args:      []string{`-S`, `--json`, kc.SQL},
+		timeout:   timeout,
+		maxOutput: maxOutputOf(kc),
+	}).run()
 	if err != nil {
 		return nil, err
 	}
 
-	var res queryResult
-	if !JsonFormat {
-		err = json.Unmarshal(out, &res.formatJson)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		res.rawJson = base64.RawURLEncoding.EncodeToString(out)
+	var rows []map[string]string
+	if err := json.Unmarshal(out, &rows); err != nil {
+		return nil, err
 	}
-
-	return &res, nil
+	return rows, nil
 }
@@ -0,0 +1,116 @@
+package kv
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type funcCollector func(ch chan<- prometheus.Metric) error
+
+func (f funcCollector) Update(ch chan<- prometheus.Metric) error {
+	return f(ch)
+}
+
+func TestExecuteSuccess(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		update  funcCollector
+		success float64
+		panics  uint64
+	}{
+		{"execute_ok", func(chan<- prometheus.Metric) error { return nil }, 1, 0},
+		{"execute_error", func(chan<- prometheus.Metric) error { return errors.New("failed") }, 0, 0},
+		{"execute_panic", func(chan<- prometheus.Metric) error { panic("unknown metric type") }, 0, 1},
+	} {
+		ch := make(chan prometheus.Metric, 10)
+		execute(c.name, c.update, ch)
+		close(ch)
+
+		found := false
+		for m := range ch {
+			if m.Desc() != scrapeSuccessDesc {
+				continue
+			}
+			var pb dto.Metric
+			m.Write(&pb)
+			if got := pb.GetGauge().GetValue(); got != c.success {
+				t.Errorf("%s: want success %v, got %v", c.name, c.success, got)
+			}
+			found = true
+		}
+		if !found {
+			t.Errorf("%s: want a success metric", c.name)
+		}
+
+		panicsMtx.Lock()
+		if panics[c.name] != c.panics {
+			t.Errorf("%s: want %d panics, got %d", c.name, c.panics, panics[c.name])
+		}
+		panicsMtx.Unlock()
+	}
+}
+
+func TestFetchedFormats(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+
+	cfg := &kvCfg{SubSystem: "fetched", Type: kvCollectorTypeExec, Command: "sh", Args: []string{"-c", "echo >>" + runs + "; echo name=kv"}, Parser: "kv", Tags: []string{"kv"}}
+	if _, err := cfg.parseExec(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.parseDurations(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewNodeCollector(cfg, FormatBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := KvCollector{Collectors: map[string]Collector{"fetched": c}}.Fetch()
+	for _, format := range []Format{FormatLabels, FormatBase64} {
+		r := prometheus.NewRegistry()
+		if err := r.Register(fetched.Collector(format)); err != nil {
+			t.Fatal(err)
+		}
+		mfs, err := r.Gather()
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		var success, series bool
+		for _, mf := range mfs {
+			switch mf.GetName() {
+			case "kv_node_scrape_collector_success":
+				success = mf.GetMetric()[0].GetGauge().GetValue() == 1
+			case "kv_node_fetched":
+				series = true
+			}
+		}
+		if !success || !series {
+			t.Errorf("%s: want a successful fetched series, got %v", format, mfs)
+		}
+	}
+
+	out, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 {
+		t.Errorf("want the command run once, got %d runs", len(out))
+	}
+}
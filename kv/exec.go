@@ -0,0 +1,179 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// exec entries run a command and parse its output into rows, with one of
+// the parsers:
+//
+//	raw:   a single row {"output": <stdout>}
+//	json:  an object, or an array of objects, one row each
+//	kv:    lines of key=value, records separated by blank lines
+//	regex: a row per match of regex, with a column per named group
+const (
+	execParserRaw   = "raw"
+	execParserJSON  = "json"
+	execParserKV    = "kv"
+	execParserRegex = "regex"
+
+	execDefaultTimeout = 30 * time.Second
+)
+
+// parseExec checks the exec settings of kc.
+func (kc *kvCfg) parseExec() (string, error) {
+	if kc.Command == "" {
+		return "command", fmt.Errorf("command missing")
+	}
+
+	switch kc.Parser {
+	case "", execParserRaw, execParserJSON, execParserKV:
+		if kc.Regex != "" {
+			return "regex", fmt.Errorf("regex set for parser %q", kc.Parser)
+		}
+	case execParserRegex:
+		re, err := regexp.Compile(kc.Regex)
+		if err != nil {
+			return "regex", fmt.Errorf("invalid regex: %s", err)
+		}
+		named := false
+		for _, name := range re.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return "regex", fmt.Errorf("regex without named group")
+		}
+		kc.re = re
+	default:
+		return "parser", fmt.Errorf("unknown parser %q", kc.Parser)
+	}
+
+	for _, e := range kc.Env {
+		if !strings.Contains(e, "=") {
+			return "env", fmt.Errorf("invalid env %q, want KEY=value", e)
+		}
+	}
+
+	return kc.parseMaxOutput()
+}
+
+// doExec runs the command of kc and parses its output.
+func doExec(kc *kvCfg) ([]map[string]string, error) {
+	timeout := kc.timeout
+	if timeout <= 0 {
+		timeout = execDefaultTimeout
+	}
+
+	out, err := (&command{
+		collector: kc.SubSystem,
+		path:      kc.Command,
+		args:      kc.Args,
+		env:       kc.Env,
+		dir:       kc.Dir,
+		timeout:   timeout,
+		maxOutput: maxOutputOf(kc),
+	}).run()
+	if err != nil {
+		return nil, err
+	}
+	return parseOutput(kc.Parser, kc.re, out)
+}
+
+func parseOutput(parser string, re *regexp.Regexp, out []byte) ([]map[string]string, error) {
+	switch parser {
+	case "", execParserRaw:
+		return []map[string]string{{"output": string(out)}}, nil
+	case execParserJSON:
+		return parseJSONRows(out)
+	case execParserKV:
+		return parseKVRows(out)
+	case execParserRegex:
+		return parseRegexRows(re, out), nil
+	}
+	return nil, fmt.Errorf("unknown parser %q", parser)
+}
+
+// parseJSONRows parses an object or an array of objects, values which are
+// not strings are kept in json, null is empty.
+func parseJSONRows(out []byte) ([]map[string]string, error) {
+	out = bytes.TrimSpace(out)
+
+	var objects []map[string]json.RawMessage
+	if len(out) > 0 && out[0] == '{' {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(out, &object); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	} else if err := json.Unmarshal(out, &objects); err != nil {
+		return nil, err
+	}
+
+	rows := make([]map[string]string, 0, len(objects))
+	for _, object := range objects {
+		row := make(map[string]string, len(object))
+		for k, v := range object {
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				s = string(v)
+			}
+			row[k] = s
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseKVRows parses lines of key=value, or key: value. Blank lines end a
+// row, lines starting with # are skipped.
+func parseKVRows(out []byte) ([]map[string]string, error) {
+	var rows []map[string]string
+	row := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, len(out)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			if len(row) > 0 {
+				rows = append(rows, row)
+				row = map[string]string{}
+			}
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+
+		i := strings.IndexAny(line, "=:")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid line %q, want key=value", line)
+		}
+		row[strings.TrimSpace(line[:i])] = strings.Trim(strings.TrimSpace(line[i+1:]), `"`)
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+func parseRegexRows(re *regexp.Regexp, out []byte) []map[string]string {
+	var rows []map[string]string
+	names := re.SubexpNames()
+	for _, m := range re.FindAllSubmatch(out, -1) {
+		row := map[string]string{}
+		for i, name := range names {
+			if name != "" {
+				row[name] = string(m[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	for _, c := range []struct {
+		parser string
+		regex  string
+		out    string
+		want   []map[string]string
+	}{
+		{"", "", "hello\n", []map[string]string{{"output": "hello\n"}}},
+		{"json", "", `{"name": "sshd", "pid": 812, "up": true}`, []map[string]string{{"name": "sshd", "pid": "812", "up": "true"}}},
+		{"json", "", `[{"a": "1"}, {"a": "2", "b": null}]`, []map[string]string{{"a": "1"}, {"a": "2", "b": ""}}},
+		{"kv", "", "# pending upgrades\norigin=Ubuntu\narch: amd64\n\norigin = \"Docker\"\narch=amd64\n", []map[string]string{
+			{"origin": "Ubuntu", "arch": "amd64"},
+			{"origin": "Docker", "arch": "amd64"},
+		}},
+		{"regex", `(?m)^Inst (?P<package>\S+) \[(?P<from>[^\]]+)\]`, "Inst libc6 [2.27-3] (2.27-3ubuntu1 Ubuntu)\nConf libc6\nInst tzdata [2018e-0] (2018g-0)\n", []map[string]string{
+			{"package": "libc6", "from": "2.27-3"},
+			{"package": "tzdata", "from": "2018e-0"},
+		}},
+	} {
+		var re *regexp.Regexp
+		if c.regex != "" {
+			re = regexp.MustCompile(c.regex)
+		}
+		got, err := parseOutput(c.parser, re, []byte(c.out))
+		if err != nil {
+			t.Errorf("%s: %s", c.parser, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want %v, got %v", c.parser, c.want, got)
+		}
+	}
+
+	if _, err := parseOutput("kv", nil, []byte("no separator")); err == nil {
+		t.Errorf("want an error on a line without separator")
+	}
+}
+
+func TestDoExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+
+	run := func(cfg *kvCfg) ([]map[string]string, error) {
+		cfg.Type, cfg.Command = kvCollectorTypeExec, "sh"
+		if _, err := cfg.parseExec(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.parseDurations(); err != nil {
+			t.Fatal(err)
+		}
+		return doExec(cfg)
+	}
+
+	rows, err := run(&kvCfg{Args: []string{"-c", "echo name=$NAME; echo dir=$(pwd)"}, Env: []string{"NAME=kv"}, Dir: "/", Parser: "kv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []map[string]string{{"name": "kv", "dir": "/"}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("want %v, got %v", want, rows)
+	}
+}
+
+func TestDoExecErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+
+	for _, c := range []struct {
+		cfg  kvCfg
+		want string
+	}{
+		{kvCfg{Args: []string{"-c", "echo oops >&2; exit 3"}}, "exit status 3: oops"},
+		{kvCfg{Args: []string{"-c", "sleep 5"}, Timeout: "100ms"}, "timed out after 100ms"},
+		{kvCfg{Args: []string{"-c", "yes | head -c 2048"}, MaxOutput: "1KB"}, "output larger than 1024 bytes"},
+	} {
+		cfg := c.cfg
+		cfg.Type, cfg.Command = kvCollectorTypeExec, "sh"
+		cfg.parseExec()
+		cfg.parseDurations()
+
+		_, err := doExec(&cfg)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: want error %q, got %v", cfg.Args, c.want, err)
+		}
+	}
+}
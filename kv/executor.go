@@ -0,0 +1,304 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// The commands of the kv entries, exec entries and osqueryd in shell mode,
+// are run by command.run: in their own process group, killed as a whole on
+// timeout or once their output is over its limit, with their stderr in the
+// error of a failed run. On Linux the process group is killed after a
+// normal exit too, its children left in the background would outlive the
+// command: the command is not reaped yet then, so the group is still its
+// own.
+
+const execStderrMax = 4096
+
+// execKillGrace is how long a killed command is waited for, a child out of
+// its process group may keep its output open
+var execKillGrace = 2 * time.Second
+
+var (
+	execMaxOutput = kingpin.Flag("kv.max-output", "Default maximum output of the commands run by kv entries, exec entries and osqueryd in shell mode, 0 for no limit.").Default("16MB").Bytes()
+
+	execDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exec", "duration_seconds"),
+		"envinfo: Duration of the last command run by a collector.",
+		[]string{"collector"},
+		nil,
+	)
+	execTimeoutsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exec", "timeouts_total"),
+		"envinfo: Total number of commands of a collector killed by its timeout.",
+		[]string{"collector"},
+		nil,
+	)
+	execKillFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exec", "kill_failures_total"),
+		"envinfo: Total number of killed commands of a collector whose output was still open after the kill grace period.",
+		[]string{"collector"},
+		nil,
+	)
+	execExitCodeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exec", "exit_code"),
+		"envinfo: Exit code of the last command run by a collector, -1 if it was killed or did not start.",
+		[]string{"collector"},
+		nil,
+	)
+
+	execStatsMtx = sync.Mutex{}
+	execStats    = make(map[string]*execStat) // by collector
+)
+
+type execStat struct {
+	duration     time.Duration
+	timeouts     uint64
+	killFailures uint64
+	exitCode     int
+}
+
+// command is a command run for a collector.
+type command struct {
+	collector string
+	path      string
+	args      []string
+	env       []string // added to the environment of the exporter
+	dir       string
+	timeout   time.Duration // 0 for no timeout
+	maxOutput int64         // 0 for no limit
+}
+
+// parseMaxOutput parses the max_output of kc.
+func (kc *kvCfg) parseMaxOutput() (string, error) {
+	if kc.MaxOutput == "" {
+		return "", nil
+	}
+	n, err := units.ParseBase2Bytes(kc.MaxOutput)
+	if err != nil {
+		return "max_output", fmt.Errorf("invalid max_output: %s", err)
+	}
+	if n <= 0 {
+		return "max_output", fmt.Errorf("max_output must be positive: %s", kc.MaxOutput)
+	}
+	kc.maxOutput = int64(n)
+	return "", nil
+}
+
+// maxOutputOf returns the max_output of kc, or --kv.max-output.
+func maxOutputOf(kc *kvCfg) int64 {
+	if kc.maxOutput > 0 {
+		return kc.maxOutput
+	}
+	return int64(*execMaxOutput)
+}
+
+// run runs c and returns its stdout.
+func (c *command) run() ([]byte, error) {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.Command(c.path, c.args...)
+	cmd.Dir = c.dir
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+	setProcessGroup(cmd)
+
+	full := make(chan struct{})
+	stdout := &limitedBuffer{max: c.maxOutput, full: full}
+	stderr := &limitedBuffer{max: execStderrMax}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	begin := time.Now()
+	if err := cmd.Start(); err != nil {
+		c.record(time.Since(begin), -1, false, false)
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if waitExit(cmd) {
+			killProcessGroup(cmd)
+		}
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	timedOut, killFailed := false, false
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		timedOut = true
+		err = c.kill(cmd, done)
+	case <-full:
+		err = c.kill(cmd, done)
+	}
+	if _, ok := err.(*killError); ok {
+		killFailed = true
+	}
+	duration := time.Since(begin)
+
+	// cmd.Wait is still running if the kill failed
+	exitCode := -1
+	if !killFailed && cmd.ProcessState != nil && !timedOut && !stdout.isTruncated() {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	c.record(duration, exitCode, timedOut, killFailed)
+
+	switch {
+	case timedOut:
+		return nil, &timeoutError{timeout: c.timeout}
+	case stdout.isTruncated():
+		return nil, fmt.Errorf("output larger than %d bytes", c.maxOutput)
+	case killFailed:
+		return nil, err
+	case err != nil:
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// kill kills the process group of cmd, and waits for it a while. It
+// returns a killError if cmd is not done by then, cmd.Wait is left running
+// until the output of cmd is closed.
+func (c *command) kill(cmd *exec.Cmd, done <-chan error) error {
+	if err := killProcessGroup(cmd); err != nil {
+		log.Printf("[warn] %s: kill %s failed: %s", c.collector, c.path, err)
+	}
+
+	timer := time.NewTimer(execKillGrace)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		log.Printf("[warn] %s: %s killed, but its output is still open", c.collector, c.path)
+		return &killError{path: c.path}
+	}
+}
+
+// killError is the error of a killed command whose output is still open
+// after execKillGrace.
+type killError struct {
+	path string
+}
+
+func (e *killError) Error() string {
+	return fmt.Sprintf("%s killed, but its output is still open after %s", e.path, execKillGrace)
+}
+
+func (c *command) record(duration time.Duration, exitCode int, timedOut, killFailed bool) {
+	if c.collector == "" {
+		return
+	}
+
+	execStatsMtx.Lock()
+	defer execStatsMtx.Unlock()
+
+	s, ok := execStats[c.collector]
+	if !ok {
+		s = &execStat{}
+		execStats[c.collector] = s
+	}
+	s.duration, s.exitCode = duration, exitCode
+	if timedOut {
+		s.timeouts++
+	}
+	if killFailed {
+		s.killFailures++
+	}
+}
+
+func describeExec(ch chan<- *prometheus.Desc) {
+	ch <- execDurationDesc
+	ch <- execTimeoutsDesc
+	ch <- execKillFailuresDesc
+	ch <- execExitCodeDesc
+}
+
+// collectExec exports the stats of the commands of the collectors which ran
+// one.
+func collectExec(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	execStatsMtx.Lock()
+	defer execStatsMtx.Unlock()
+
+	for name := range collectors {
+		s, ok := execStats[name]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(execDurationDesc, prometheus.GaugeValue, s.duration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(execTimeoutsDesc, prometheus.CounterValue, float64(s.timeouts), name)
+		ch <- prometheus.MustNewConstMetric(execKillFailuresDesc, prometheus.CounterValue, float64(s.killFailures), name)
+		ch <- prometheus.MustNewConstMetric(execExitCodeDesc, prometheus.GaugeValue, float64(s.exitCode), name)
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it, and drops the
+// rest; full is closed once it is over max. The buffer is not embedded,
+// io.Copy would use its ReadFrom.
+type limitedBuffer struct {
+	mtx       sync.Mutex
+	buf       bytes.Buffer
+	max       int64 // 0 for no limit
+	full      chan struct{}
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.max <= 0 {
+		return b.buf.Write(p)
+	}
+	if left := b.max - int64(b.buf.Len()); int64(len(p)) > left {
+		if left > 0 {
+			b.buf.Write(p[:left])
+		}
+		if !b.truncated && b.full != nil {
+			close(b.full)
+		}
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) isTruncated() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.truncated
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Bytes()
+}
+
+func (b *limitedBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
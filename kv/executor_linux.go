@@ -0,0 +1,24 @@
+package kv
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitExit waits for cmd to exit without reaping it, its pid and so the id
+// of its process group can not be reused until cmd.Wait. It returns false if
+// the wait failed.
+func waitExit(cmd *exec.Cmd) bool {
+	const pPID = 1 // P_PID of waitid(2)
+
+	var siginfo [16]uint64
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(cmd.Process.Pid), uintptr(unsafe.Pointer(&siginfo[0])), syscall.WEXITED|unix.WNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			return errno == 0
+		}
+	}
+}
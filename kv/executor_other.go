@@ -0,0 +1,11 @@
+// +build !linux
+
+package kv
+
+import "os/exec"
+
+// waitExit can not wait for cmd without reaping it, the process group of
+// cmd is only killed on timeout or once its output is full.
+func waitExit(cmd *exec.Cmd) bool {
+	return false
+}
@@ -0,0 +1,53 @@
+package kv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandRun(t *testing.T) {
+	run := func(c *command) ([]byte, error, time.Duration) {
+		t.Helper()
+		begin := time.Now()
+		out, err := c.run()
+		return out, err, time.Since(begin)
+	}
+
+	out, err, _ := run(&command{collector: "exec_test", path: "sh", args: []string{"-c", "echo $GREETING"}, env: []string{"GREETING=hi"}})
+	if err != nil || string(out) != "hi\n" {
+		t.Fatalf("want hi, got %q, %v", out, err)
+	}
+	if s := execStats["exec_test"]; s == nil || s.exitCode != 0 {
+		t.Errorf("want an exit code of 0, got %+v", s)
+	}
+
+	// the children of the shell hold its output open, they are killed with
+	// it
+	timeouts := execStats["exec_test"].timeouts
+	_, err, took := run(&command{collector: "exec_test", path: "sh", args: []string{"-c", "sleep 5; echo done"}, timeout: 100 * time.Millisecond})
+	if _, ok := err.(*timeoutError); !ok || took > time.Second {
+		t.Fatalf("want a timeout after 100ms, got %v after %v", err, took)
+	}
+	if s := execStats["exec_test"]; s.timeouts != timeouts+1 || s.exitCode != -1 {
+		t.Errorf("want a timeout and an exit code of -1, got %+v", s)
+	}
+
+	// a command is killed once its output is over the limit
+	_, err, took = run(&command{path: "yes", maxOutput: 1024, timeout: 5 * time.Second})
+	if err == nil || !strings.Contains(err.Error(), "larger than 1024 bytes") || took > time.Second {
+		t.Fatalf("want an output error, got %v after %v", err, took)
+	}
+
+	_, err, _ = run(&command{collector: "exec_test", path: "sh", args: []string{"-c", "echo failed >&2; exit 3"}})
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("want the stderr in the error, got %v", err)
+	}
+	if s := execStats["exec_test"]; s.exitCode != 3 {
+		t.Errorf("want an exit code of 3, got %+v", s)
+	}
+
+	if _, err, _ = run(&command{collector: "exec_test", path: "/nonexistent"}); err == nil || execStats["exec_test"].exitCode != -1 {
+		t.Errorf("want an error and an exit code of -1, got %v", err)
+	}
+}
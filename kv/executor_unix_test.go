@@ -0,0 +1,94 @@
+// +build !windows
+
+package kv
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// running reports whether the process pid is alive, not a zombie.
+func running(pid int) bool {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// the state follows the command name, which is in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestCommandRunKillsChildren(t *testing.T) {
+	if _, err := ioutil.ReadFile("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+
+	// a child left in the background is killed after the command exits
+	out, err := (&command{path: "sh", args: []string{"-c", "sleep 5 >/dev/null 2>&1 & echo $!"}}).run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; running(pid) && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if running(pid) {
+		t.Errorf("want the background child %d killed", pid)
+	}
+}
+
+func TestCommandRunOutputHeldByChild(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the process group is only killed after a normal exit on linux")
+	}
+
+	// the group is killed once the command exits, so a child keeping its
+	// output open does not hold the run
+	begin := time.Now()
+	out, err := (&command{path: "sh", args: []string{"-c", "sleep 5 & echo done"}}).run()
+	if err != nil || strings.TrimSpace(string(out)) != "done" {
+		t.Fatalf("want done, got %q %v", out, err)
+	}
+	if d := time.Since(begin); d > 2*time.Second {
+		t.Errorf("want the run done once the command exits, took %v", d)
+	}
+}
+
+func TestCommandRunKillFailure(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("no setsid")
+	}
+
+	grace := execKillGrace
+	execKillGrace = 100 * time.Millisecond
+	defer func() { execKillGrace = grace }()
+
+	execStatsMtx.Lock()
+	var failures uint64
+	if s := execStats["exec_kill_test"]; s != nil {
+		failures = s.killFailures
+	}
+	execStatsMtx.Unlock()
+
+	// a child out of the process group keeps the output open after the
+	// kill
+	begin := time.Now()
+	_, err := (&command{collector: "exec_kill_test", path: "sh", args: []string{"-c", "setsid sleep 1 & sleep 5"}, timeout: 100 * time.Millisecond}).run()
+	if _, ok := err.(*timeoutError); !ok || time.Since(begin) > time.Second {
+		t.Fatalf("want a timeout, got %v after %v", err, time.Since(begin))
+	}
+
+	execStatsMtx.Lock()
+	defer execStatsMtx.Unlock()
+	if s := execStats["exec_kill_test"]; s.killFailures != failures+1 {
+		t.Errorf("want a kill failure, got %+v", s)
+	}
+}
@@ -0,0 +1,11 @@
+package kv
+
+import "os/exec"
+
+// Windows has no process groups to kill, only the command itself is killed.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup fails once the command is done.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
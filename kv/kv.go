@@ -1,14 +1,18 @@
 package kv
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"os"
+	"regexp"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/node_exporter/redact"
 )
 
 var forbidTags = []string{
@@ -28,9 +32,38 @@ var forbidTags = []string{
 	"quantile",
 }
 
+// IsForbidTag reports whether tag is reserved by prometheus and can not be
+// used as a label name as is, label names starting with __ are all
+// reserved.
+func IsForbidTag(tag string) bool {
+	if strings.HasPrefix(tag, "__") {
+		return true
+	}
+	for _, ft := range forbidTags {
+		if ft == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TuneTag renames a reserved tag by appending "_" to it, or by prefixing it
+// with "exported" if it starts with __, other tags are returned unchanged.
+func TuneTag(tag string) string {
+	if strings.HasPrefix(tag, "__") {
+		return "exported" + tag
+	}
+	if IsForbidTag(tag) {
+		return tag + "_"
+	}
+	return tag
+}
+
 const (
 	kvCollectorTypeCat     = `cat`
 	kvCollectorTypeOSQuery = `osquery`
+	kvCollectorTypeNative  = `native`
+	kvCollectorTypeExec    = `exec`
 
 	kvPlatformWindows = `windows`
 	kvPlatformLinux   = `linux`
@@ -44,12 +77,75 @@ type kvCfg struct {
 	Type      string `json:"type"`
 	SQL       string `json:"sql"`
 
-	Files []string `json:"files"`
-	Any   bool     `json:"any"`
+	// Files of the cat type are paths, glob patterns or directories, see
+	// cat.go. MaxFileSize and MaxSize default to --kv.cat.max-file-size and
+	// --kv.cat.max-size, Gzip compresses the files before their base64
+	// encoding.
+	Files       []string `json:"files"`
+	Any         bool     `json:"any"`
+	Include     string   `json:"include"`
+	Exclude     string   `json:"exclude"`
+	MaxFileSize string   `json:"max_file_size"`
+	MaxSize     string   `json:"max_size"`
+	Gzip        bool     `json:"gzip"`
+
+	// Table is the table of the native type, its rows are filtered by
+	// Filters and reduced to Columns if set. An osquery entry with a Table
+	// falls back to it when osqueryd can not be run.
+	Table   string          `json:"table"`
+	Columns []string        `json:"columns"`
+	Filters []*nativeFilter `json:"filters"`
+
+	// Command is run with Args by the exec type, in Dir and with Env added
+	// to the environment of the exporter. Its output is parsed into rows by
+	// Parser, see exec.go. MaxOutput limits the output of the exec type and
+	// of osqueryd in shell mode, --kv.max-output by default.
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	Env       []string `json:"env"`
+	Dir       string   `json:"dir"`
+	MaxOutput string   `json:"max_output"`
+	Parser    string   `json:"parser"`
+	Regex     string   `json:"regex"`
 
 	Tags    []string `json:"tags"`
 	Help    string   `json:"help"`
 	Enabled bool     `json:"enabled"`
+
+	// Priority orders the collectors when their concurrency is limited,
+	// lower priorities run first.
+	Priority int `json:"priority"`
+
+	// Interval caches the result of the collector, it is refreshed in the
+	// background once older than Interval. A failed refresh keeps the last
+	// good result, served as stale until it is older than MaxAge (3 times
+	// Interval by default).
+	Interval string `json:"interval"`
+	MaxAge   string `json:"max_age"`
+	// Timeout stops a run of the collector, the osquery and native default
+	// is --kv.osqueryd.query-timeout, the exec default is 30s.
+	Timeout string `json:"timeout"`
+
+	// Changes diffs each result of the collector with the previous one, the
+	// rows are matched by their Keys columns, or as a whole without Keys.
+	// Keys are ignored by cat collectors, whose files are matched by path.
+	Changes bool     `json:"changes"`
+	Keys    []string `json:"keys"`
+
+	// Schema maps the rows to series in the labels format, see schema.go.
+	Schema *kvSchema `json:"schema"`
+
+	// Redact rules are applied to the rows, or the file contents of the cat
+	// type, before they leave the collector, see redact/redact.go.
+	Redact []*redact.Rule `json:"redact"`
+
+	interval, maxAge, timeout time.Duration
+
+	re        *regexp.Regexp
+	maxOutput int64
+
+	include, exclude     *regexp.Regexp
+	maxFileSize, maxSize int64
 }
 
 type kvCfgs struct {
@@ -57,87 +153,229 @@ type kvCfgs struct {
 }
 
 type kvCollector struct {
-	desc *prometheus.Desc
-	cfg  *kvCfg
+	desc   *prometheus.Desc
+	cfg    *kvCfg
+	format Format
 }
 
-var (
-	JsonFormat = true
-)
-
-func NewNodeCollector(conf *kvCfg) (Collector, error) {
+func NewNodeCollector(conf *kvCfg, format Format) (Collector, error) {
 	c := &kvCollector{
-		cfg: conf,
+		cfg:    conf,
+		format: format,
 	}
 
-	//conf.Tags = append(conf.Tags, cloudcare.TagUploaderUID)
-	c.desc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", conf.SubSystem),
-		conf.Help, conf.Tags, nil)
+	c.desc = prometheus.NewDesc(MetricName(conf.SubSystem), conf.Help, conf.Tags, nil)
 
 	return c, nil
 }
 
-func Init(cfgFile string) {
-	var kvCfgs kvCfgs
-	j, err := ioutil.ReadFile(cfgFile)
+// MetricName returns the name of the series of the collector subSystem.
+func MetricName(subSystem string) string {
+	return prometheus.BuildFQName(namespace, "", subSystem)
+}
+
+// Init registers the kv collectors of the kv configure j, the content of
+// kv.json. It must be called before the command line is parsed, for the
+// --[no-]kv.collector.<name> flags.
+func Init(j []byte) error {
+	kcs, err := parseConfig(j)
 	if err != nil {
-		log.Fatalf("[fatal] open %s failed: %s", cfgFile, err)
+		return err
 	}
 
+	for _, kc := range kcs {
+		if err := registerCollector(kc.SubSystem, kc.Enabled, NewNodeCollector, kc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseConfig parses and checks the kv configure j, only the entries of the
+// current platform are returned.
+func parseConfig(j []byte) ([]*kvCfg, error) {
+	var kvCfgs kvCfgs
 	if err := json.Unmarshal(j, &kvCfgs); err != nil {
-		log.Fatalf("[fatal] yaml load %s failed: %s", cfgFile, err)
+		return nil, err
 	}
 
+	var res []*kvCfg
+	names := map[string]bool{}
 	for _, kc := range kvCfgs.Kvs {
-		if kc.Platform != "" && kc.Platform == runtime.GOOS {
+		if kc.Platform == "" || kc.Platform != runtime.GOOS {
+			log.Printf("[info] skip collector %s(platform: %s)", kc.SubSystem, kc.Platform)
+			continue
+		}
 
-			//kc.Tags = append(kc.Tags, cloudcare.TagUploaderUID, cloudcare.TagHost) // 追加默认 tags
-			registerCollector(kc.SubSystem, kc.Enabled, NewNodeCollector, kc)
+		if kc.SubSystem == "" {
+			return nil, fmt.Errorf("sub_system missing")
+		}
+		if names[kc.SubSystem] {
+			return nil, fmt.Errorf("duplicate collector: %s", kc.SubSystem)
+		}
+		names[kc.SubSystem] = true
 
-		} else {
-			log.Printf("[info] skip collector %s(platform: %s)", kc.SubSystem, kc.Platform)
+		switch kc.Type {
+		case kvCollectorTypeOSQuery:
+			if _, err := kc.parseMaxOutput(); err != nil {
+				return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+			}
+			if kc.Table != "" {
+				if err := kc.checkNative(); err != nil {
+					return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+				}
+			}
+		case kvCollectorTypeCat:
+			if _, err := kc.parseCat(); err != nil {
+				return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+			}
+		case kvCollectorTypeNative:
+			if err := kc.checkNative(); err != nil {
+				return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+			}
+		case kvCollectorTypeExec:
+			if _, err := kc.parseExec(); err != nil {
+				return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unsupported type %q", kc.SubSystem, kc.Type)
 		}
-	}
 
-}
+		for _, tag := range kc.Tags {
+			if !model.LabelName(tag).IsValid() {
+				return nil, fmt.Errorf("%s: invalid tag %q", kc.SubSystem, tag)
+			}
+		}
 
-func (kc *kvCollector) Update(ch chan<- prometheus.Metric) error {
-	switch kc.cfg.Type {
-	case kvCollectorTypeCat:
-		return kc.catUpdate(ch)
-	case kvCollectorTypeOSQuery:
-		return kc.osqueryUpdate(ch)
-	default:
-		log.Printf("[warn] unsupported env collector type: %s", kc.cfg.Type)
-		return nil
+		if err := kc.parseDurations(); err != nil {
+			return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+		}
+
+		if err := kc.checkKeys(); err != nil {
+			return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+		}
+
+		if err := kc.parseRedact(); err != nil {
+			return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+		}
+
+		if err := kc.parseSchema(); err != nil {
+			return nil, fmt.Errorf("%s: %s", kc.SubSystem, err)
+		}
+
+		res = append(res, kc)
 	}
-	return nil
+	return res, nil
 }
 
-func (kc *kvCollector) catUpdate(ch chan<- prometheus.Metric) error {
-	var rawFileContents []string
-	for _, f := range kc.cfg.Files {
-		if _, err := os.Stat(f); err != nil {
+// parseDurations parses the interval, max_age and timeout of kc.
+func (kc *kvCfg) parseDurations() *durationError {
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"interval", kc.Interval, &kc.interval},
+		{"max_age", kc.MaxAge, &kc.maxAge},
+		{"timeout", kc.Timeout, &kc.timeout},
+	} {
+		if d.value == "" {
 			continue
 		}
-
-		raw, err := doCat(f)
+		v, err := time.ParseDuration(d.value)
 		if err != nil {
-			return err
+			return &durationError{d.name, fmt.Sprintf("invalid %s: %s", d.name, err)}
+		}
+		if v <= 0 {
+			return &durationError{d.name, fmt.Sprintf("%s must be positive: %s", d.name, d.value)}
 		}
-		rawFileContents = append(rawFileContents, raw)
+		*d.dst = v
+	}
 
-		if kc.cfg.Any {
-			break
+	if kc.maxAge > 0 && kc.interval == 0 {
+		return &durationError{"max_age", "max_age without interval"}
+	}
+	if kc.maxAge == 0 {
+		kc.maxAge = 3 * kc.interval
+	}
+	if kc.maxAge < kc.interval {
+		return &durationError{"max_age", fmt.Sprintf("max_age %v shorter than interval %v", kc.maxAge, kc.interval)}
+	}
+	return nil
+}
+
+// checkKeys checks that the keys of kc are among its columns, if they are
+// known.
+func (kc *kvCfg) checkKeys() error {
+	if kc.Type != kvCollectorTypeNative || len(kc.Columns) == 0 {
+		return nil
+	}
+	for _, k := range kc.Keys {
+		if !contains(kc.Columns, k) {
+			return fmt.Errorf("key %q not in columns", k)
 		}
 	}
+	return nil
+}
+
+// durationError is an invalid duration of a kv entry, field is its json
+// name.
+type durationError struct {
+	field string
+	msg   string
+}
+
+func (e *durationError) Error() string {
+	return e.msg
+}
+
+func (kc *kvCollector) priority() int {
+	return kc.cfg.Priority
+}
+
+func (kc *kvCollector) Update(ch chan<- prometheus.Metric) error {
+	res, age, stale, err := kc.fetch()
+	return kc.render(ch, kc.format, res, age, stale, err)
+}
+
+// render exports the result of a fetch of kc in format.
+func (kc *kvCollector) render(ch chan<- prometheus.Metric, format Format, res *kvResult, age time.Duration, stale bool, err error) error {
+	if kc.cfg.interval > 0 && (err == nil || stale) {
+		cacheMetrics(ch, kc.cfg.SubSystem, age, stale)
+	}
+	if err != nil {
+		return err
+	}
 
-	if len(rawFileContents) == 0 {
-		log.Printf("[warn] no file read for %s, ignored", kc.cfg.SubSystem)
+	switch kc.cfg.Type {
+	case kvCollectorTypeCat:
+		return kc.catUpdate(ch, res.files, res.missing)
+	default:
+		return kc.rowsUpdate(ch, format, res.rows)
+	}
+}
+
+func (kc *kvCollector) catUpdate(ch chan<- prometheus.Metric, files []catFile, missing []string) error {
+	ch <- fileMissingMetric(kc, missing)
+	if len(missing) > 0 {
+		log.Printf("[warn] %s: files not found or unreadable: %s", kc.cfg.SubSystem, strings.Join(missing, ", "))
+	}
+	if len(files) == 0 {
 		return nil
 	}
 
+	var rawFileContents []string
+	for _, f := range files {
+		content := f.content
+		if kc.cfg.Gzip {
+			var err error
+			if content, err = gzipped(content); err != nil {
+				return err
+			}
+		}
+		rawFileContents = append(rawFileContents, base64.RawURLEncoding.EncodeToString(content))
+	}
+
 	raw := strings.Join(rawFileContents, fileSep)
 	ch <- newEnvMetric(kc, raw)
 	return nil
@@ -145,62 +383,43 @@ func (kc *kvCollector) catUpdate(ch chan<- prometheus.Metric) error {
 
 func newEnvMetric(kc *kvCollector, envVal string) prometheus.Metric {
 	return prometheus.MustNewConstMetric(kc.desc, prometheus.GaugeValue, float64(-1), envVal)
-	return nil
 }
 
-func (kc *kvCollector) osqueryUpdate(ch chan<- prometheus.Metric) error {
-	res, err := doQuery(kc.cfg.SQL)
-	if err != nil {
-		return err
-	}
-
+// rowsUpdate exports the rows of an osquery or native table.
+func (kc *kvCollector) rowsUpdate(ch chan<- prometheus.Metric, format Format, rows []map[string]string) error {
 	//集群模式下，兼容promtheous
-	if !JsonFormat {
-		n := len(res.formatJson)
-		if n == 0 {
+	if format == FormatLabels {
+		if len(rows) == 0 {
 			return nil
 		}
 
-		entry := res.formatJson[0]
-		var keys = []string{}
-		var tuned []string
-		for k := range entry {
-			bforbid := false
-			for _, ft := range forbidTags {
-				if ft == k {
-					bforbid = true
-					break
-				}
-			}
-			if bforbid {
-				k = k + "_"
-				tuned = append(tuned, k)
-			}
-			keys = append(keys, k)
+		names, series, err := kc.cfg.series(rows)
+		if err != nil {
+			return err
 		}
 
+		valueType := prometheus.GaugeValue
+		if kc.cfg.Schema != nil {
+			valueType = kc.cfg.Schema.valueType
+		}
 		desc := prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", kc.cfg.SubSystem),
 			kc.cfg.Help,
-			keys,
+			names,
 			nil,
 		)
-
-		for _, m := range res.formatJson {
-			var vals []string
-			for _, k := range keys {
-				for _, tk := range tuned {
-					if tk == k {
-						k = k[:len(k)-1]
-						break
-					}
-				}
-				vals = append(vals, m[k])
-			}
-			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, -1, vals...)
+		for _, s := range series {
+			ch <- prometheus.MustNewConstMetric(desc, valueType, s.value, s.labels...)
 		}
 	} else {
-		ch <- newEnvMetric(kc, res.rawJson)
+		if rows == nil {
+			rows = []map[string]string{}
+		}
+		out, err := json.Marshal(rows)
+		if err != nil {
+			return err
+		}
+		ch <- newEnvMetric(kc, base64.RawURLEncoding.EncodeToString(out))
 	}
 
 	return nil
@@ -0,0 +1,150 @@
+package kv
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Native tables are read by the exporter itself from /etc, /proc and /var,
+// with the columns of the osquery tables of the same name, so that they work
+// without osqueryd.
+
+// nativeFilter keeps the rows whose column is one of In, and none of NotIn.
+type nativeFilter struct {
+	Column string   `json:"column"`
+	In     []string `json:"in"`
+	NotIn  []string `json:"not_in"`
+}
+
+// nativeQuery is the query of a native table. Tables may use the filters to
+// read less, the rows they return are filtered anyway.
+type nativeQuery struct {
+	table   string
+	columns []string
+	filters []*nativeFilter
+}
+
+// nativeTables are the native tables of the current platform, registered by
+// init functions.
+var nativeTables = map[string]func(q *nativeQuery) ([]map[string]string, error){}
+
+func registerNativeTable(name string, gen func(q *nativeQuery) ([]map[string]string, error)) {
+	nativeTables[name] = gen
+}
+
+func checkNativeTable(table string) error {
+	if table == "" {
+		return fmt.Errorf("table missing")
+	}
+	if _, ok := nativeTables[table]; !ok {
+		return fmt.Errorf("native table %q not supported on %s", table, runtime.GOOS)
+	}
+	return nil
+}
+
+// checkNative checks the native table of kc and its filters.
+func (kc *kvCfg) checkNative() error {
+	if err := checkNativeTable(kc.Table); err != nil {
+		return err
+	}
+	for _, f := range kc.Filters {
+		if f == nil || f.Column == "" {
+			return fmt.Errorf("filter column missing")
+		}
+	}
+	return nil
+}
+
+// doNative reads the rows of the native table of kc. The read is abandoned
+// after timeout, so that a hung mount does not block the scrape.
+func doNative(kc *kvCfg, timeout time.Duration) ([]map[string]string, error) {
+	q := &nativeQuery{table: kc.Table, columns: kc.Columns, filters: kc.Filters}
+
+	gen, ok := nativeTables[q.table]
+	if !ok {
+		return nil, fmt.Errorf("native table %q not supported on %s", q.table, runtime.GOOS)
+	}
+
+	res, err := withTimeout(timeout, func() (*kvResult, error) {
+		rows, err := gen(q)
+		return &kvResult{rows: rows}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.apply(res.rows), nil
+}
+
+// in returns the values the filters allow for column, nil if any value is
+// allowed.
+func (q *nativeQuery) in(column string) []string {
+	for _, f := range q.filters {
+		if f.Column == column && f.In != nil {
+			return f.In
+		}
+	}
+	return nil
+}
+
+// apply filters the rows and keeps their selected columns.
+func (q *nativeQuery) apply(rows []map[string]string) []map[string]string {
+	res := rows[:0]
+	for _, row := range rows {
+		if !q.match(row) {
+			continue
+		}
+
+		if len(q.columns) > 0 {
+			selected := make(map[string]string, len(q.columns))
+			for _, c := range q.columns {
+				selected[c] = row[c]
+			}
+			row = selected
+		}
+		res = append(res, row)
+	}
+	return res
+}
+
+func (q *nativeQuery) match(row map[string]string) bool {
+	for _, f := range q.filters {
+		v := row[f.Column]
+		if f.In != nil && !contains(f.In, v) {
+			return false
+		}
+		if contains(f.NotIn, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// rootfsFilePath and procFilePath return the paths of the host, they follow
+// the --path.rootfs and --path.procfs flags of the node collectors.
+func rootfsFilePath(name string) string {
+	return filepath.Join(flagValue("path.rootfs", "/"), name)
+}
+
+func procFilePath(name string) string {
+	return filepath.Join(flagValue("path.procfs", "/proc"), name)
+}
+
+func flagValue(name, def string) string {
+	if f := kingpin.CommandLine.GetFlag(name); f != nil {
+		return f.Model().Value.String()
+	}
+	return def
+}
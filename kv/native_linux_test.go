@@ -0,0 +1,375 @@
+package kv
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestUserGroups(t *testing.T) {
+	users, err := parsePasswd(strings.NewReader(`root:x:0:0:root:/root:/bin/bash
+# comment
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+alice:x:1000:1000:Alice,,,:/home/alice:/bin/bash
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := parseGroup(strings.NewReader(`root:x:0:
+sudo:x:27:alice
+alice:x:1000:alice
+docker:x:999:alice,root
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 3 || users[2].description != "Alice,,," || users[2].directory != "/home/alice" {
+		t.Fatalf("unexpected users %+v", users)
+	}
+	if signed(users[1].uid) != "65534" || signed("4294967294") != "-2" {
+		t.Errorf("unexpected signed ids %s %s", signed(users[1].uid), signed("4294967294"))
+	}
+
+	want := []map[string]string{
+		{"uid": "0", "gid": "0"},
+		{"uid": "0", "gid": "999"},
+		{"uid": "65534", "gid": "65534"},
+		{"uid": "1000", "gid": "1000"},
+		{"uid": "1000", "gid": "27"},
+		{"uid": "1000", "gid": "999"},
+	}
+	if got := userGroups(users, groups); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	keys := parseAuthorizedKeys([]byte(`# keys
+ssh-ed25519 AAAAC3Nza alice@laptop
+from="10.0.0.1,10.0.0.2",command="echo hi there" ssh-rsa AAAAB3Nza backup key
+`))
+
+	want := []map[string]string{
+		{"algorithm": "ssh-ed25519", "key": "AAAAC3Nza", "options": "", "comment": "alice@laptop"},
+		{"algorithm": "ssh-rsa", "key": "AAAAB3Nza", "options": `from="10.0.0.1,10.0.0.2",command="echo hi there"`, "comment": "backup key"},
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("want %v, got %v", want, keys)
+	}
+}
+
+func TestParseCrontab(t *testing.T) {
+	rows := parseCrontab("/etc/crontab", strings.Split(`SHELL=/bin/sh
+# m h dom mon dow user command
+17 *	* * *	root    cd / && run-parts --report /etc/cron.hourly
+@reboot root /usr/local/bin/start.sh # not a comment
+`, "\n"))
+
+	if len(rows) != 2 {
+		t.Fatalf("want 2 jobs, got %v", rows)
+	}
+	if rows[0]["minute"] != "17" || rows[0]["day_of_week"] != "*" || rows[0]["command"] != "root cd / && run-parts --report /etc/cron.hourly" {
+		t.Errorf("unexpected job %v", rows[0])
+	}
+	if rows[1]["event"] != "@reboot" || rows[1]["command"] != "root /usr/local/bin/start.sh # not a comment" || rows[1]["path"] != "/etc/crontab" {
+		t.Errorf("unexpected job %v", rows[1])
+	}
+}
+
+func TestParseResolvConf(t *testing.T) {
+	lines, _ := parseLines(strings.NewReader(`# generated
+nameserver 10.0.0.2
+nameserver 8.8.8.8
+search example.com corp.example.com
+sortlist 130.155.160.0/255.255.240.0
+options ndots:2
+`))
+
+	got := parseResolvConf(lines)
+	if len(got) != 5 {
+		t.Fatalf("want 5 rows, got %v", got)
+	}
+	if got[1]["id"] != "1" || got[1]["address"] != "8.8.8.8" || got[3]["type"] != "search" || got[3]["id"] != "1" {
+		t.Errorf("unexpected rows %v", got)
+	}
+	if got[4]["address"] != "130.155.160.0" || got[4]["netmask"] != "255.255.240.0" {
+		t.Errorf("unexpected sortlist %v", got[4])
+	}
+}
+
+func TestOSVersion(t *testing.T) {
+	release, err := parseOSRelease(strings.NewReader(`NAME="Ubuntu"
+VERSION="18.04.1 LTS (Bionic Beaver)"
+ID=ubuntu
+ID_LIKE=debian
+VERSION_ID="18.04"
+VERSION_CODENAME=bionic
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"name":          "Ubuntu",
+		"version":       "18.04.1 LTS (Bionic Beaver)",
+		"major":         "18",
+		"minor":         "04",
+		"patch":         "0",
+		"build":         "",
+		"platform":      "ubuntu",
+		"platform_like": "debian",
+		"codename":      "bionic",
+		"arch":          "x86_64",
+	}
+	if got := osVersion(release, "x86_64"); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	want := map[string]string{"days": "1", "hours": "2", "minutes": "3", "seconds": "4", "total_seconds": "93784"}
+	if got := uptime(93784); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	rows := parseRoutes([]string{
+		"Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT",
+		"eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0",
+		"eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0",
+	})
+	if len(rows) != 2 {
+		t.Fatalf("want 2 routes, got %v", rows)
+	}
+	if rows[0]["destination"] != "0.0.0.0" || rows[0]["gateway"] != "192.168.0.1" || rows[0]["netmask"] != "0" || rows[0]["flags"] != "3" {
+		t.Errorf("unexpected default route %v", rows[0])
+	}
+	if rows[1]["destination"] != "192.168.0.0" || rows[1]["netmask"] != "24" || rows[1]["type"] != "gateway" {
+		t.Errorf("unexpected route %v", rows[1])
+	}
+
+	rows = parseIPv6Routes([]string{
+		"00000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001       lo",
+	})
+	if len(rows) != 1 || rows[0]["destination"] != "::1" || rows[0]["netmask"] != "128" || rows[0]["type"] != "local" {
+		t.Errorf("unexpected ipv6 routes %v", rows)
+	}
+}
+
+func TestParseProcNet(t *testing.T) {
+	socks := parseProcNet([]string{
+		"sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode",
+		"0: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000   107        0 23452 1 0000000000000000 100 0 0 10 0",
+		"1: 0100007F:8F4C 0100007F:0CEA 01 00000000:00000000 00:00000000 00000000  1000        0 98123 1 0000000000000000 20 4 30 10 -1",
+	}, tcpListen)
+	want := []procNetSocket{{address: "127.0.0.1", port: 3306, inode: "23452"}}
+	if !reflect.DeepEqual(socks, want) {
+		t.Errorf("want %v, got %v", want, socks)
+	}
+
+	socks = parseProcNet([]string{
+		"0: 00000000000000000000000000000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 19001 1 0000000000000000 100 0 0 10 0",
+	}, tcpListen)
+	if len(socks) != 1 || socks[0].address != "::" || socks[0].port != 22 {
+		t.Errorf("unexpected ipv6 sockets %v", socks)
+	}
+}
+
+// wtmpRecord returns a wtmp record in the layout of glibc.
+func wtmpRecord(typ int16, pid int32, line, user, host string, sec int32) []byte {
+	b := make([]byte, utmpRecordSize)
+	binary.LittleEndian.PutUint16(b[0:], uint16(typ))
+	binary.LittleEndian.PutUint32(b[4:], uint32(pid))
+	copy(b[8:40], line)
+	copy(b[44:76], user)
+	copy(b[76:332], host)
+	binary.LittleEndian.PutUint32(b[340:], uint32(sec))
+	return b
+}
+
+func TestParseWtmp(t *testing.T) {
+	var data []byte
+	data = append(data, wtmpRecord(2, 0, "~", "reboot", "4.15.0", 1540000000)...)
+	data = append(data, wtmpRecord(7, 1234, "pts/0", "alice", "10.0.0.5", 1540000100)...)
+	data = append(data, wtmpRecord(8, 1234, "pts/0", "", "", 1540000200)...)
+
+	want := []map[string]string{
+		{"username": "alice", "tty": "pts/0", "pid": "1234", "type": "7", "type_name": "user-process", "time": "1540000100", "host": "10.0.0.5"},
+		{"username": "", "tty": "pts/0", "pid": "1234", "type": "8", "type_name": "dead-process", "time": "1540000200", "host": ""},
+	}
+	if got := parseWtmp(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestNativeQueryApply(t *testing.T) {
+	q := &nativeQuery{
+		columns: []string{"port", "pid"},
+		filters: []*nativeFilter{
+			{Column: "pid", NotIn: []string{"-1"}},
+			{Column: "protocol", In: []string{"6"}},
+		},
+	}
+	rows := q.apply([]map[string]string{
+		{"pid": "1", "port": "22", "protocol": "6"},
+		{"pid": "-1", "port": "111", "protocol": "6"},
+		{"pid": "2", "port": "53", "protocol": "17"},
+	})
+
+	want := []map[string]string{{"port": "22", "pid": "1"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("want %v, got %v", want, rows)
+	}
+}
+
+func TestQueryNativeFallback(t *testing.T) {
+	defer func(path string, d *osqueryDaemon) {
+		OSQuerydPath, daemon = path, d
+	}(OSQuerydPath, daemon)
+	OSQuerydPath, daemon = filepath.Join(t.TempDir(), "osqueryd"), nil
+
+	kcs, err := parseConfig([]byte(`{"kvs": [
+		{"sub_system": "uptime", "platform": "linux", "type": "osquery", "sql": "select * from uptime",
+		 "table": "uptime", "columns": ["total_seconds"]},
+		{"sub_system": "etc_hosts", "platform": "linux", "type": "osquery", "sql": "select * from etc_hosts"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := doQuery(kcs[0])
+	if err != nil {
+		t.Fatalf("want the native table read without osqueryd, got %v", err)
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 || rows[0]["total_seconds"] == "" {
+		t.Errorf("want the total_seconds of the native table, got %v", rows)
+	}
+
+	// without a table, osquery entries do not fall back
+	if _, err := doQuery(kcs[1]); err == nil {
+		t.Error("want an error without osqueryd")
+	}
+
+	if _, err := parseConfig([]byte(`{"kvs": [
+		{"sub_system": "hosts", "platform": "linux", "type": "osquery", "sql": "select * from hosts", "table": "hosts"}
+	]}`)); err == nil {
+		t.Error("want an error for an unknown fallback table")
+	}
+}
+
+// withNativeRoot points the native tables to rootfs and procfs, the
+// --path.rootfs and --path.procfs flags are registered by the node
+// collectors, which are not part of the kv tests.
+func withNativeRoot(t *testing.T, rootfs, procfs string) {
+	for name, value := range map[string]string{"path.rootfs": rootfs, "path.procfs": procfs} {
+		f := kingpin.CommandLine.GetFlag(name)
+		if f == nil {
+			kingpin.Flag(name, "").String()
+			f = kingpin.CommandLine.GetFlag(name)
+		}
+		prev := f.Model().Value.String()
+		if err := f.Model().Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Model().Value.Set(prev) })
+	}
+}
+
+func TestShippedKvNativeFallback(t *testing.T) {
+	defer func(path string, d *osqueryDaemon) {
+		OSQuerydPath, daemon = path, d
+	}(OSQuerydPath, daemon)
+	OSQuerydPath, daemon = filepath.Join(t.TempDir(), "osqueryd"), nil
+
+	rootfs, procfs := t.TempDir(), t.TempDir()
+	withNativeRoot(t, rootfs, procfs)
+
+	writeFiles(t, rootfs, map[string]string{
+		"etc/passwd":                      "root:x:0:0:root:/root:/bin/bash\nalice:x:1000:1000:Alice:/home/alice:/bin/bash\n",
+		"etc/group":                       "root:x:0:\nsudo:x:27:alice\nalice:x:1000:\n",
+		"etc/hosts":                       "127.0.0.1 localhost\n",
+		"etc/resolv.conf":                 "nameserver 10.0.0.2\n",
+		"etc/crontab":                     "17 * * * * root run-parts /etc/cron.hourly\n",
+		"etc/sudoers":                     "root ALL=(ALL:ALL) ALL\n",
+		"etc/os-release":                  "NAME=\"Ubuntu\"\nVERSION_ID=\"18.04\"\nID=ubuntu\n",
+		"home/alice/.ssh/authorized_keys": "ssh-ed25519 AAAAC3Nza alice@laptop\n",
+		"usr/bin/passwd":                  "",
+		"var/log/wtmp":                    string(wtmpRecord(7, 1234, "pts/0", "alice", "10.0.0.5", 1540000100)),
+	})
+	if err := os.Chmod(filepath.Join(rootfs, "usr/bin/passwd"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, procfs, map[string]string{
+		"modules":                     "ext4 737280 1 - Live 0x0000000000000000\n",
+		"mounts":                      "/dev/sda1 / ext4 rw,relatime 0 0\n",
+		"net/route":                   "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\tMTU\tWindow\tIRTT\neth0\t00000000\t0100A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+		"net/tcp":                     "  sl  local_address rem_address   st\n   0: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000   107        0 23452 1\n",
+		"sys/net/ipv4/tcp_syncookies": "1\n",
+		"uptime":                      "12345.67 100.00\n",
+	})
+	if err := os.MkdirAll(filepath.Join(procfs, "100/fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:[23452]", filepath.Join(procfs, "100/fd/3")); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := ioutil.ReadFile("../kv.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kcs, err := parseConfig(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs := map[string]*kvCfg{}
+	for _, kc := range kcs {
+		cfgs[kc.SubSystem] = kc
+	}
+
+	for _, name := range []string{
+		"users", "groups", "user_groups", "etc_hosts", "dns_resolvers", "crontab",
+		"authorized_keys", "sudoers", "kernel_modules", "mounts", "routes",
+		"listening_ports", "system_controls", "os_version", "uptime", "suid_bin", "last",
+	} {
+		kc, ok := cfgs[name]
+		if !ok || kc.Type != kvCollectorTypeOSQuery || kc.Table != name {
+			t.Errorf("%s: want an osquery entry falling back to the native table, got %+v", name, kc)
+			continue
+		}
+
+		c, err := NewNodeCollector(kc, FormatLabels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan prometheus.Metric, 100)
+		if err := c.Update(ch); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		close(ch)
+
+		series := 0
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+			series++
+		}
+		if series == 0 {
+			t.Errorf("%s: want series without osqueryd", name)
+		}
+	}
+}
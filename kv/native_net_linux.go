@@ -0,0 +1,335 @@
+package kv
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	registerNativeTable("mounts", genMounts)
+	registerNativeTable("routes", genRoutes)
+	registerNativeTable("listening_ports", genListeningPorts)
+}
+
+func genMounts(q *nativeQuery) ([]map[string]string, error) {
+	// the mounts of the host, not of the exporter container
+	lines, err := readLines(procFilePath("1/mounts"))
+	if err != nil {
+		lines, err = readLines(procFilePath("mounts"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		device, path := unescapeMount(fields[0]), unescapeMount(fields[1])
+
+		row := map[string]string{
+			"device":           device,
+			"device_alias":     device,
+			"path":             path,
+			"type":             fields[2],
+			"blocks_size":      "0",
+			"blocks":           "0",
+			"blocks_free":      "0",
+			"blocks_available": "0",
+			"inodes":           "0",
+			"inodes_free":      "0",
+			"flags":            fields[3],
+		}
+		if strings.HasPrefix(device, "/") {
+			if alias, err := filepath.EvalSymlinks(rootfsFilePath(device)); err == nil {
+				rel, _ := filepath.Rel(rootfsFilePath("/"), alias)
+				row["device_alias"] = "/" + rel
+			}
+		}
+
+		var st unix.Statfs_t
+		if err := unix.Statfs(rootfsFilePath(path), &st); err == nil {
+			row["blocks_size"] = strconv.FormatInt(int64(st.Bsize), 10)
+			row["blocks"] = strconv.FormatUint(uint64(st.Blocks), 10)
+			row["blocks_free"] = strconv.FormatUint(uint64(st.Bfree), 10)
+			row["blocks_available"] = strconv.FormatUint(uint64(st.Bavail), 10)
+			row["inodes"] = strconv.FormatUint(uint64(st.Files), 10)
+			row["inodes_free"] = strconv.FormatUint(uint64(st.Ffree), 10)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// unescapeMount decodes the octal escapes of the spaces, tabs and
+// backslashes in the fields of /proc/mounts.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+const (
+	rtfReject = 0x0200
+	rtfLocal  = 0x80000000
+)
+
+func genRoutes(q *nativeQuery) ([]map[string]string, error) {
+	v4, err := readLines(procFilePath("net/route"))
+	if err != nil {
+		return nil, err
+	}
+	rows := parseRoutes(v4)
+
+	// missing if ipv6 is disabled
+	if v6, err := readLines(procFilePath("net/ipv6_route")); err == nil {
+		rows = append(rows, parseIPv6Routes(v6)...)
+	}
+	return rows, nil
+}
+
+// parseRoutes parses /proc/net/route:
+// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+func parseRoutes(lines []string) []map[string]string {
+	var rows []map[string]string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 11 || fields[0] == "Iface" {
+			continue
+		}
+
+		dst, err1 := parseHexIP(fields[1])
+		gw, err2 := parseHexIP(fields[2])
+		mask, err3 := parseHexIP(fields[7])
+		flags, err4 := strconv.ParseUint(fields[3], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		ones, _ := net.IPMask(mask.To4()).Size()
+
+		rows = append(rows, map[string]string{
+			"destination": dst.String(),
+			"netmask":     strconv.Itoa(ones),
+			"gateway":     gw.String(),
+			"source":      "",
+			"flags":       strconv.FormatUint(flags, 10),
+			"interface":   fields[0],
+			"mtu":         fields[8],
+			"metric":      fields[6],
+			"type":        routeType(flags),
+			"hopcount":    "0",
+		})
+	}
+	return rows
+}
+
+// parseIPv6Routes parses /proc/net/ipv6_route:
+// dst dst_len src src_len next_hop metric refcnt use flags iface
+func parseIPv6Routes(lines []string) []map[string]string {
+	var rows []map[string]string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+
+		dst, err1 := hex.DecodeString(fields[0])
+		gw, err2 := hex.DecodeString(fields[4])
+		dstLen, err3 := strconv.ParseUint(fields[1], 16, 8)
+		metric, err4 := strconv.ParseUint(fields[5], 16, 32)
+		flags, err5 := strconv.ParseUint(fields[8], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || len(dst) != 16 || len(gw) != 16 {
+			continue
+		}
+
+		rows = append(rows, map[string]string{
+			"destination": net.IP(dst).String(),
+			"netmask":     strconv.FormatUint(dstLen, 10),
+			"gateway":     net.IP(gw).String(),
+			"source":      "",
+			"flags":       strconv.FormatUint(flags, 10),
+			"interface":   fields[9],
+			"mtu":         "0",
+			"metric":      strconv.FormatUint(metric, 10),
+			"type":        routeType(flags),
+			"hopcount":    "0",
+		})
+	}
+	return rows
+}
+
+// routeType returns the osquery route type, unicast routes are reported as
+// gateway routes by osquery.
+func routeType(flags uint64) string {
+	switch {
+	case flags&rtfLocal != 0:
+		return "local"
+	case flags&rtfReject != 0:
+		return "other"
+	default:
+		return "gateway"
+	}
+}
+
+// parseHexIP parses the addresses of /proc/net, made of 32 bits words in
+// host order, little endian on the platforms supported.
+func parseHexIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	return ip, nil
+}
+
+const (
+	tcpListen   = "0A"
+	udpUnconn   = "07"
+	ipprotoTCP  = "6"
+	ipprotoUDP  = "17"
+	familyInet  = "2"
+	familyInet6 = "10"
+)
+
+type socketOwner struct {
+	pid, fd, netns string
+}
+
+func genListeningPorts(q *nativeQuery) ([]map[string]string, error) {
+	owners := socketOwners()
+
+	var rows []map[string]string
+	for _, s := range []struct {
+		file, protocol, family, state string
+	}{
+		{"net/tcp", ipprotoTCP, familyInet, tcpListen},
+		{"net/tcp6", ipprotoTCP, familyInet6, tcpListen},
+		{"net/udp", ipprotoUDP, familyInet, udpUnconn},
+		{"net/udp6", ipprotoUDP, familyInet6, udpUnconn},
+	} {
+		lines, err := readLines(procFilePath(s.file))
+		if err != nil {
+			continue
+		}
+		for _, sock := range parseProcNet(lines, s.state) {
+			owner, ok := owners[sock.inode]
+			if !ok {
+				owner = socketOwner{pid: "-1", fd: "-1", netns: "0"}
+			}
+			rows = append(rows, map[string]string{
+				"pid":           owner.pid,
+				"port":          strconv.Itoa(sock.port),
+				"protocol":      s.protocol,
+				"family":        s.family,
+				"address":       sock.address,
+				"fd":            owner.fd,
+				"socket":        sock.inode,
+				"path":          "",
+				"net_namespace": owner.netns,
+			})
+		}
+	}
+	return rows, nil
+}
+
+type procNetSocket struct {
+	address string
+	port    int
+	inode   string
+}
+
+// parseProcNet returns the sockets in state of /proc/net/{tcp,udp}[6]:
+// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+func parseProcNet(lines []string, state string) []procNetSocket {
+	var socks []procNetSocket
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[3] != state {
+			continue
+		}
+
+		local := strings.SplitN(fields[1], ":", 2)
+		if len(local) != 2 {
+			continue
+		}
+		ip, err := parseHexIP(local[0])
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(local[1], 16, 16)
+		if err != nil {
+			continue
+		}
+		socks = append(socks, procNetSocket{address: ip.String(), port: int(port), inode: fields[9]})
+	}
+	return socks
+}
+
+// socketOwners maps the inodes of the sockets to the processes which opened
+// them.
+func socketOwners() map[string]socketOwner {
+	owners := map[string]socketOwner{}
+
+	procs, err := ioutil.ReadDir(procFilePath(""))
+	if err != nil {
+		return owners
+	}
+	for _, p := range procs {
+		pid := p.Name()
+		if _, err := strconv.Atoi(pid); err != nil {
+			continue
+		}
+
+		fds, err := ioutil.ReadDir(procFilePath(filepath.Join(pid, "fd")))
+		if err != nil {
+			continue
+		}
+
+		netns := "0"
+		if link, err := os.Readlink(procFilePath(filepath.Join(pid, "ns/net"))); err == nil {
+			netns = strings.TrimSuffix(strings.TrimPrefix(link, "net:["), "]")
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(procFilePath(filepath.Join(pid, "fd", fd.Name())))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			if _, ok := owners[inode]; !ok {
+				owners[inode] = socketOwner{pid: pid, fd: fd.Name(), netns: netns}
+			}
+		}
+	}
+	return owners
+}
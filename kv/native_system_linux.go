@@ -0,0 +1,463 @@
+package kv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	registerNativeTable("etc_hosts", genEtcHosts)
+	registerNativeTable("dns_resolvers", genDNSResolvers)
+	registerNativeTable("crontab", genCrontab)
+	registerNativeTable("kernel_modules", genKernelModules)
+	registerNativeTable("system_controls", genSystemControls)
+	registerNativeTable("os_version", genOSVersion)
+	registerNativeTable("uptime", genUptime)
+	registerNativeTable("suid_bin", genSuidBin)
+}
+
+// readLines returns the lines of file without comments and blank lines.
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseLines(f)
+}
+
+func parseLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func genEtcHosts(q *nativeQuery) ([]map[string]string, error) {
+	lines, err := readLines(rootfsFilePath("etc/hosts"))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		rows = append(rows, map[string]string{
+			"address":   fields[0],
+			"hostnames": strings.Join(fields[1:], " "),
+		})
+	}
+	return rows, nil
+}
+
+func genDNSResolvers(q *nativeQuery) ([]map[string]string, error) {
+	lines, err := readLines(rootfsFilePath("etc/resolv.conf"))
+	if err != nil {
+		return nil, err
+	}
+	return parseResolvConf(lines), nil
+}
+
+// parseResolvConf returns the nameservers, search domains and sortlist of
+// resolv.conf, numbered by type like osquery does. Its options column is
+// the bitmask of the resolver of osqueryd, it is left empty.
+func parseResolvConf(lines []string) []map[string]string {
+	var rows []map[string]string
+	ids := map[string]int{}
+	add := func(typ, address, netmask string) {
+		rows = append(rows, map[string]string{
+			"id":      strconv.Itoa(ids[typ]),
+			"type":    typ,
+			"address": address,
+			"netmask": netmask,
+			"options": "",
+		})
+		ids[typ]++
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			add("nameserver", fields[1], "")
+		case "search", "domain":
+			for _, domain := range fields[1:] {
+				add("search", domain, "")
+			}
+		case "sortlist":
+			for _, pair := range fields[1:] {
+				address, netmask := pair, ""
+				if i := strings.IndexByte(pair, '/'); i >= 0 {
+					address, netmask = pair[:i], pair[i+1:]
+				}
+				add("sortlist", address, netmask)
+			}
+		}
+	}
+	return rows
+}
+
+func genCrontab(q *nativeQuery) ([]map[string]string, error) {
+	files := []string{"/etc/crontab"}
+	for _, dir := range []string{"/etc/cron.d", "/var/spool/cron", "/var/spool/cron/crontabs"} {
+		fis, err := ioutil.ReadDir(rootfsFilePath(dir))
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() {
+				files = append(files, filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+
+	var rows []map[string]string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(rootfsFilePath(file))
+		if err != nil {
+			continue
+		}
+		rows = append(rows, parseCrontab(file, strings.Split(string(data), "\n"))...)
+	}
+	return rows, nil
+}
+
+// parseCrontab parses the jobs of a crontab file. Like osquery, the user
+// field of the system crontabs is kept in the command. Commands may contain
+// #, only whole lines are comments.
+func parseCrontab(file string, lines []string) []map[string]string {
+	var rows []map[string]string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		// comments and environment settings
+		if len(fields) == 0 || fields[0][0] == '#' || strings.Contains(fields[0], "=") {
+			continue
+		}
+
+		row := map[string]string{
+			"event":        "",
+			"minute":       "",
+			"hour":         "",
+			"day_of_month": "",
+			"month":        "",
+			"day_of_week":  "",
+			"path":         file,
+		}
+		switch {
+		case strings.HasPrefix(fields[0], "@"):
+			row["event"] = fields[0]
+			row["command"] = strings.Join(fields[1:], " ")
+		case len(fields) >= 6:
+			row["minute"] = fields[0]
+			row["hour"] = fields[1]
+			row["day_of_month"] = fields[2]
+			row["month"] = fields[3]
+			row["day_of_week"] = fields[4]
+			row["command"] = strings.Join(fields[5:], " ")
+		default:
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func genKernelModules(q *nativeQuery) ([]map[string]string, error) {
+	// kernels built without module support
+	lines, err := readLines(procFilePath("modules"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseModules(lines), nil
+}
+
+// parseModules parses /proc/modules:
+// name size refcount used_by status address
+func parseModules(lines []string) []map[string]string {
+	var rows []map[string]string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		rows = append(rows, map[string]string{
+			"name":    fields[0],
+			"size":    fields[1],
+			"used_by": fields[3],
+			"status":  fields[4],
+			"address": fields[5],
+		})
+	}
+	return rows
+}
+
+var sysctlConfigs = []string{"/etc/sysctl.conf", "/etc/sysctl.d", "/usr/lib/sysctl.d", "/run/sysctl.d"}
+
+func genSystemControls(q *nativeQuery) ([]map[string]string, error) {
+	config := readSysctlConfig()
+
+	var names []string
+	if in := q.in("name"); in != nil {
+		names = in
+	} else {
+		root := procFilePath("sys")
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if fi.Mode().IsRegular() && fi.Mode().Perm()&0444 != 0 {
+				rel, _ := filepath.Rel(root, path)
+				names = append(names, strings.Replace(rel, "/", ".", -1))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rows []map[string]string
+	for _, name := range names {
+		data, err := ioutil.ReadFile(procFilePath(filepath.Join("sys", strings.Replace(name, ".", "/", -1))))
+		if err != nil {
+			// write only, or a name which is not a sysctl
+			continue
+		}
+		rows = append(rows, map[string]string{
+			"name":          name,
+			"oid":           "",
+			"subsystem":     strings.SplitN(name, ".", 2)[0],
+			"current_value": strings.Join(strings.Fields(string(data)), " "),
+			"config_value":  config[name],
+			"type":          "",
+			"field_name":    "",
+		})
+	}
+	return rows, nil
+}
+
+// readSysctlConfig returns the values of the sysctl configure files, the
+// later files win like with sysctl --system.
+func readSysctlConfig() map[string]string {
+	var files []string
+	for _, path := range sysctlConfigs {
+		fis, err := ioutil.ReadDir(rootfsFilePath(path))
+		if err != nil {
+			files = append(files, path)
+			continue
+		}
+		for _, fi := range fis {
+			if strings.HasSuffix(fi.Name(), ".conf") {
+				files = append(files, filepath.Join(path, fi.Name()))
+			}
+		}
+	}
+
+	config := map[string]string{}
+	for _, file := range files {
+		lines, err := readLines(rootfsFilePath(file))
+		if err != nil {
+			continue
+		}
+		for _, line := range lines {
+			if line[0] == ';' {
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			name := strings.Replace(strings.TrimSpace(kv[0]), "/", ".", -1)
+			config[name] = strings.TrimSpace(kv[1])
+		}
+	}
+	return config
+}
+
+func genOSVersion(q *nativeQuery) ([]map[string]string, error) {
+	f, err := os.Open(rootfsFilePath("etc/os-release"))
+	if err != nil {
+		f, err = os.Open(rootfsFilePath("usr/lib/os-release"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	release, err := parseOSRelease(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var uname unix.Utsname
+	arch := ""
+	if err := unix.Uname(&uname); err == nil {
+		arch = cString(uname.Machine[:])
+	}
+	return []map[string]string{osVersion(release, arch)}, nil
+}
+
+func parseOSRelease(r io.Reader) (map[string]string, error) {
+	lines, err := parseLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	release := map[string]string{}
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if v, err := strconv.Unquote(kv[1]); err == nil {
+			kv[1] = v
+		} else {
+			kv[1] = strings.Trim(kv[1], `'"`)
+		}
+		release[kv[0]] = kv[1]
+	}
+	return release, nil
+}
+
+func osVersion(release map[string]string, arch string) map[string]string {
+	row := map[string]string{
+		"name":          release["NAME"],
+		"version":       release["VERSION"],
+		"major":         "0",
+		"minor":         "0",
+		"patch":         "0",
+		"build":         release["BUILD_ID"],
+		"platform":      release["ID"],
+		"platform_like": release["ID_LIKE"],
+		"codename":      release["VERSION_CODENAME"],
+		"arch":          arch,
+	}
+	if row["version"] == "" {
+		row["version"] = release["VERSION_ID"]
+	}
+
+	parts := strings.SplitN(release["VERSION_ID"], ".", 3)
+	for i, column := range []string{"major", "minor", "patch"} {
+		if i < len(parts) && parts[i] != "" {
+			row[column] = parts[i]
+		}
+	}
+	return row
+}
+
+func genUptime(q *nativeQuery) ([]map[string]string, error) {
+	data, err := ioutil.ReadFile(procFilePath("uptime"))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty %s", procFilePath("uptime"))
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	return []map[string]string{uptime(int64(seconds))}, nil
+}
+
+func uptime(total int64) map[string]string {
+	return map[string]string{
+		"days":          strconv.FormatInt(total/86400, 10),
+		"hours":         strconv.FormatInt(total%86400/3600, 10),
+		"minutes":       strconv.FormatInt(total%3600/60, 10),
+		"seconds":       strconv.FormatInt(total%60, 10),
+		"total_seconds": strconv.FormatInt(total, 10),
+	}
+}
+
+// suidBinPaths are the directories searched for setuid and setgid binaries
+// by osquery.
+var suidBinPaths = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin", "/usr/local/bin", "/usr/local/sbin", "/tmp"}
+
+func genSuidBin(q *nativeQuery) ([]map[string]string, error) {
+	usernames, groupnames := map[string]string{}, map[string]string{}
+	if users, err := readPasswd(); err == nil {
+		for _, u := range users {
+			usernames[u.uid] = u.username
+		}
+	}
+	if groups, err := readGroup(); err == nil {
+		for _, g := range groups {
+			groupnames[g.gid] = g.groupname
+		}
+	}
+
+	var rows []map[string]string
+	for _, dir := range suidBinPaths {
+		fis, err := ioutil.ReadDir(rootfsFilePath(dir))
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			mode := fi.Mode()
+			if !mode.IsRegular() || mode&(os.ModeSetuid|os.ModeSetgid) == 0 {
+				continue
+			}
+
+			var permissions string
+			if mode&os.ModeSetuid != 0 {
+				permissions += "S"
+			}
+			if mode&os.ModeSetgid != 0 {
+				permissions += "G"
+			}
+
+			row := map[string]string{
+				"path":        filepath.Join(dir, fi.Name()),
+				"username":    "",
+				"groupname":   "",
+				"permissions": permissions,
+			}
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				uid, gid := strconv.Itoa(int(st.Uid)), strconv.Itoa(int(st.Gid))
+				row["username"], row["groupname"] = nameOr(usernames, uid), nameOr(groupnames, gid)
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["path"] < rows[j]["path"] })
+	return rows, nil
+}
+
+func nameOr(names map[string]string, id string) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return id
+}
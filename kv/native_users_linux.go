@@ -0,0 +1,394 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerNativeTable("users", genUsers)
+	registerNativeTable("groups", genGroups)
+	registerNativeTable("user_groups", genUserGroups)
+	registerNativeTable("authorized_keys", genAuthorizedKeys)
+	registerNativeTable("sudoers", genSudoers)
+	registerNativeTable("last", genLast)
+}
+
+type passwdEntry struct {
+	username, uid, gid, description, directory, shell string
+}
+
+type groupEntry struct {
+	groupname, gid string
+	members        []string
+}
+
+// readColonFile reads the colon separated entries of files like
+// /etc/passwd, skipping comments and entries with less than n fields.
+func readColonFile(r io.Reader, n int) ([][]string, error) {
+	var entries [][]string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < n {
+			continue
+		}
+		entries = append(entries, fields)
+	}
+	return entries, scanner.Err()
+}
+
+func parsePasswd(r io.Reader) ([]passwdEntry, error) {
+	entries, err := readColonFile(r, 7)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []passwdEntry
+	for _, f := range entries {
+		res = append(res, passwdEntry{
+			username:    f[0],
+			uid:         f[2],
+			gid:         f[3],
+			description: f[4],
+			directory:   f[5],
+			shell:       f[6],
+		})
+	}
+	return res, nil
+}
+
+func parseGroup(r io.Reader) ([]groupEntry, error) {
+	entries, err := readColonFile(r, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []groupEntry
+	for _, f := range entries {
+		g := groupEntry{groupname: f[0], gid: f[2]}
+		for _, m := range strings.Split(f[3], ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				g.members = append(g.members, m)
+			}
+		}
+		res = append(res, g)
+	}
+	return res, nil
+}
+
+func readPasswd() ([]passwdEntry, error) {
+	f, err := os.Open(rootfsFilePath("etc/passwd"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePasswd(f)
+}
+
+func readGroup() ([]groupEntry, error) {
+	f, err := os.Open(rootfsFilePath("etc/group"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseGroup(f)
+}
+
+// signed returns the id as the signed 32 bits integer osquery reports in
+// its *_signed columns.
+func signed(id string) string {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return id
+	}
+	return strconv.FormatInt(int64(int32(n)), 10)
+}
+
+func genUsers(q *nativeQuery) ([]map[string]string, error) {
+	users, err := readPasswd()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]string
+	for _, u := range users {
+		rows = append(rows, map[string]string{
+			"uid":         u.uid,
+			"gid":         u.gid,
+			"uid_signed":  signed(u.uid),
+			"gid_signed":  signed(u.gid),
+			"username":    u.username,
+			"description": u.description,
+			"directory":   u.directory,
+			"shell":       u.shell,
+			"uuid":        "",
+		})
+	}
+	return rows, nil
+}
+
+func genGroups(q *nativeQuery) ([]map[string]string, error) {
+	groups, err := readGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]string
+	for _, g := range groups {
+		rows = append(rows, map[string]string{
+			"gid":        g.gid,
+			"gid_signed": signed(g.gid),
+			"groupname":  g.groupname,
+		})
+	}
+	return rows, nil
+}
+
+func genUserGroups(q *nativeQuery) ([]map[string]string, error) {
+	users, err := readPasswd()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readGroup()
+	if err != nil {
+		return nil, err
+	}
+	return userGroups(users, groups), nil
+}
+
+// userGroups returns the primary and supplementary groups of every user.
+func userGroups(users []passwdEntry, groups []groupEntry) []map[string]string {
+	var rows []map[string]string
+	for _, u := range users {
+		seen := map[string]bool{u.gid: true}
+		rows = append(rows, map[string]string{"uid": u.uid, "gid": u.gid})
+
+		for _, g := range groups {
+			if seen[g.gid] || !contains(g.members, u.username) {
+				continue
+			}
+			seen[g.gid] = true
+			rows = append(rows, map[string]string{"uid": u.uid, "gid": g.gid})
+		}
+	}
+	return rows
+}
+
+func genAuthorizedKeys(q *nativeQuery) ([]map[string]string, error) {
+	users, err := readPasswd()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]string
+	for _, u := range users {
+		if u.directory == "" {
+			continue
+		}
+		for _, name := range []string{".ssh/authorized_keys", ".ssh/authorized_keys2"} {
+			keyFile := filepath.Join(u.directory, name)
+			data, err := ioutil.ReadFile(rootfsFilePath(keyFile))
+			if err != nil {
+				continue
+			}
+			for _, k := range parseAuthorizedKeys(data) {
+				k["uid"] = u.uid
+				k["key_file"] = keyFile
+				rows = append(rows, k)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// parseAuthorizedKeys parses the lines of an authorized_keys file:
+// [options] algorithm key [comment]
+func parseAuthorizedKeys(data []byte) []map[string]string {
+	var keys []map[string]string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var options string
+		if !isKeyAlgorithm(strings.Fields(line)[0]) {
+			options, line = splitOptions(line)
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		keys = append(keys, map[string]string{
+			"algorithm": fields[0],
+			"key":       fields[1],
+			"options":   options,
+			"comment":   strings.Join(fields[2:], " "),
+		})
+	}
+	return keys
+}
+
+func isKeyAlgorithm(s string) bool {
+	return strings.HasPrefix(s, "ssh-") || strings.HasPrefix(s, "ecdsa-") || strings.HasPrefix(s, "sk-")
+}
+
+// splitOptions splits the options of an authorized_keys line from the rest
+// of it, the options may contain quoted spaces.
+func splitOptions(line string) (string, string) {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case (c == ' ' || c == '\t') && !quoted:
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+	return line, ""
+}
+
+func genSudoers(q *nativeQuery) ([]map[string]string, error) {
+	var rows []map[string]string
+	err := readSudoers("/etc/sudoers", &rows, 0)
+	return rows, err
+}
+
+// readSudoers reads the rules of the sudoers file, following its include
+// directives.
+func readSudoers(file string, rows *[]map[string]string, depth int) error {
+	// sudo itself stops at 128 nested includes
+	if depth > 128 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(rootfsFilePath(file))
+	if err != nil {
+		if depth > 0 || os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		// continued lines
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + " " + strings.TrimSpace(lines[i])
+		}
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		header, details := fields[0], strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		switch header {
+		case "#include", "@include":
+			*rows = append(*rows, map[string]string{"source": file, "header": header, "rule_details": details})
+			readSudoers(sudoersPath(file, details), rows, depth+1)
+			continue
+		case "#includedir", "@includedir":
+			*rows = append(*rows, map[string]string{"source": file, "header": header, "rule_details": details})
+			dir := sudoersPath(file, details)
+			files, _ := ioutil.ReadDir(rootfsFilePath(dir))
+			for _, fi := range files {
+				// files ending in ~ or containing a . are skipped by sudo
+				if fi.IsDir() || strings.HasSuffix(fi.Name(), "~") || strings.Contains(fi.Name(), ".") {
+					continue
+				}
+				readSudoers(filepath.Join(dir, fi.Name()), rows, depth+1)
+			}
+			continue
+		}
+
+		if line[0] == '#' {
+			continue
+		}
+		*rows = append(*rows, map[string]string{"source": file, "header": header, "rule_details": details})
+	}
+	return nil
+}
+
+func sudoersPath(file, include string) string {
+	if filepath.IsAbs(include) {
+		return include
+	}
+	return filepath.Join(filepath.Dir(file), include)
+}
+
+const (
+	utmpRecordSize  = 384
+	utmpUserProcess = 7
+	utmpDeadProcess = 8
+)
+
+var utmpTypeNames = map[int16]string{
+	0: "empty",
+	1: "runlevel",
+	2: "boot-time",
+	3: "new-time",
+	4: "old-time",
+	5: "init-process",
+	6: "login-process",
+	7: "user-process",
+	8: "dead-process",
+	9: "accounting",
+}
+
+func genLast(q *nativeQuery) ([]map[string]string, error) {
+	data, err := ioutil.ReadFile(rootfsFilePath("var/log/wtmp"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseWtmp(data), nil
+}
+
+// parseWtmp parses the login and logout records of wtmp, the struct utmp
+// of glibc on Linux.
+func parseWtmp(data []byte) []map[string]string {
+	var rows []map[string]string
+	for ; len(data) >= utmpRecordSize; data = data[utmpRecordSize:] {
+		rec := data[:utmpRecordSize]
+
+		typ := int16(binary.LittleEndian.Uint16(rec[0:]))
+		if typ != utmpUserProcess && typ != utmpDeadProcess {
+			continue
+		}
+
+		rows = append(rows, map[string]string{
+			"username":  cString(rec[44:76]),
+			"tty":       cString(rec[8:40]),
+			"pid":       strconv.Itoa(int(int32(binary.LittleEndian.Uint32(rec[4:])))),
+			"type":      strconv.Itoa(int(typ)),
+			"type_name": utmpTypeNames[typ],
+			"time":      strconv.Itoa(int(int32(binary.LittleEndian.Uint32(rec[340:])))),
+			"host":      cString(rec[76:332]),
+		})
+	}
+	return rows
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
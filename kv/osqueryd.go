@@ -0,0 +1,278 @@
+package kv
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// osqueryd is run as a daemon and queried over its extension socket, which
+// serves the event tables (process_events, socket_events...) the shell mode
+// can not. Queries fall back to the shell mode when the daemon is down.
+
+const (
+	queryModeDaemon = "daemon"
+	queryModeShell  = "shell"
+	// osquery entries with a table fall back to the native table when
+	// osqueryd fails, see doQuery
+	queryModeNative = "native"
+
+	queryResultSuccess = "success"
+	queryResultError   = "error"
+	queryResultTimeout = "timeout"
+
+	// time given to osqueryd to create its extension socket
+	osquerydStartTimeout = 30 * time.Second
+	// osqueryd is restarted after osquerydHealthFailures failed health checks
+	osquerydHealthInterval = 10 * time.Second
+	osquerydHealthFailures = 3
+	osquerydMaxBackoff     = time.Minute
+)
+
+var (
+	osquerydDaemon       = kingpin.Flag("kv.osqueryd.daemon", "Run osqueryd as a daemon and query it over its extension socket, instead of running it for every query. Not supported on Windows.").Default("true").Bool()
+	osquerydSocket       = kingpin.Flag("kv.osqueryd.socket", "Extension socket of the osqueryd daemon, osquery.em under the install directory if unset.").Default("").String()
+	osquerydQueryTimeout = kingpin.Flag("kv.osqueryd.query-timeout", "Timeout of a query to the osqueryd daemon.").Default("10s").Duration()
+	osquerydBackoff      = kingpin.Flag("kv.osqueryd.restart-backoff", "Delay before the osqueryd daemon is restarted, doubled on each consecutive restart up to 1m.").Default("1s").Duration()
+	osquerydFlags        = kingpin.Flag("kv.osqueryd.flag", "Extra flag of the osqueryd daemon, such as --disable_audit=false, can be repeated.").Strings()
+
+	osquerydUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "osqueryd", "up"),
+		"envinfo: Whether the osqueryd daemon answers on its extension socket.",
+		nil,
+		nil,
+	)
+	osquerydRestartsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "osqueryd", "restarts_total"),
+		"envinfo: Total number of restarts of the osqueryd daemon.",
+		nil,
+		nil,
+	)
+	osquerydQueriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "osqueryd", "queries_total"),
+		"envinfo: Total number of osquery queries by mode (daemon, shell or native fallback) and result.",
+		[]string{"mode", "result"},
+		nil,
+	)
+
+	queriesMtx = sync.Mutex{}
+	queries    = make(map[[2]string]uint64) // {mode, result}
+
+	// daemon is the supervised osqueryd, nil if not started
+	daemon *osqueryDaemon
+)
+
+type osqueryDaemon struct {
+	path   string
+	socket string
+	args   []string
+
+	mtx      sync.Mutex
+	up       bool
+	restarts uint64
+}
+
+// StartOSQueryd starts the osqueryd daemon of OSQuerydPath and keeps it
+// running, unless disabled by --no-kv.osqueryd.daemon. Its files are kept in
+// dir. Queries use the shell mode until the daemon is up.
+func StartOSQueryd(dir string) error {
+	if !*osquerydDaemon {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		log.Printf("[info] osqueryd daemon not supported on %s, use shell mode", runtime.GOOS)
+		return nil
+	}
+	if _, err := os.Stat(OSQuerydPath); err != nil {
+		return err
+	}
+
+	socket := *osquerydSocket
+	if socket == "" {
+		socket = filepath.Join(dir, "osquery.em")
+	}
+
+	d := &osqueryDaemon{
+		path:   OSQuerydPath,
+		socket: socket,
+		args: append([]string{
+			"--extensions_socket=" + socket,
+			"--pidfile=" + filepath.Join(dir, "osqueryd.pid"),
+			"--database_path=" + filepath.Join(dir, "osquery.db"),
+			"--logger_path=" + filepath.Join(dir, "osquery-log"),
+			"--disable_events=false",
+			"--force",
+		}, *osquerydFlags...),
+	}
+
+	daemon = d
+	go d.supervise()
+	return nil
+}
+
+// supervise runs osqueryd until the exporter exits, restarting it with an
+// exponential backoff.
+func (d *osqueryDaemon) supervise() {
+	backoff := *osquerydBackoff
+	for {
+		begin := time.Now()
+		err := d.run()
+		d.setUp(false)
+
+		// a daemon which ran long enough restarts without delay
+		if time.Since(begin) > osquerydMaxBackoff {
+			backoff = *osquerydBackoff
+		}
+		log.Printf("[warn] osqueryd exited: %s, restart in %v", err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > osquerydMaxBackoff {
+			backoff = osquerydMaxBackoff
+		}
+
+		d.mtx.Lock()
+		d.restarts++
+		d.mtx.Unlock()
+	}
+}
+
+// run starts osqueryd and waits until it exits, it is killed if its
+// extension socket does not answer.
+func (d *osqueryDaemon) run() error {
+	os.Remove(d.socket) // stale socket of a previous run
+
+	cmd := exec.Command(d.path, d.args...)
+	cmd.SysProcAttr = daemonSysProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("[info] osqueryd started, pid %d", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	if err := d.waitSocket(exited); err != nil {
+		cmd.Process.Kill()
+		<-exited
+		return err
+	}
+	d.setUp(true)
+	log.Printf("[info] osqueryd up on %s", d.socket)
+
+	ticker := time.NewTicker(osquerydHealthInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("exit status 0")
+			}
+			return err
+		case <-ticker.C:
+			if _, err := thriftQuery(d.socket, "select 1", *osquerydQueryTimeout); err != nil {
+				failures++
+				log.Printf("[warn] osqueryd health check failed (%d/%d): %s", failures, osquerydHealthFailures, err)
+				d.setUp(false)
+			} else {
+				failures = 0
+				d.setUp(true)
+			}
+
+			if failures >= osquerydHealthFailures {
+				cmd.Process.Kill()
+				<-exited
+				return fmt.Errorf("not healthy")
+			}
+		}
+	}
+}
+
+// waitSocket waits until the extension socket of osqueryd accepts
+// connections.
+func (d *osqueryDaemon) waitSocket(exited chan error) error {
+	deadline := time.Now().Add(osquerydStartTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			exited <- err // for run
+			if err == nil {
+				err = fmt.Errorf("exit status 0")
+			}
+			return err
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if conn, err := net.Dial("unix", d.socket); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("no extension socket %s after %v", d.socket, osquerydStartTimeout)
+}
+
+func (d *osqueryDaemon) setUp(up bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.up = up
+}
+
+func (d *osqueryDaemon) isUp() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.up
+}
+
+func countQuery(mode string, err error) {
+	result := queryResultSuccess
+	if err != nil {
+		result = queryResultError
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			result = queryResultTimeout
+		}
+	}
+
+	queriesMtx.Lock()
+	defer queriesMtx.Unlock()
+	queries[[2]string{mode, result}]++
+}
+
+func describeOSQueryd(ch chan<- *prometheus.Desc) {
+	ch <- osquerydUpDesc
+	ch <- osquerydRestartsDesc
+	ch <- osquerydQueriesDesc
+}
+
+func collectOSQueryd(ch chan<- prometheus.Metric) {
+	if d := daemon; d != nil {
+		d.mtx.Lock()
+		up, restarts := 0.0, d.restarts
+		if d.up {
+			up = 1
+		}
+		d.mtx.Unlock()
+
+		ch <- prometheus.MustNewConstMetric(osquerydUpDesc, prometheus.GaugeValue, up)
+		ch <- prometheus.MustNewConstMetric(osquerydRestartsDesc, prometheus.CounterValue, float64(restarts))
+	}
+
+	queriesMtx.Lock()
+	defer queriesMtx.Unlock()
+
+	for key, n := range queries {
+		ch <- prometheus.MustNewConstMetric(osquerydQueriesDesc, prometheus.CounterValue, float64(n), key[0], key[1])
+	}
+}
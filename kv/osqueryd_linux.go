@@ -0,0 +1,8 @@
+package kv
+
+import "syscall"
+
+// daemonSysProcAttr stops osqueryd when the exporter dies.
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
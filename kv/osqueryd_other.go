@@ -0,0 +1,9 @@
+// +build !linux
+
+package kv
+
+import "syscall"
+
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
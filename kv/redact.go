@@ -0,0 +1,80 @@
+package kv
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/node_exporter/redact"
+)
+
+// The redact rules of an entry are applied to each result as soon as it is
+// collected, before it is cached, diffed or rendered. Rules of cat entries
+// apply to the content of their files, as they are read, the others to
+// their rows.
+
+var (
+	redactionsTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "redactions", "total"),
+		"envinfo: Total number of values, lines or files redacted from the results of a collector.",
+		[]string{"collector", "action"},
+		nil,
+	)
+
+	redactionsMtx   = sync.Mutex{}
+	redactionsCount = make(map[[2]string]uint64) // {collector, action}
+)
+
+// parseRedact compiles the redact rules of kc.
+func (kc *kvCfg) parseRedact() error {
+	return redact.Compile(kc.Redact, kc.Type == kvCollectorTypeCat)
+}
+
+// redactResult applies the redact rules of cfg to res, in place.
+func redactResult(cfg *kvCfg, res *kvResult) {
+	if len(cfg.Redact) == 0 {
+		return
+	}
+
+	// the files of cat entries are redacted by redactFile
+	if cfg.Type == kvCollectorTypeCat {
+		return
+	}
+	countRedactions(cfg, redact.Rows(cfg.Redact, res.rows))
+}
+
+// redactFile applies the redact rules of cfg to the content of the file f
+// of a cat entry, in place. It returns false if the file is dropped.
+func redactFile(cfg *kvCfg, f *catFile) bool {
+	content, keep, counts := redact.Content(cfg.Redact, f.path, f.content)
+	countRedactions(cfg, counts)
+	f.content = content
+	return keep
+}
+
+func countRedactions(cfg *kvCfg, counts redact.Counts) {
+	redactionsMtx.Lock()
+	defer redactionsMtx.Unlock()
+	for action, n := range counts {
+		redactionsCount[[2]string{cfg.SubSystem, action}] += uint64(n)
+	}
+}
+
+func describeRedactions(ch chan<- *prometheus.Desc) {
+	ch <- redactionsTotalDesc
+}
+
+// collectRedactions exports the redaction counters of the collectors with
+// redact rules.
+func collectRedactions(collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	redactionsMtx.Lock()
+	defer redactionsMtx.Unlock()
+
+	for name, c := range collectors {
+		if kc, ok := c.(*kvCollector); !ok || len(kc.cfg.Redact) == 0 {
+			continue
+		}
+		for _, action := range []string{redact.ActionDrop, redact.ActionHash, redact.ActionMask} {
+			ch <- prometheus.MustNewConstMetric(redactionsTotalDesc, prometheus.CounterValue, float64(redactionsCount[[2]string{name, action}]), name, action)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package kv
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// The schema of an entry maps its rows to the series of the labels format:
+// the Labels columns become labels in their order, and the Value column the
+// sample value. Without a schema every column is a label, sorted by name,
+// and the value is -1.
+
+const (
+	schemaTypeGauge   = "gauge"
+	schemaTypeCounter = "counter"
+	schemaTypeUntyped = "untyped"
+
+	// a row missing a schema column, or whose value is not a number
+	schemaMissingSkip  = "skip"
+	schemaMissingEmpty = "empty"
+	schemaMissingError = "error"
+
+	// columns of a row which are neither labels nor the value
+	schemaExtraDrop   = "drop"
+	schemaExtraLabels = "labels"
+	schemaExtraError  = "error"
+)
+
+type kvSchema struct {
+	// Labels are the label columns, in order, Value the numeric column of
+	// the sample value, -1 if unset. Type is gauge by default.
+	Labels []string `json:"labels"`
+	Value  string   `json:"value"`
+	Type   string   `json:"type"`
+
+	// Missing is skip (the default), empty for an empty label or a NaN
+	// value, or error to fail the collector. Extra is drop (the default),
+	// labels to append them as labels sorted by name, or error.
+	Missing string `json:"missing"`
+	Extra   string `json:"extra"`
+
+	valueType prometheus.ValueType
+}
+
+// parseSchema checks the schema of kc and sets its defaults.
+func (kc *kvCfg) parseSchema() error {
+	s := kc.Schema
+	if s == nil {
+		return nil
+	}
+	if kc.Type == kvCollectorTypeCat {
+		return fmt.Errorf("schema not supported by cat entries")
+	}
+
+	switch s.Type {
+	case "", schemaTypeGauge:
+		s.valueType = prometheus.GaugeValue
+	case schemaTypeCounter:
+		s.valueType = prometheus.CounterValue
+	case schemaTypeUntyped:
+		s.valueType = prometheus.UntypedValue
+	default:
+		return fmt.Errorf("unknown schema type %q", s.Type)
+	}
+	if s.Type == schemaTypeCounter && s.Value == "" {
+		return fmt.Errorf("schema value missing for a counter")
+	}
+
+	switch s.Missing {
+	case "":
+		s.Missing = schemaMissingSkip
+	case schemaMissingSkip, schemaMissingEmpty, schemaMissingError:
+	default:
+		return fmt.Errorf("unknown schema missing %q", s.Missing)
+	}
+	switch s.Extra {
+	case "":
+		s.Extra = schemaExtraDrop
+	case schemaExtraDrop, schemaExtraLabels, schemaExtraError:
+	default:
+		return fmt.Errorf("unknown schema extra %q", s.Extra)
+	}
+
+	seen := map[string]bool{}
+	for _, l := range s.Labels {
+		if !model.LabelName(TuneTag(l)).IsValid() {
+			return fmt.Errorf("invalid schema label %q", l)
+		}
+		if seen[l] {
+			return fmt.Errorf("duplicate schema label %q", l)
+		}
+		seen[l] = true
+	}
+	if seen[s.Value] {
+		return fmt.Errorf("schema value %q is also a label", s.Value)
+	}
+
+	// the columns of native entries are known
+	if kc.Type == kvCollectorTypeNative && len(kc.Columns) > 0 {
+		for _, c := range append(s.Labels, s.Value) {
+			if c != "" && !contains(kc.Columns, c) {
+				return fmt.Errorf("schema column %q not in columns", c)
+			}
+		}
+	}
+	return nil
+}
+
+// kvSeries is a series of the rows of an entry.
+type kvSeries struct {
+	labels []string
+	value  float64
+}
+
+// labelName returns the label name of the column c. Columns come from the
+// output of commands, such as the dotted keys of sysctl, so the characters
+// not allowed in label names are replaced with _, a leading digit is
+// prefixed with _, and reserved names are renamed by TuneTag.
+func labelName(c string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, c)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return TuneTag(name)
+}
+
+// series maps rows to the label names and the series of the labels format,
+// by the schema of kc or, without a schema, a label per column of the first
+// row. Rows with the labels of a previous row are dropped.
+func (kc *kvCfg) series(rows []map[string]string) ([]string, []kvSeries, error) {
+	s := kc.Schema
+	if s == nil {
+		s = &kvSchema{Missing: schemaMissingEmpty, Extra: schemaExtraLabels}
+	}
+
+	columns := append([]string{}, s.Labels...)
+	if s.Extra != schemaExtraDrop {
+		known := map[string]bool{s.Value: true}
+		for _, l := range s.Labels {
+			known[l] = true
+		}
+
+		extra := map[string]bool{}
+		for i, row := range rows {
+			// without a schema the labels are the columns of the first
+			// row, as they always were
+			if kc.Schema == nil && i > 0 {
+				break
+			}
+			for c := range row {
+				if !known[c] {
+					extra[c] = true
+				}
+			}
+		}
+		if len(extra) > 0 && s.Extra == schemaExtraError {
+			return nil, nil, fmt.Errorf("columns not in the schema: %s", strings.Join(sortedSet(extra), ", "))
+		}
+		columns = append(columns, sortedSet(extra)...)
+	}
+
+	names := make([]string, 0, len(columns))
+	byName := map[string]string{}
+	for _, c := range columns {
+		name := labelName(c)
+		if name == "" {
+			return nil, nil, fmt.Errorf("column %q is not a valid label name", c)
+		}
+		if prev, ok := byName[name]; ok {
+			return nil, nil, fmt.Errorf("columns %q and %q are both exported as label %q", prev, c, name)
+		}
+		byName[name] = c
+		names = append(names, name)
+	}
+
+	var series []kvSeries
+	seen := map[string]bool{}
+	skipped, duplicates := 0, 0
+rows:
+	for _, row := range rows {
+		ser := kvSeries{value: -1}
+		for i, c := range columns {
+			v, ok := row[c]
+			if !ok && i < len(s.Labels) {
+				switch s.Missing {
+				case schemaMissingSkip:
+					skipped++
+					continue rows
+				case schemaMissingError:
+					return nil, nil, fmt.Errorf("column %q missing", c)
+				}
+			}
+			ser.labels = append(ser.labels, v)
+		}
+
+		if s.Value != "" {
+			v, err := strconv.ParseFloat(strings.TrimSpace(row[s.Value]), 64)
+			if err != nil {
+				switch s.Missing {
+				case schemaMissingSkip:
+					skipped++
+					continue rows
+				case schemaMissingError:
+					return nil, nil, fmt.Errorf("value %q of column %q is not a number", row[s.Value], s.Value)
+				}
+				v = math.NaN()
+			}
+			ser.value = v
+		}
+
+		key := strings.Join(ser.labels, "\xff")
+		if seen[key] {
+			duplicates++
+			continue
+		}
+		seen[key] = true
+		series = append(series, ser)
+	}
+
+	if skipped > 0 {
+		log.Printf("[warn] %s: %d rows skipped, missing a schema column", kc.SubSystem, skipped)
+	}
+	if duplicates > 0 {
+		log.Printf("[warn] %s: %d rows dropped, with the labels of another row", kc.SubSystem, duplicates)
+	}
+	return names, series, nil
+}
+
+func sortedSet(set map[string]bool) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
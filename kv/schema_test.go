@@ -0,0 +1,130 @@
+package kv
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSeries(t *testing.T) {
+	rows := []map[string]string{
+		{"type": "nofile", "soft_limit": "1024", "hard_limit": "4096", "job": "x"},
+		{"type": "stack", "soft_limit": "8192", "hard_limit": "unlimited"},
+		{"soft_limit": "1"},
+		{"type": "nofile", "soft_limit": "2048", "hard_limit": "4096"},
+	}
+
+	for _, c := range []struct {
+		schema *kvSchema
+		names  []string
+		series []kvSeries
+		err    bool
+	}{
+		// every column of the first row, sorted
+		{nil, []string{"hard_limit", "job_", "soft_limit", "type"}, []kvSeries{
+			{[]string{"4096", "x", "1024", "nofile"}, -1},
+			{[]string{"unlimited", "", "8192", "stack"}, -1},
+			{[]string{"", "", "1", ""}, -1},
+			{[]string{"4096", "", "2048", "nofile"}, -1},
+		}, false},
+		// rows missing a column or with the labels of a previous row are
+		// dropped
+		{&kvSchema{Labels: []string{"type"}, Value: "soft_limit"}, []string{"type"}, []kvSeries{
+			{[]string{"nofile"}, 1024},
+			{[]string{"stack"}, 8192},
+		}, false},
+		{&kvSchema{Labels: []string{"type"}, Value: "hard_limit", Extra: "labels"}, []string{"type", "job_", "soft_limit"}, []kvSeries{
+			{[]string{"nofile", "x", "1024"}, 4096},
+			{[]string{"nofile", "", "2048"}, 4096},
+		}, false},
+		{&kvSchema{Labels: []string{"soft_limit", "type"}, Missing: "empty"}, []string{"soft_limit", "type"}, []kvSeries{
+			{[]string{"1024", "nofile"}, -1},
+			{[]string{"8192", "stack"}, -1},
+			{[]string{"1", ""}, -1},
+			{[]string{"2048", "nofile"}, -1},
+		}, false},
+		{&kvSchema{Labels: []string{"type"}, Missing: "error"}, nil, nil, true},
+		{&kvSchema{Labels: []string{"type"}, Extra: "error"}, nil, nil, true},
+	} {
+		cfg := &kvCfg{SubSystem: "ulimit_info", Type: kvCollectorTypeOSQuery, Schema: c.schema}
+		if err := cfg.parseSchema(); err != nil {
+			t.Fatal(err)
+		}
+		names, series, err := cfg.series(rows)
+		if c.err {
+			if err == nil {
+				t.Errorf("%+v: want an error", c.schema)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, c.names) || !reflect.DeepEqual(series, c.series) {
+			t.Errorf("%+v: want %v %v, got %v %v", c.schema, c.names, c.series, names, series)
+		}
+	}
+
+	// values which are not numbers are NaN with empty
+	cfg := &kvCfg{Type: kvCollectorTypeOSQuery, Schema: &kvSchema{Labels: []string{"type"}, Value: "hard_limit", Missing: "empty"}}
+	cfg.parseSchema()
+	_, series, _ := cfg.series(rows[1:2])
+	if len(series) != 1 || !math.IsNaN(series[0].value) {
+		t.Errorf("want a NaN value, got %v", series)
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	for _, c := range []struct {
+		cfg kvCfg
+		ok  bool
+	}{
+		{kvCfg{Type: kvCollectorTypeNative, Columns: []string{"total_seconds"}, Schema: &kvSchema{Value: "total_seconds", Type: "counter"}}, true},
+		{kvCfg{Type: kvCollectorTypeNative, Columns: []string{"days"}, Schema: &kvSchema{Value: "total_seconds"}}, false},
+		{kvCfg{Type: kvCollectorTypeOSQuery, Schema: &kvSchema{Type: "counter"}}, false},
+		{kvCfg{Type: kvCollectorTypeOSQuery, Schema: &kvSchema{Type: "summary"}}, false},
+		{kvCfg{Type: kvCollectorTypeOSQuery, Schema: &kvSchema{Labels: []string{"a", "a"}}}, false},
+		{kvCfg{Type: kvCollectorTypeOSQuery, Schema: &kvSchema{Labels: []string{"a-b"}}}, false},
+		{kvCfg{Type: kvCollectorTypeOSQuery, Schema: &kvSchema{Labels: []string{"a"}, Value: "a"}}, false},
+		{kvCfg{Type: kvCollectorTypeOSQuery, Schema: &kvSchema{Missing: "zero"}}, false},
+		{kvCfg{Type: kvCollectorTypeCat, Schema: &kvSchema{}}, false},
+	} {
+		if err := c.cfg.parseSchema(); (err == nil) != c.ok {
+			t.Errorf("%+v: unexpected result %v", c.cfg.Schema, err)
+		}
+	}
+}
+
+func TestSeriesLabelNames(t *testing.T) {
+	// the keys of sysctl and of json documents are not label names
+	rows, err := parseKVRows([]byte("net.ipv4.ip_forward = 1\nvm-swappiness: 60\n2fa=on\n__meta_zone=a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &kvCfg{SubSystem: "sysctl", Type: kvCollectorTypeExec}
+	names, series, err := cfg.series(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"_2fa", "exported__meta_zone", "net_ipv4_ip_forward", "vm_swappiness"}
+	if !reflect.DeepEqual(names, want) || len(series) != 1 || !reflect.DeepEqual(series[0].labels, []string{"on", "a", "1", "60"}) {
+		t.Errorf("want %v, got %v %v", want, names, series)
+	}
+
+	// the series can be exported
+	desc := prometheus.NewDesc(MetricName(cfg.SubSystem), "", names, nil)
+	if _, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, series[0].value, series[0].labels...); err != nil {
+		t.Errorf("want a valid metric, got %s", err)
+	}
+
+	rows, err = parseJSONRows([]byte(`{"foo-bar": "x", "foo.bar": "y"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cfg.series(rows); err == nil || !strings.Contains(err.Error(), `exported as label "foo_bar"`) {
+		t.Errorf("want an error for columns with the same label name, got %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A minimal client of the osquery ExtensionManager thrift service, only
+// its query() method is implemented, over the binary protocol and the
+// buffered transport osqueryd uses on its extension socket:
+//
+//	ExtensionResponse query(1:string sql)
+
+const (
+	thriftVersion1 = 0x80010000
+
+	thriftMsgCall      = 1
+	thriftMsgReply     = 2
+	thriftMsgException = 3
+
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftByte   = 3
+	thriftDouble = 4
+	thriftI16    = 6
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftMap    = 13
+	thriftSet    = 14
+	thriftList   = 15
+
+	// limits of the sizes read, against a corrupted stream
+	thriftMaxString = 64 << 20
+	thriftMaxItems  = 1 << 24
+)
+
+// osqueryStatusError is a query failed by osqueryd, such as a SQL error. The
+// daemon itself works.
+type osqueryStatusError struct {
+	code    int32
+	message string
+}
+
+func (e *osqueryStatusError) Error() string {
+	return fmt.Sprintf("osqueryd: %s (code %d)", e.message, e.code)
+}
+
+// thriftQuery runs sql on the osqueryd extension socket, the whole call is
+// bounded by timeout.
+func thriftQuery(socket, sql string, timeout time.Duration) ([]map[string]string, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	w := &thriftWriter{w: bufio.NewWriter(conn)}
+	w.i32(thriftVersion1 | thriftMsgCall)
+	w.str("query")
+	w.i32(1) // seqid
+	w.fieldHeader(thriftString, 1)
+	w.str(sql)
+	w.byte(thriftStop)
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+
+	r := &thriftReader{r: bufio.NewReader(conn)}
+	return r.queryReply()
+}
+
+type thriftWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *thriftWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *thriftWriter) byte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *thriftWriter) i16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	w.write(b[:])
+}
+
+func (w *thriftWriter) i32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.write(b[:])
+}
+
+func (w *thriftWriter) str(s string) {
+	w.i32(uint32(len(s)))
+	w.write([]byte(s))
+}
+
+func (w *thriftWriter) fieldHeader(typ byte, id int16) {
+	w.byte(typ)
+	w.i16(id)
+}
+
+func (w *thriftWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+type thriftReader struct {
+	r *bufio.Reader
+}
+
+func (r *thriftReader) byte() (byte, error) {
+	return r.r.ReadByte()
+}
+
+func (r *thriftReader) i16() (int16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return 0, err
+	}
+	return int16(binary.BigEndian.Uint16(b[:])), nil
+}
+
+func (r *thriftReader) i32() (int32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(b[:])), nil
+}
+
+func (r *thriftReader) i64() (int64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:])), nil
+}
+
+func (r *thriftReader) str() (string, error) {
+	n, err := r.i32()
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n > thriftMaxString {
+		return "", fmt.Errorf("thrift: invalid string size %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (r *thriftReader) size() (int, error) {
+	n, err := r.i32()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > thriftMaxItems {
+		return 0, fmt.Errorf("thrift: invalid container size %d", n)
+	}
+	return int(n), nil
+}
+
+// fields reads the fields of a struct, calling read for each of them. read
+// returns false for the fields it does not know, which are skipped.
+func (r *thriftReader) fields(read func(typ byte, id int16) (bool, error)) error {
+	for {
+		typ, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if typ == thriftStop {
+			return nil
+		}
+		id, err := r.i16()
+		if err != nil {
+			return err
+		}
+
+		ok, err := read(typ, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := r.skip(typ); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *thriftReader) skip(typ byte) error {
+	var err error
+	switch typ {
+	case thriftBool, thriftByte:
+		_, err = r.byte()
+	case thriftI16:
+		_, err = r.i16()
+	case thriftI32:
+		_, err = r.i32()
+	case thriftI64, thriftDouble:
+		_, err = r.i64()
+	case thriftString:
+		_, err = r.str()
+	case thriftStruct:
+		err = r.fields(func(byte, int16) (bool, error) { return false, nil })
+	case thriftMap:
+		var kt, vt byte
+		var n int
+		if kt, err = r.byte(); err != nil {
+			return err
+		}
+		if vt, err = r.byte(); err != nil {
+			return err
+		}
+		if n, err = r.size(); err != nil {
+			return err
+		}
+		for i := 0; i < n && err == nil; i++ {
+			if err = r.skip(kt); err == nil {
+				err = r.skip(vt)
+			}
+		}
+	case thriftSet, thriftList:
+		var et byte
+		var n int
+		if et, err = r.byte(); err != nil {
+			return err
+		}
+		if n, err = r.size(); err != nil {
+			return err
+		}
+		for i := 0; i < n && err == nil; i++ {
+			err = r.skip(et)
+		}
+	default:
+		err = fmt.Errorf("thrift: unknown type %d", typ)
+	}
+	return err
+}
+
+// queryReply reads the reply of a query() call.
+func (r *thriftReader) queryReply() ([]map[string]string, error) {
+	header, err := r.i32()
+	if err != nil {
+		return nil, err
+	}
+
+	var typ byte
+	if header < 0 {
+		if uint32(header)&0xffff0000 != thriftVersion1 {
+			return nil, fmt.Errorf("thrift: bad version %#x", uint32(header))
+		}
+		typ = byte(header & 0xff)
+		if _, err := r.str(); err != nil {
+			return nil, err
+		}
+	} else {
+		// old non strict header: name, type
+		name := make([]byte, header)
+		if _, err := io.ReadFull(r.r, name); err != nil {
+			return nil, err
+		}
+		if typ, err = r.byte(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := r.i32(); err != nil { // seqid
+		return nil, err
+	}
+
+	switch typ {
+	case thriftMsgReply:
+	case thriftMsgException:
+		return nil, r.exception()
+	default:
+		return nil, fmt.Errorf("thrift: unexpected message type %d", typ)
+	}
+
+	var rows []map[string]string
+	var status *osqueryStatusError
+	found := false
+
+	err = r.fields(func(typ byte, id int16) (bool, error) {
+		if id != 0 || typ != thriftStruct { // the success field of the result
+			return false, nil
+		}
+		found = true
+		return true, r.fields(func(typ byte, id int16) (bool, error) {
+			switch {
+			case id == 1 && typ == thriftStruct:
+				s, err := r.status()
+				status = s
+				return true, err
+			case id == 2 && typ == thriftList:
+				var err error
+				rows, err = r.rows()
+				return true, err
+			}
+			return false, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("thrift: query returned no result")
+	}
+	if status != nil && status.code != 0 {
+		return nil, status
+	}
+	return rows, nil
+}
+
+func (r *thriftReader) status() (*osqueryStatusError, error) {
+	s := &osqueryStatusError{}
+	err := r.fields(func(typ byte, id int16) (bool, error) {
+		var err error
+		switch {
+		case id == 1 && typ == thriftI32:
+			s.code, err = r.i32()
+		case id == 2 && typ == thriftString:
+			s.message, err = r.str()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return s, err
+}
+
+// rows reads a list<map<string, string>>, the list header is not read yet.
+func (r *thriftReader) rows() ([]map[string]string, error) {
+	et, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	n, err := r.size()
+	if err != nil {
+		return nil, err
+	}
+	if et != thriftMap {
+		for i := 0; i < n; i++ {
+			if err := r.skip(et); err != nil {
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("thrift: unexpected row type %d", et)
+	}
+
+	rows := make([]map[string]string, 0, n)
+	for i := 0; i < n; i++ {
+		kt, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		vt, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		m, err := r.size()
+		if err != nil {
+			return nil, err
+		}
+		if kt != thriftString || vt != thriftString {
+			return nil, fmt.Errorf("thrift: unexpected column types %d, %d", kt, vt)
+		}
+
+		row := make(map[string]string, m)
+		for j := 0; j < m; j++ {
+			k, err := r.str()
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.str()
+			if err != nil {
+				return nil, err
+			}
+			row[k] = v
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// exception reads a TApplicationException.
+func (r *thriftReader) exception() error {
+	var msg string
+	var code int32
+	err := r.fields(func(typ byte, id int16) (bool, error) {
+		var err error
+		switch {
+		case id == 1 && typ == thriftString:
+			msg, err = r.str()
+		case id == 2 && typ == thriftI32:
+			code, err = r.i32()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("thrift: application exception %d: %s", code, msg)
+}
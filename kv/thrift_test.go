@@ -0,0 +1,171 @@
+package kv
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serveQuery serves a single query() call on socket, checking the sql sent
+// and answering with reply.
+func serveQuery(t *testing.T, socket, sql string, reply func(w *thriftWriter)) {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := &thriftReader{r: bufio.NewReader(conn)}
+		if header, _ := r.i32(); uint32(header) != thriftVersion1|thriftMsgCall {
+			t.Errorf("bad header %#x", uint32(header))
+		}
+		if name, _ := r.str(); name != "query" {
+			t.Errorf("bad method %q", name)
+		}
+		r.i32() // seqid
+
+		var got string
+		r.fields(func(typ byte, id int16) (bool, error) {
+			if id != 1 || typ != thriftString {
+				return false, nil
+			}
+			var err error
+			got, err = r.str()
+			return true, err
+		})
+		if got != sql {
+			t.Errorf("sql: want %q, got %q", sql, got)
+		}
+
+		w := &thriftWriter{w: bufio.NewWriter(conn)}
+		reply(w)
+		w.flush()
+	}()
+}
+
+func writeReply(w *thriftWriter, code int32, message string, rows []map[string]string) {
+	w.i32(thriftVersion1 | thriftMsgReply)
+	w.str("query")
+	w.i32(1)
+
+	w.fieldHeader(thriftStruct, 0)
+
+	w.fieldHeader(thriftStruct, 1)
+	w.fieldHeader(thriftI32, 1)
+	w.i32(uint32(code))
+	w.fieldHeader(thriftString, 2)
+	w.str(message)
+	w.fieldHeader(thriftI64, 3) // uuid, skipped
+	w.i32(0)
+	w.i32(42)
+	w.byte(thriftStop)
+
+	w.fieldHeader(thriftList, 2)
+	w.byte(thriftMap)
+	w.i32(uint32(len(rows)))
+	for _, row := range rows {
+		w.byte(thriftString)
+		w.byte(thriftString)
+		w.i32(uint32(len(row)))
+		for k, v := range row {
+			w.str(k)
+			w.str(v)
+		}
+	}
+
+	w.byte(thriftStop) // ExtensionResponse
+	w.byte(thriftStop) // result
+}
+
+func TestThriftQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rows := []map[string]string{
+		{"username": "root", "uid": "0"},
+		{"username": "nobody", "uid": "65534"},
+	}
+
+	for _, c := range []struct {
+		name  string
+		reply func(w *thriftWriter)
+		rows  []map[string]string
+		err   string
+	}{
+		{
+			name:  "rows",
+			reply: func(w *thriftWriter) { writeReply(w, 0, "OK", rows) },
+			rows:  rows,
+		},
+		{
+			name:  "status",
+			reply: func(w *thriftWriter) { writeReply(w, 1, "no such table: userz", nil) },
+			err:   "osqueryd: no such table: userz (code 1)",
+		},
+		{
+			name: "exception",
+			reply: func(w *thriftWriter) {
+				w.i32(thriftVersion1 | thriftMsgException)
+				w.str("query")
+				w.i32(1)
+				w.fieldHeader(thriftString, 1)
+				w.str("Internal error")
+				w.fieldHeader(thriftI32, 2)
+				w.i32(6)
+				w.byte(thriftStop)
+			},
+			err: "thrift: application exception 6: Internal error",
+		},
+	} {
+		socket := filepath.Join(dir, c.name+".em")
+		serveQuery(t, socket, "select * from users", c.reply)
+
+		got, err := thriftQuery(socket, "select * from users", time.Second)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: want error %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.rows) {
+			t.Errorf("%s: want %v, got %v", c.name, c.rows, got)
+		}
+	}
+}
+
+func TestThriftQueryTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "osquery.em")
+	serveQuery(t, socket, "select 1", func(w *thriftWriter) {
+		time.Sleep(time.Second)
+	})
+
+	_, err = thriftQuery(socket, "select 1", 100*time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("want a timeout, got %v", err)
+	}
+}
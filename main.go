@@ -15,35 +15,67 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/node_exporter/collector"
 	"github.com/prometheus/node_exporter/fileinfo"
 	"github.com/prometheus/node_exporter/git"
 	"github.com/prometheus/node_exporter/handler"
 	"github.com/prometheus/node_exporter/kv"
+	"github.com/prometheus/node_exporter/redact"
 	"github.com/prometheus/node_exporter/utils"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+const (
+	defaultKvCfg       = `/usr/local/cloudcare/ft_node_exporter/kv.json`
+	defaultFileinfoCfg = `/usr/local/cloudcare/ft_node_exporter/fileinfo.json`
+)
+
 var (
 	metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
 	kvJsonUrlPath = kingpin.Flag("web.telemetry-env-info-path", "Path under which to expose env info.").Default("/kvs/json").String()
 	//kvUrlPath       = kingpin.Flag("web.telemetry-env-info-path", "Path under which to expose env info.").Default("/kvs").String()
 	fileinfoUrlPath = kingpin.Flag("web.telemetry-file-info-path", "Path under which to expose file info.").Default("/fileinfos").String()
 
+	collectorStatusPath = kingpin.Flag("web.collector-status-path", "Path under which to expose the collectors health status as JSON.").Default("/collectors/status").String()
+
+	metricsCollectInterval  = kingpin.Flag("collector.background-interval", "Collect node metrics in the background on this interval and serve the last snapshot, 0 collects on every scrape.").Default("0s").Duration()
+	kvCollectInterval       = kingpin.Flag("kv.background-interval", "Collect kv metrics in the background on this interval and serve the last snapshot, 0 collects on every scrape.").Default("0s").Duration()
+	fileinfoCollectInterval = kingpin.Flag("fileinfo.background-interval", "Collect file info in the background on this interval and serve the last snapshot, 0 collects on every scrape.").Default("0s").Duration()
+
+	adminTokenFile = kingpin.Flag("web.admin-token-file", "File holding the bearer token of the admin API under /api/collectors and of /-/reload, both are disabled if unset.").Default("").String()
+	adminStateFile = kingpin.Flag("web.admin-state-file", "File the collector changes made through the admin API are saved to, they are not saved if unset.").Default("").String()
+
 	disableExporterMetrics = kingpin.Flag("web.disable-exporter-metrics", "Exclude metrics about the exporter itself (promhttp_*, process_*, go_*).").Bool()
 
 	flagBindAddr = kingpin.Flag("bind-addr", `http server bind addr`).Default(`localhost:9100`).String()
 
-	flagKvCfg       = kingpin.Flag("env-cfg", "env-collector configure").Default(`/usr/local/cloudcare/ft_node_exporter/kv.json`).String()
-	flagFileinfoCfg = kingpin.Flag("fileinfo-cfg", "cfg-collector configure").Default(`/usr/local/cloudcare/ft_node_exporter/fileinfo.json`).String()
+	flagConfigFile  = kingpin.Flag("config.file", "unified YAML/JSON configure file, reloaded on SIGHUP or a POST to /-/reload").Default("").String()
+	flagKvCfg       = kingpin.Flag("env-cfg", "env-collector configure").Default(defaultKvCfg).String()
+	flagFileinfoCfg = kingpin.Flag("fileinfo-cfg", "cfg-collector configure").Default(defaultFileinfoCfg).String()
+
+	flagLabelsCfg = kingpin.Flag("labels-cfg", "configure of the labels added to every metric, such as host identity labels").Default("").String()
+
+	flagRelabelCfg = kingpin.Flag("relabel-cfg", "configure of the relabel rules applied to every metric").Default("").String()
 
-	flagEnableAllCollectors = kingpin.Flag("enable-all", "enable all collectors").Default(`1`).Int()
+	flagEnableAllCollectors = kingpin.Flag("enable-all", "enable all collectors not disabled explicitly by --no-collector.<name> flags").Default(`0`).Int()
+
+	serveCmd           = kingpin.Command("serve", "Run the exporter.").Default()
+	checkConfigCmd     = kingpin.Command("check-config", "Check the configuration, reporting every problem found, and exit.")
+	checkDryRun        = checkConfigCmd.Flag("dry-run", "Run every enabled collector once and print a summary.").Bool()
+	checkDryRunTimeout = checkConfigCmd.Flag("dry-run.timeout", "Time after which a collector run by --dry-run is abandoned.").Default("30s").Duration()
+	checkMaxFileSize   = checkConfigCmd.Flag("max-file-size", "Files and directories of fileinfo larger than this are reported, 0 disables the check.").Default("4MB").Bytes()
 
 	flagVersionInfo = kingpin.Flag("version", "show version info").Bool()
 	flagInstallDir  = kingpin.Flag("install-dir", "install directory").Default(`/usr/local/cloudcare/ft_node_exporter/`).String()
@@ -58,15 +90,44 @@ func main() {
 	version.Version = git.Version
 	version.BuildDate = git.BuildAt
 
-	logfilepath := fmt.Sprintf("%s%s.log", *flagInstallDir, AppName)
-	rw, err := utils.SetLog(logfilepath)
+	// check-config reports the problems instead of dying at the first one,
+	// and logs to stderr
+	checking := isCheckConfig(os.Args[1:])
+
+	if !checking {
+		logfilepath := fmt.Sprintf("%s%s.log", *flagInstallDir, AppName)
+		rw, err := utils.SetLog(logfilepath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rw.Close()
+	}
+
+	// kv and fileinfo collectors come from the config, load it before
+	// parsing so that their --[no-]kv.collector.<name> and
+	// --[no-]fileinfo.collector.<name> flags are known to kingpin
+	cfgFiles := handler.ConfigFiles{
+		File:     preParseFlag(os.Args[1:], "config.file", ""),
+		Kv:       preParseFlag(os.Args[1:], "env-cfg", defaultKvCfg),
+		Fileinfo: preParseFlag(os.Args[1:], "fileinfo-cfg", defaultFileinfoCfg),
+	}
+	cfg, err := handler.LoadConfig(cfgFiles)
+	if err == nil {
+		if err = kv.Init(cfg.Kv); err != nil {
+			err = fmt.Errorf("init kv collectors failed: %s", err)
+		} else if err = fileinfo.Init(cfg.Fileinfo); err != nil {
+			err = fmt.Errorf("init fileinfo collectors failed: %s", err)
+		}
+	}
 	if err != nil {
-		log.Fatal(err)
+		if !checking {
+			log.Fatalf("[fatal] %s", err)
+		}
+		cfg = nil
 	}
-	defer rw.Close()
 
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	if *flagVersionInfo {
 		fmt.Printf(`Version:        %s
 Sha1:           %s
@@ -76,15 +137,95 @@ Golang Version: %s
 		return
 	}
 
-	// init kv configure
+	if *flagEnableAllCollectors != 0 {
+		collector.EnableAllCollectors()
+		kv.EnableAllCollectors()
+		fileinfo.EnableAllCollectors()
+	}
+
 	kv.OSQuerydPath = filepath.Join(*flagInstallDir, `osqueryd`)
-	kv.Init(*flagKvCfg)
-	fileinfo.Init(*flagFileinfoCfg)
 
-	http.Handle(*kvJsonUrlPath, handler.NewKvHandler())
-	http.Handle("/kvs", handler.NewKvHandler())
-	http.Handle(*fileinfoUrlPath, handler.NewFileInfoHandler())
-	http.Handle(*metricsPath, handler.NewMetricHandler(!*disableExporterMetrics))
+	if command == checkConfigCmd.FullCommand() {
+		os.Exit(checkConfig(cfgFiles, cfg))
+	}
+
+	if *flagLabelsCfg != "" {
+		if err := handler.LoadConstLabels(*flagLabelsCfg); err != nil {
+			log.Fatalf("[fatal] %s", err)
+		}
+	}
+
+	if *flagRelabelCfg != "" {
+		if err := handler.LoadRelabelRules(*flagRelabelCfg); err != nil {
+			log.Fatalf("[fatal] %s", err)
+		}
+	}
+
+	if err := handler.ApplyConfig(cfg); err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+	applyWebConfig(cfg.Web)
+
+	if err := kv.StartOSQueryd(*flagInstallDir); err != nil {
+		log.Printf("[error] start osqueryd daemon failed: %s, use shell mode", err)
+	}
+
+	// before any collector hashes a value
+	if err := redact.LoadSalt(*flagInstallDir); err != nil {
+		log.Printf("[error] %s, hashes only hold for this run", err)
+	}
+
+	if err := kv.LoadChanges(*flagInstallDir); err != nil {
+		log.Printf("[error] %s, kv changes start from scratch", err)
+	}
+
+	// the changes made through the admin API win over the config
+	if err := handler.LoadCollectorStates(*adminStateFile); err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+
+	kvHandler := handler.NewKvHandler(*kvCollectInterval)
+	fileinfoHandler := handler.NewFileInfoHandler(*fileinfoCollectInterval)
+	metricHandler := handler.NewMetricHandler(!*disableExporterMetrics, *metricsCollectInterval)
+
+	http.Handle(*kvJsonUrlPath, kvHandler)
+	http.Handle("/kvs", kvHandler)
+	http.Handle(*fileinfoUrlPath, fileinfoHandler)
+	http.Handle(*metricsPath, metricHandler)
+	http.Handle(*collectorStatusPath, handler.NewCollectorStatusHandler())
+	http.Handle(handler.KvChangesPath, handler.NewKvChangesHandler())
+
+	var adminToken string
+	if *adminTokenFile != "" {
+		token, err := ioutil.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatalf("[fatal] read admin token failed: %s", err)
+		}
+		adminToken = strings.TrimSpace(string(token))
+	}
+
+	reloader := handler.NewReloader(cfgFiles, adminToken, metricHandler, kvHandler, fileinfoHandler)
+
+	// without a token, the admin API and the reload endpoint are not served,
+	// the config is still reloaded on SIGHUP
+	if adminToken != "" {
+		adminHandler := handler.NewAdminHandler(adminToken, *adminStateFile, metricHandler, kvHandler, fileinfoHandler)
+		http.Handle(handler.AdminCollectorsPath, adminHandler)
+		http.Handle(handler.AdminCollectorsPath+"/", adminHandler)
+		http.Handle(handler.ReloadPath, reloader)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloader.Reload(); err != nil {
+				log.Printf("[error] reload config failed: %s", err)
+				continue
+			}
+			log.Printf("[info] config reloaded")
+		}
+	}()
 
 	l, err := net.Listen(`tcp`, *flagBindAddr)
 	if err != nil {
@@ -100,3 +241,95 @@ Golang Version: %s
 		log.Println("[fatal]", err)
 	}
 }
+
+// applyWebConfig sets the listen address and the paths from the web section
+// of the config, flags given explicitly on the command line win over it.
+func applyWebConfig(web handler.WebConfig) {
+	for _, s := range []struct {
+		flag  string
+		value *string
+		cfg   string
+	}{
+		{"bind-addr", flagBindAddr, web.ListenAddress},
+		{"web.telemetry-path", metricsPath, web.TelemetryPath},
+		{"web.telemetry-env-info-path", kvJsonUrlPath, web.KvPath},
+		{"web.telemetry-file-info-path", fileinfoUrlPath, web.FileinfoPath},
+	} {
+		f := kingpin.CommandLine.GetFlag(s.flag)
+		if s.cfg == "" || f == nil || *s.value != strings.Join(f.Model().Default, ",") {
+			continue
+		}
+		*s.value = s.cfg
+	}
+}
+
+// checkConfig runs the check-config command, cfg is nil if the config
+// could not be loaded. It returns the exit code, 1 if a problem which is
+// not a warning is found.
+func checkConfig(files handler.ConfigFiles, cfg *handler.Config) int {
+	code := 0
+
+	problems := handler.CheckConfig(files, int64(*checkMaxFileSize))
+	for _, p := range problems {
+		fmt.Println(p)
+		if !p.Warning {
+			code = 1
+		}
+	}
+	fmt.Printf("%d problem(s) found\n", len(problems))
+
+	if *checkDryRun && cfg != nil {
+		if err := handler.ApplyConfig(cfg); err != nil {
+			fmt.Printf("dry run skipped: %s\n", err)
+			return 1
+		}
+
+		fmt.Println()
+		handler.PrintDryRun(os.Stdout, handler.DryRun(*checkDryRunTimeout))
+	}
+	return code
+}
+
+// isCheckConfig reports whether the check-config command is run, that is
+// whether it is the first positional argument of args. It runs before
+// kingpin.Parse(), so flags are skipped along with their value by looking
+// them up in the model, flags not registered yet are the boolean
+// --[no-]kv.collector.<name> and --[no-]fileinfo.collector.<name> ones.
+func isCheckConfig(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return i+1 < len(args) && args[i+1] == checkConfigCmd.FullCommand()
+		case strings.HasPrefix(arg, "--"):
+			if !strings.Contains(arg, "=") && flagTakesValue(strings.TrimPrefix(arg, "--")) {
+				i++
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			// short flags, only -h is defined
+		default:
+			return arg == checkConfigCmd.FullCommand()
+		}
+	}
+	return false
+}
+
+func flagTakesValue(name string) bool {
+	f := kingpin.CommandLine.GetFlag(name)
+	return f != nil && !f.Model().IsBoolFlag()
+}
+
+// preParseFlag returns the value of the long flag name in args, or def if
+// the flag is absent. It is only used for the flags that must be known
+// before kingpin.Parse() runs.
+func preParseFlag(args []string, name, def string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--"+name && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, "--"+name+"="):
+			return strings.TrimPrefix(arg, "--"+name+"=")
+		}
+	}
+	return def
+}
@@ -145,3 +145,26 @@ func TestOSQuery(t *testing.T) {
 		fmt.Printf("%s", string(out))
 	}
 }
+
+func TestIsCheckConfig(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"check-config"}, true},
+		{[]string{"check-config", "--dry-run"}, true},
+		{[]string{"--env-cfg", "kv.json", "check-config"}, true},
+		{[]string{"--env-cfg=kv.json", "--no-kv.collector.users", "check-config"}, true},
+		{[]string{"--", "check-config"}, true},
+		{[]string{}, false},
+		{[]string{"serve"}, false},
+		{[]string{"serve", "check-config"}, false},
+		// flag values are not commands
+		{[]string{"--web.telemetry-path", "check-config"}, false},
+		{[]string{"--env-cfg", "check-config"}, false},
+	} {
+		if got := isCheckConfig(c.args); got != c.want {
+			t.Errorf("%q: want %v, got %v", c.args, c.want, got)
+		}
+	}
+}
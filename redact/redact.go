@@ -0,0 +1,318 @@
+// Package redact applies the redaction rules of the kv entries and fileinfo
+// groups to their rows and file contents, before they are exported.
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	ActionDrop = "drop"
+	ActionHash = "hash"
+	ActionMask = "mask"
+
+	defaultReplacement = "[REDACTED]"
+
+	// ReadMargin is how much of a file is read past its size limit to be
+	// redacted, a secret crossing the limit still matches its rule and a
+	// file is never read whole because it has rules
+	ReadMargin = 64 << 10
+)
+
+var (
+	saltFile = kingpin.Flag("redact.salt-file", "File holding the salt of the hashes of the redaction rules, created on first start, redact.salt under the install directory if unset.").Default("").String()
+
+	// salt is random until LoadSalt, the hashes then only hold for the run
+	saltMtx = sync.RWMutex{}
+	salt    = newSalt()
+)
+
+// Rule is a redaction rule:
+//
+//	drop: drops the Columns of the rows; drops the files, or their lines
+//	      matching Regex if set
+//	hash: replaces the values of Columns, or the parts of them matching
+//	      Regex, with their salted hash; a Regex with a group only hashes
+//	      the group
+//	mask: replaces the parts matching Regex, of Columns or of every column,
+//	      with Replacement ([REDACTED] by default, $1 expands to a group)
+//
+// Columns only apply to rows, and Files only to file contents. Files are
+// glob patterns of the paths, or of the file names if they have no /.
+type Rule struct {
+	Action      string   `json:"action"`
+	Columns     []string `json:"columns"`
+	Files       []string `json:"files"`
+	Regex       string   `json:"regex"`
+	Replacement string   `json:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// RuleError is an invalid rule, Field is the json name of its invalid
+// field.
+type RuleError struct {
+	Index int
+	Field string
+	Msg   string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("redact rule %d: %s", e.Index, e.Msg)
+}
+
+// Counts are the number of values, lines or files redacted by action.
+type Counts map[string]int
+
+// Compile checks and compiles rules, applied to file contents if content is
+// set, to rows otherwise.
+func Compile(rules []*Rule, content bool) error {
+	for i, r := range rules {
+		fail := func(field, format string, args ...interface{}) error {
+			return &RuleError{Index: i, Field: field, Msg: fmt.Sprintf(format, args...)}
+		}
+
+		if r == nil {
+			return fail("", "empty rule")
+		}
+
+		switch r.Action {
+		case ActionDrop, ActionHash, ActionMask:
+		default:
+			return fail("action", "unknown action %q", r.Action)
+		}
+
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return fail("regex", "invalid regex: %s", err)
+			}
+			r.re = re
+		}
+		for _, f := range r.Files {
+			if _, err := filepath.Match(f, ""); err != nil {
+				return fail("files", "invalid pattern %q: %s", f, err)
+			}
+		}
+
+		if content {
+			if len(r.Columns) > 0 {
+				return fail("columns", "columns only apply to rows")
+			}
+			if r.Action != ActionDrop && r.re == nil {
+				return fail("regex", "regex missing")
+			}
+			continue
+		}
+
+		if len(r.Files) > 0 {
+			return fail("files", "files only apply to file contents")
+		}
+		switch {
+		case r.Action == ActionDrop && len(r.Columns) == 0:
+			return fail("columns", "columns missing")
+		case r.Action == ActionDrop && r.re != nil:
+			return fail("regex", "regex not supported by drop on rows")
+		case r.Action == ActionHash && len(r.Columns) == 0 && r.re == nil:
+			return fail("columns", "columns or regex missing")
+		case r.Action == ActionMask && r.re == nil:
+			return fail("regex", "regex missing")
+		}
+	}
+	return nil
+}
+
+// Rows redacts rows in place.
+func Rows(rules []*Rule, rows []map[string]string) Counts {
+	counts := Counts{}
+	for _, r := range rules {
+		for _, row := range rows {
+			if r.Action == ActionDrop {
+				for _, c := range r.Columns {
+					if _, ok := row[c]; ok {
+						delete(row, c)
+						counts[r.Action]++
+					}
+				}
+				continue
+			}
+
+			for c, v := range row {
+				if len(r.Columns) > 0 && !contains(r.Columns, c) {
+					continue
+				}
+				if nv := r.apply(v); nv != v {
+					row[c] = nv
+					counts[r.Action]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// Content redacts the content of the file path, it returns false if the
+// file is dropped.
+func Content(rules []*Rule, path string, content []byte) ([]byte, bool, Counts) {
+	counts := Counts{}
+	for _, r := range rules {
+		if !r.matchFile(path) {
+			continue
+		}
+
+		switch {
+		case r.Action == ActionDrop && r.re == nil:
+			counts[r.Action]++
+			return nil, false, counts
+		case r.Action == ActionDrop:
+			var kept [][]byte
+			lines := bytes.SplitAfter(content, []byte("\n"))
+			for _, line := range lines {
+				if r.re.Match(bytes.TrimRight(line, "\r\n")) {
+					counts[r.Action]++
+					continue
+				}
+				kept = append(kept, line)
+			}
+			content = bytes.Join(kept, nil)
+		default:
+			nc := []byte(r.apply(string(content)))
+			if !bytes.Equal(nc, content) {
+				counts[r.Action]++
+				content = nc
+			}
+		}
+	}
+	return content, true, counts
+}
+
+// apply hashes or masks v.
+func (r *Rule) apply(v string) string {
+	if r.Action == ActionMask {
+		replacement := r.Replacement
+		if replacement == "" {
+			replacement = defaultReplacement
+		}
+		return r.re.ReplaceAllString(v, replacement)
+	}
+
+	if r.re == nil {
+		if v == "" {
+			return v
+		}
+		return Hash(v)
+	}
+	if r.re.NumSubexp() == 0 {
+		return r.re.ReplaceAllStringFunc(v, Hash)
+	}
+
+	// only the first group of each match
+	var b strings.Builder
+	last := 0
+	for _, m := range r.re.FindAllStringSubmatchIndex(v, -1) {
+		if m[2] < 0 {
+			continue
+		}
+		b.WriteString(v[last:m[2]])
+		b.WriteString(Hash(v[m[2]:m[3]]))
+		last = m[3]
+	}
+	b.WriteString(v[last:])
+	return b.String()
+}
+
+func (r *Rule) matchFile(path string) bool {
+	if len(r.Files) == 0 {
+		return true
+	}
+	for _, f := range r.Files {
+		name := path
+		if !strings.Contains(f, "/") {
+			name = filepath.Base(path)
+		}
+		if ok, _ := filepath.Match(f, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadLimit returns how much of a file cut at limit bytes is read to be
+// redacted, limit is ignored if negative.
+func ReadLimit(limit int64) int64 {
+	if limit < 0 {
+		return limit
+	}
+	return limit + ReadMargin
+}
+
+// Hash returns the salted hash of v, the same on an install for the same
+// value.
+func Hash(v string) string {
+	saltMtx.RLock()
+	mac := hmac.New(sha256.New, salt)
+	saltMtx.RUnlock()
+
+	mac.Write([]byte(v))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// LoadSalt loads the salt of the hashes, from --redact.salt-file or
+// redact.salt under dir. A random salt is saved to it if it does not
+// exist.
+func LoadSalt(dir string) error {
+	file := *saltFile
+	if file == "" {
+		file = filepath.Join(dir, "redact.salt")
+	}
+
+	s, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		s = newSalt()
+		if err := ioutil.WriteFile(file, s, 0600); err != nil {
+			return fmt.Errorf("save redact salt failed: %s", err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	s = bytes.TrimSpace(s)
+	if len(s) == 0 {
+		return fmt.Errorf("empty redact salt %s", file)
+	}
+
+	saltMtx.Lock()
+	salt = s
+	saltMtx.Unlock()
+	return nil
+}
+
+func newSalt() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return []byte(hex.EncodeToString(b))
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package redact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	for _, c := range []struct {
+		rule    Rule
+		content bool
+		field   string
+	}{
+		{Rule{Action: "drop", Columns: []string{"key"}}, false, ""},
+		{Rule{Action: "hash", Regex: `\$6\$\S+`}, false, ""},
+		{Rule{Action: "drop", Files: []string{"/etc/shadow"}}, true, ""},
+		{Rule{Action: "erase", Columns: []string{"key"}}, false, "action"},
+		{Rule{Action: "drop"}, false, "columns"},
+		{Rule{Action: "drop", Columns: []string{"key"}, Regex: "x"}, false, "regex"},
+		{Rule{Action: "hash"}, false, "columns"},
+		{Rule{Action: "mask", Columns: []string{"key"}}, false, "regex"},
+		{Rule{Action: "mask", Regex: "("}, false, "regex"},
+		{Rule{Action: "mask", Regex: "x", Files: []string{"/etc/*"}}, false, "files"},
+		{Rule{Action: "hash", Columns: []string{"key"}}, true, "columns"},
+		{Rule{Action: "mask"}, true, "regex"},
+		{Rule{Action: "drop", Files: []string{"["}}, true, "files"},
+	} {
+		r := c.rule
+		err := Compile([]*Rule{&r}, c.content)
+		if c.field == "" && err != nil {
+			t.Errorf("%+v: unexpected error %s", c.rule, err)
+		}
+		if c.field != "" && (err == nil || err.(*RuleError).Field != c.field) {
+			t.Errorf("%+v: want an error on %s, got %v", c.rule, c.field, err)
+		}
+	}
+}
+
+func TestRows(t *testing.T) {
+	rules := []*Rule{
+		{Action: "drop", Columns: []string{"comment"}},
+		{Action: "hash", Columns: []string{"key"}},
+		{Action: "hash", Columns: []string{"options"}, Regex: `token=(\w+)`},
+		{Action: "mask", Regex: `\$6\$[^:\s]+`},
+	}
+	if err := Compile(rules, false); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []map[string]string{
+		{"key": "AAAAB3Nza", "comment": "root@host", "options": "from=x,token=abc", "password": "$6$salt$hash"},
+		{"key": "", "options": "", "password": "!"},
+	}
+	counts := Rows(rules, rows)
+
+	want := []map[string]string{
+		{"key": Hash("AAAAB3Nza"), "options": "from=x,token=" + Hash("abc"), "password": "[REDACTED]"},
+		{"key": "", "options": "", "password": "!"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("want %v, got %v", want, rows)
+	}
+	if want := (Counts{"drop": 1, "hash": 2, "mask": 1}); !reflect.DeepEqual(counts, want) {
+		t.Errorf("want counts %v, got %v", want, counts)
+	}
+
+	if Hash("a") != Hash("a") || Hash("a") == Hash("b") || !strings.HasPrefix(Hash("a"), "hmac:") {
+		t.Errorf("unexpected hashes %s, %s", Hash("a"), Hash("b"))
+	}
+}
+
+func TestContent(t *testing.T) {
+	rules := []*Rule{
+		{Action: "drop", Files: []string{"/etc/ssh/ssh_host_*_key"}},
+		{Action: "drop", Regex: `^\s*#`},
+		{Action: "mask", Files: []string{"shadow"}, Regex: `(?m)^([^:]+):[^:!*]+:`, Replacement: "$1:[REDACTED]:"},
+	}
+	if err := Compile(rules, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, keep, _ := Content(rules, "/etc/ssh/ssh_host_rsa_key", []byte("-----BEGIN")); keep {
+		t.Error("want the private key dropped")
+	}
+
+	content, keep, counts := Content(rules, "/etc/shadow", []byte("# users\nroot:$6$a$b:18000::\nbin:*:18000::\n"))
+	if want := "root:[REDACTED]:18000::\nbin:*:18000::\n"; !keep || string(content) != want {
+		t.Errorf("want %q, got %q (kept %v)", want, content, keep)
+	}
+	if want := (Counts{"drop": 1, "mask": 1}); !reflect.DeepEqual(counts, want) {
+		t.Errorf("want counts %v, got %v", want, counts)
+	}
+}
+
+func TestLoadSalt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := LoadSalt(dir); err != nil {
+		t.Fatal(err)
+	}
+	h := Hash("a")
+
+	fi, err := os.Stat(filepath.Join(dir, "redact.salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("want a 0600 salt file, got %v", fi.Mode())
+	}
+
+	// the saved salt is reused
+	salt = newSalt()
+	if err := LoadSalt(dir); err != nil {
+		t.Fatal(err)
+	}
+	if Hash("a") != h {
+		t.Errorf("want the hash %s of the saved salt, got %s", h, Hash("a"))
+	}
+}